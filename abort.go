@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// watchSignals turns SIGINT, SIGTERM and SIGHUP into an abort of the
+// install. The scripts run in their own process group so the terminal's
+// Ctrl+C only reaches them through here.
+func (r *stageRunner) watchSignals() (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			fmt.Fprintf(r.stdout, "==> Received %s, aborting after the current script\n", sig)
+			r.interrupt()
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
+
+// interrupt aborts the install: SIGINT goes to the process group of the
+// running script and no further scripts are started.
+func (r *stageRunner) interrupt() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.aborted = true
+	if r.current != nil && r.current.Process != nil {
+		syscall.Kill(-r.current.Process.Pid, syscall.SIGINT)
+	}
+}
+
+func (r *stageRunner) isAborted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.aborted
+}
+
+// aurSudoersDropIn gives the new user passwordless sudo while aur-pkgs.sh
+// runs, it must not outlive the stage.
+const aurSudoersDropIn = "/mnt/etc/sudoers.d/99-arch-matic-aur"
+
+// cleanupTarget leaves the disk in a state that is safe to power off or to
+// install again: the AUR sudoers drop-in is removed, swap on the install
+// device is turned off, everything under /mnt is unmounted and the LUKS
+// mappings on the install device are closed.
+func cleanupTarget(answers map[string]string, dryRun bool, out io.Writer) error {
+	device := answers["INSTALL_DEVICE"]
+	var commands [][]string
+
+	if _, err := os.Lstat(aurSudoersDropIn); err == nil {
+		commands = append(commands, []string{"rm", "-f", aurSudoersDropIn})
+	}
+
+	for _, swap := range targetSwaps(device) {
+		commands = append(commands, []string{"swapoff", swap})
+	}
+	if isMountpoint("/mnt") {
+		commands = append(commands, []string{"umount", "-R", "/mnt"})
+	}
+	for _, mapping := range cryptMappings(device) {
+		commands = append(commands, []string{"cryptsetup", "close", mapping})
+	}
+
+	var failed []string
+	for _, command := range commands {
+		if dryRun {
+			fmt.Fprintf(out, "[DRY RUN] Would execute: %s\n", strings.Join(command, " "))
+			continue
+		}
+		fmt.Fprintf(out, "==> %s\n", strings.Join(command, " "))
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if err := cmd.Run(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", strings.Join(command, " "), err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("cleanup incomplete: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// cryptMappings lists the dm-crypt mappings backed by a partition of device
+func cryptMappings(device string) []string {
+	if device == "" {
+		return nil
+	}
+	base := filepath.Base(device)
+	entries, _ := filepath.Glob("/sys/block/dm-*")
+
+	var mappings []string
+	for _, dm := range entries {
+		if !strings.HasPrefix(readSysfsString(filepath.Join(dm, "dm", "uuid")), "CRYPT-") {
+			continue
+		}
+		slaves, _ := os.ReadDir(filepath.Join(dm, "slaves"))
+		for _, slave := range slaves {
+			if strings.HasPrefix(slave.Name(), base) {
+				mappings = append(mappings, readSysfsString(filepath.Join(dm, "dm", "name")))
+				break
+			}
+		}
+	}
+	sort.Strings(mappings)
+	return mappings
+}
+
+// targetSwaps lists the active swap partitions on device or on a mapping
+// of it, the live system's own swap is left alone.
+func targetSwaps(device string) []string {
+	if device == "" {
+		return nil
+	}
+	file, err := os.Open("/proc/swaps")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	mappings := cryptMappings(device)
+	var swaps []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "Filename" {
+			continue
+		}
+		name := fields[0]
+		if strings.HasPrefix(name, device) || containsString(mappings, filepath.Base(name)) {
+			swaps = append(swaps, name)
+		}
+	}
+	return swaps
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// packageSourcesStepName is the built-in step that opens the local
+// repository and the live ISO's package cache to the pacman of the target,
+// last-cleanup.sh closes them again. It runs at the start of 4-post, once
+// the fstab has been written, so genfstab never sees the bind mounts.
+const packageSourcesStepName = "package-sources"
+
+const (
+	isoCacheDir    = "/var/cache/pacman/pkg"
+	targetISOCache = "/var/cache/pacman/iso" // the ISO cache as the target sees it
+	repoArch       = "x86_64"
+	cachePoolDir   = "pool" // downloads of cache build, kept for the next build
+	isoCacheMarker = "# arch-matic iso cache"
+)
+
+// repositoryConfig is the [repository] section of arch_config.toml
+type repositoryConfig struct {
+	Mirror   string `toml:"mirror,omitempty"`    // LAN or file:// mirror, e.g. http://10.0.0.2/archlinux/$repo/os/$arch
+	Local    string `toml:"local,omitempty"`     // directory made by arch-matic cache build
+	ISOCache bool   `toml:"iso_cache,omitempty"` // reuse the live ISO's package cache
+}
+
+// localRepoServer is the mirrorlist entry of a cache build directory
+func localRepoServer(dir string) string {
+	return "file://" + strings.TrimSuffix(dir, "/") + "/$repo/os/$arch"
+}
+
+// bindMount mounts source read-only on target, creating target first
+func bindMount(source, target string, dryRun bool, out io.Writer) error {
+	commands := [][]string{
+		{"mkdir", "-p", target},
+		{"mount", "--bind", source, target},
+		{"mount", "-o", "remount,bind,ro", target},
+	}
+	for _, command := range commands {
+		if dryRun {
+			fmt.Fprintf(out, "[DRY RUN] Would execute: %s\n", strings.Join(command, " "))
+			continue
+		}
+		fmt.Fprintf(out, "==> %s\n", strings.Join(command, " "))
+		if output, err := exec.Command(command[0], command[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %v: %s", strings.Join(command, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// packageSourcesStep is the package-sources step. The local repository is
+// mounted at its own path so the mirrorlist pacstrap copied resolves in the
+// chroot; the ISO cache becomes a second, read-only CacheDir.
+func (r *stageRunner) packageSourcesStep(index int, step installStep) error {
+	local := r.answers["LOCAL_REPO"]
+	isoCache := r.answers["REUSE_ISO_CACHE"] == "true"
+	if local == "" && !isoCache {
+		fmt.Fprintln(r.stdout, "==> No local repository or ISO cache configured, skipping")
+		return nil
+	}
+
+	if local != "" {
+		target := filepath.Join("/mnt", local)
+		if !r.dryRun && isMountpoint(target) {
+			fmt.Fprintf(r.stdout, "==> %s is already mounted\n", target)
+		} else if err := bindMount(local, target, r.dryRun, r.stdout); err != nil {
+			return err
+		}
+	}
+	if !isoCache {
+		return nil
+	}
+
+	target := filepath.Join("/mnt", targetISOCache)
+	if !r.dryRun && isMountpoint(target) {
+		fmt.Fprintf(r.stdout, "==> %s is already mounted\n", target)
+	} else if err := bindMount(isoCacheDir, target, r.dryRun, r.stdout); err != nil {
+		return err
+	}
+	// pacman downloads into the first writable CacheDir and finds packages
+	// in any of them. pacman.conf has no trailing comments, the marker line
+	// above the two lines lets last-cleanup.sh remove them.
+	conf := filepath.Join("/mnt", "etc", "pacman.conf")
+	if r.dryRun {
+		fmt.Fprintf(r.stdout, "[DRY RUN] Would add CacheDir %s/ and %s/ to %s\n", isoCacheDir, targetISOCache, conf)
+		return nil
+	}
+	data, err := os.ReadFile(conf)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", conf, err)
+	}
+	if strings.Contains(string(data), isoCacheMarker) {
+		return nil
+	}
+	cacheDirs := fmt.Sprintf("[options]\n%s\nCacheDir = %s/\nCacheDir = %s/\n", isoCacheMarker, isoCacheDir, targetISOCache)
+	updated := strings.Replace(string(data), "[options]\n", cacheDirs, 1)
+	if updated == string(data) {
+		return fmt.Errorf("no [options] section in %s", conf)
+	}
+	if err := os.WriteFile(conf, []byte(updated), 0644); err != nil {
+		return fmt.Errorf("error writing %s: %v", conf, err)
+	}
+	fmt.Fprintf(r.stdout, "==> Added the ISO package cache to %s\n", conf)
+	return nil
+}
+
+// cachedPackage is one file pacman would download for the config
+type cachedPackage struct {
+	Repo string
+	File string
+}
+
+// resolveCacheTargets asks pacman, against an empty local database, for
+// every file the names need including all their dependencies.
+func resolveCacheTargets(dbPath string, names []string) ([]cachedPackage, error) {
+	args := append([]string{"-Sp", "--dbpath", dbPath, "--noconfirm", "--print-format", "%r %f"}, names...)
+	output, err := exec.Command("pacman", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error resolving packages: %v", err)
+	}
+	var targets []cachedPackage
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			targets = append(targets, cachedPackage{Repo: fields[0], File: fields[1]})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("pacman resolved no packages")
+	}
+	return targets, nil
+}
+
+// linkOrCopy hard links source to target, copying across filesystems
+func linkOrCopy(source, target string) error {
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	if err := os.Link(source, target); err == nil {
+		return nil
+	}
+	return copyFile(source, target)
+}
+
+// runCommand runs a command with its output on out
+func runCommand(out io.Writer, name string, args ...string) error {
+	fmt.Fprintf(out, "==> %s %s\n", name, strings.Join(args, " "))
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v", name, err)
+	}
+	return nil
+}
+
+// buildPackageCache downloads every repository package of the config and
+// its dependencies to dir/pool, reusing the ISO cache, and lays them out
+// as a mirror: dir/<repo>/os/x86_64 with a database made by repo-add.
+func buildPackageCache(answers map[string]string, dir string, out io.Writer) error {
+	names, _, helper, err := plannedPackages(answers)
+	if err != nil {
+		return err
+	}
+	var official, aur []string
+	for _, name := range names {
+		if helper[name] {
+			aur = append(aur, name)
+		} else {
+			official = append(official, name)
+		}
+	}
+	if len(aur) > 0 {
+		fmt.Fprintf(out, "Warning: AUR packages are built at install time and not cached: %s\n", strings.Join(aur, " "))
+	}
+
+	pool := filepath.Join(dir, cachePoolDir)
+	if err := os.MkdirAll(pool, 0755); err != nil {
+		return fmt.Errorf("error creating %s: %v", pool, err)
+	}
+	dbPath, err := os.MkdirTemp("", "arch-matic-db")
+	if err != nil {
+		return fmt.Errorf("error creating a pacman database: %v", err)
+	}
+	defer os.RemoveAll(dbPath)
+
+	// A fresh database so packages installed on this machine are
+	// downloaded as dependencies too
+	if err := runCommand(out, "pacman", "-Sy", "--dbpath", dbPath); err != nil {
+		return err
+	}
+	targets, err := resolveCacheTargets(dbPath, official)
+	if err != nil {
+		return err
+	}
+	download := append([]string{"-Sw", "--dbpath", dbPath, "--cachedir", pool, "--cachedir", isoCacheDir, "--noconfirm"}, official...)
+	if err := runCommand(out, "pacman", download...); err != nil {
+		return err
+	}
+
+	files := make(map[string][]string)
+	for _, target := range targets {
+		repoDir := filepath.Join(dir, target.Repo, "os", repoArch)
+		if err := os.MkdirAll(repoDir, 0755); err != nil {
+			return fmt.Errorf("error creating %s: %v", repoDir, err)
+		}
+		found := false
+		for _, cache := range []string{pool, isoCacheDir} {
+			source := filepath.Join(cache, target.File)
+			if _, err := os.Stat(source); err != nil {
+				continue
+			}
+			if err := linkOrCopy(source, filepath.Join(repoDir, target.File)); err != nil {
+				return fmt.Errorf("error adding %s: %v", target.File, err)
+			}
+			if _, err := os.Stat(source + ".sig"); err == nil {
+				linkOrCopy(source+".sig", filepath.Join(repoDir, target.File+".sig"))
+			}
+			found = true
+			break
+		}
+		if !found {
+			return fmt.Errorf("%s was not downloaded", target.File)
+		}
+		files[target.Repo] = append(files[target.Repo], filepath.Join(repoDir, target.File))
+	}
+
+	var repos []string
+	for repo := range files {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		db := filepath.Join(dir, repo, "os", repoArch, repo+".db.tar.gz")
+		args := append([]string{"--quiet", "--include-sigs", db}, files[repo]...)
+		if err := runCommand(out, "repo-add", args...); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "  %-10s %d packages\n", repo, len(files[repo]))
+	}
+	fmt.Fprintf(out, "==> %d packages for %d names in %s\n", len(targets), len(official), dir)
+	fmt.Fprintf(out, "Set [repository] local = %q in the config to install from it, the mirrorlist entry is:\nServer = %s\n", dir, localRepoServer(dir))
+	return nil
+}
+
+// runCache implements "arch-matic cache build"
+func runCache(args []string) {
+	if len(args) == 0 || args[0] != "build" {
+		fmt.Println("Usage: arch-matic cache build [-config file] [-dir directory]")
+		os.Exit(1)
+	}
+	flags := flag.NewFlagSet("cache build", flag.ExitOnError)
+	configFile := flags.String("config", filepath.Join("install", "arch_config.toml"), "Configuration whose packages are cached")
+	dir := flags.String("dir", "arch-matic-repo", "Directory to build the offline repository in")
+	flags.Parse(args[1:])
+
+	answers, err := loadTOMLConfig(*configFile)
+	if err != nil {
+		fmt.Printf("Error loading %s: %v\n", *configFile, err)
+		os.Exit(1)
+	}
+	absDir, err := filepath.Abs(*dir)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := buildPackageCache(answers, absDir, os.Stdout); err != nil {
+		fmt.Printf("Error building the package cache: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSavedConfigIsPrivate(t *testing.T) {
+	dir := t.TempDir()
+	answers := map[string]string{"USERNAME": "ssnow", "USER_PASSWORD": "secret", "ROOT_PASSWORD": "secret"}
+	files := map[string]func(string) error{
+		"arch_config.toml": func(path string) error { return saveAnswersToFile(answers, path) },
+		"arch_config.cfg":  func(path string) error { return writeShellConfig(answers, path) },
+	}
+	for name, save := range files {
+		// An older run left the file readable by everyone
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := save(path); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("%s has mode %o, want 600", name, mode)
+		}
+	}
+}
+
+func TestConfigHashSurvivesSaveAndLoad(t *testing.T) {
+	tests := map[string]map[string]string{
+		"empty sections": {
+			"HOSTNAME": "arch", "USER_PASSWORD": "secret",
+			"PACMAN_MIRROR": "", "LOCAL_REPO": "", "REUSE_ISO_CACHE": "",
+			"EXTRA_PACKAGES": "", "EXTRA_AUR_PACKAGES": "", "EXTRA_PACKAGE_LISTS": "",
+			"DOTFILES_SOURCE": "", "DOTFILES_USER": "", "DOTFILES_METHOD": "",
+		},
+		"filled sections": {
+			"HOSTNAME": "arch", "PACMAN_MIRROR": "http://10.0.0.2/$repo/os/$arch", "REUSE_ISO_CACHE": "true",
+			"EXTRA_PACKAGES": " htop  ripgrep", "DOTFILES_SOURCE": "/root/dotfiles", "DOTFILES_METHOD": "stow",
+		},
+		"no sections": {"HOSTNAME": "arch", "FORMAT_TYPE": "btrfs"},
+	}
+	for name, answers := range tests {
+		path := filepath.Join(t.TempDir(), "arch_config.toml")
+		if err := writeConfigTOML(answers, path); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		loaded, err := loadTOMLConfig(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if configHash(loaded) != configHash(answers) {
+			t.Errorf("%s: hash changed from %v to %v", name, answers, loaded)
+		}
+		state := newInstallState(answers)
+		if err := state.verifyResume(loaded); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const desktopProfilesFile = "install/desktop_profiles.toml"
+
+// desktopProfile is one table of desktop_profiles.toml
+type desktopProfile struct {
+	Name           string
+	Description    string   `toml:"description"`
+	Packages       []string `toml:"packages"`
+	AUR            []string `toml:"aur"`
+	DisplayManager string   `toml:"display_manager"`
+	Session        string   `toml:"session"` // what the greetd greeter starts
+	Services       []string `toml:"services"`
+	Extras         []string `toml:"extras"`
+}
+
+// loadDesktopProfiles reads the profiles compiled into the binary
+func loadDesktopProfiles() ([]desktopProfile, error) {
+	data, err := installFiles.ReadFile(desktopProfilesFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading embedded desktop_profiles.toml: %v", err)
+	}
+	return decodeDesktopProfiles(data, "desktop_profiles.toml")
+}
+
+// decodeDesktopProfiles keeps the profiles in file order and rejects
+// unknown keys and malformed or repeated package names.
+func decodeDesktopProfiles(data []byte, filename string) ([]desktopProfile, error) {
+	var tables map[string]desktopProfile
+	meta, err := toml.Decode(string(data), &tables)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", filename, err)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("%s: unknown key %s", filename, undecoded[0])
+	}
+
+	var profiles []desktopProfile
+	var problems []string
+	for _, key := range meta.Keys() {
+		if len(key) != 1 {
+			continue
+		}
+		profile := tables[key[0]]
+		profile.Name = key[0]
+		seen := make(map[string]bool)
+		for _, name := range profile.allPackages() {
+			switch {
+			case !packageNamePattern.MatchString(name):
+				problems = append(problems, fmt.Sprintf("[%s] invalid package name %q", profile.Name, name))
+			case seen[name]:
+				problems = append(problems, fmt.Sprintf("[%s] lists %s twice", profile.Name, name))
+			}
+			seen[name] = true
+		}
+		if profile.DisplayManager == "greetd" && profile.Session == "" {
+			problems = append(problems, fmt.Sprintf("[%s] uses greetd without a session", profile.Name))
+		}
+		if len(profile.Services) > 0 && len(profile.Packages) == 0 {
+			problems = append(problems, fmt.Sprintf("[%s] enables services without installing packages", profile.Name))
+		}
+		profiles = append(profiles, profile)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s: %s", filename, strings.Join(problems, "; "))
+	}
+	return profiles, nil
+}
+
+func (p desktopProfile) allPackages() []string {
+	var names []string
+	names = append(names, p.Packages...)
+	names = append(names, p.AUR...)
+	return append(names, p.Extras...)
+}
+
+// preview is what the wizard shows under the highlighted profile
+func (p desktopProfile) preview() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", p.Description)
+	line := func(label string, values []string) {
+		if len(values) > 0 {
+			fmt.Fprintf(&b, "%-16s %s\n", label+":", strings.Join(values, " "))
+		}
+	}
+	line("Packages", p.Packages)
+	line("AUR", p.AUR)
+	if p.DisplayManager != "" {
+		line("Display manager", []string{p.DisplayManager})
+	}
+	line("Services", p.Services)
+	line("Extras", p.Extras)
+	return b.String()
+}
+
+func findDesktopProfile(profiles []desktopProfile, name string) (desktopProfile, bool) {
+	for _, profile := range profiles {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+	return desktopProfile{}, false
+}
+
+// desktopProfileNames lists the profiles for the wizard
+func desktopProfileNames(profiles []desktopProfile) []string {
+	var names []string
+	for _, profile := range profiles {
+		names = append(names, profile.Name)
+	}
+	return names
+}
+
+// desktopPreview shows what the highlighted profile of the wizard installs
+func desktopPreview(name string) string {
+	profiles, err := loadDesktopProfiles()
+	if err != nil {
+		return err.Error()
+	}
+	profile, _ := findDesktopProfile(profiles, name)
+	return profile.preview()
+}
+
+// checkAUR fails for a profile with AUR packages when aur-pkgs.sh will not
+// install them.
+func (p desktopProfile) checkAUR(helper string, answers map[string]string) error {
+	if len(p.AUR) == 0 {
+		return nil
+	}
+	if helper == "" || helper == "none" || answers[optionalScriptKey("aur-pkgs.sh")] == "false" {
+		return fmt.Errorf("the %s profile needs an AUR helper and aur-pkgs.sh for %s", p.Name, strings.Join(p.AUR, " "))
+	}
+	return nil
+}
+
+// validateDesktopAUR is the wizard check of AUR_HELPER against the profile
+func validateDesktopAUR(helper string, answers map[string]string) error {
+	profiles, err := loadDesktopProfiles()
+	if err != nil {
+		return err
+	}
+	profile, _ := findDesktopProfile(profiles, answers["DESKTOP_ENVIRONMENT"])
+	return profile.checkAUR(helper, answers)
+}
+
+// setDesktopAnswers writes what the chosen profile installs and enables:
+// DESKTOP_PACKAGES and DESKTOP_SESSION for desktop.sh, DESKTOP_AUR_PACKAGES
+// for aur-pkgs.sh and DISPLAY_MANAGER and DESKTOP_SERVICES for
+// last-cleanup.sh.
+func setDesktopAnswers(answers map[string]string) error {
+	profiles, err := loadDesktopProfiles()
+	if err != nil {
+		return err
+	}
+	name := answers["DESKTOP_ENVIRONMENT"]
+	if name == "" {
+		name = "none"
+	}
+	profile, ok := findDesktopProfile(profiles, name)
+	if !ok {
+		return fmt.Errorf("unknown desktop environment %q, use one of %s", name, strings.Join(desktopProfileNames(profiles), ", "))
+	}
+	if err := profile.checkAUR(answers["AUR_HELPER"], answers); err != nil {
+		return err
+	}
+
+	packages := profile.Packages
+	if answers["DESKTOP_EXTRAS"] != "false" {
+		packages = append(append([]string{}, packages...), profile.Extras...)
+	}
+	answers["DESKTOP_PACKAGES"] = strings.Join(packages, " ")
+	answers["DESKTOP_AUR_PACKAGES"] = strings.Join(profile.AUR, " ")
+	answers["DISPLAY_MANAGER"] = profile.DisplayManager
+	answers["DESKTOP_SESSION"] = profile.Session
+	answers["DESKTOP_SERVICES"] = strings.Join(profile.Services, " ")
+	return nil
+}
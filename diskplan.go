@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type plannedPartition struct {
+	Number   int    `json:"number"`
+	Device   string `json:"device"`
+	Start    string `json:"start"`
+	Size     string `json:"size"`
+	TypeCode string `json:"type_code"`
+	Label    string `json:"label"`
+}
+
+type plannedFilesystem struct {
+	Device string `json:"device"`
+	Type   string `json:"type"`
+	Label  string `json:"label"`
+}
+
+// plannedMount is a mount of the installed system, Target is relative to
+// its root so it reads the same in fstab and under /mnt.
+type plannedMount struct {
+	Source    string `json:"source"`
+	Target    string `json:"target"`
+	FSType    string `json:"fstype"`
+	Options   string `json:"options"`
+	Subvolume string `json:"subvolume,omitempty"`
+}
+
+// diskPlan is the layout the drive stage creates, computed from the config
+type diskPlan struct {
+	Device      string              `json:"device"`
+	FormatType  string              `json:"format_type"`
+	Partitions  []plannedPartition  `json:"partitions"`
+	Filesystems []plannedFilesystem `json:"filesystems"`
+	Subvolumes  []string            `json:"subvolumes,omitempty"`
+	Mounts      []plannedMount      `json:"mounts"`
+}
+
+// defaultSubvolumes is the SUBVOLUMES default of lib.sh
+const defaultSubvolumes = "@,@home,@var,@tmp,@.snapshots"
+
+var (
+	subvolumeName = regexp.MustCompile(`^@[A-Za-z0-9._-]*$`)
+	swapSize      = regexp.MustCompile(`^[1-9][0-9]*[MG]$`)
+)
+
+// parseSubvolumes reads the SUBVOLUMES answer the way format-btrfs.sh does.
+// "@" is the root and has to be there, the others are mounted on their
+// name without the @.
+func parseSubvolumes(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		value = defaultSubvolumes
+	}
+	var subvolumes []string
+	for _, name := range strings.Fields(strings.ReplaceAll(value, ",", " ")) {
+		switch {
+		case !subvolumeName.MatchString(name) || name == "@." || name == "@..":
+			return nil, fmt.Errorf("invalid subvolume %q, use @ followed by letters, digits, '.', '_' or '-'", name)
+		case containsString(subvolumes, name):
+			return nil, fmt.Errorf("subvolume %s is listed twice", name)
+		}
+		subvolumes = append(subvolumes, name)
+	}
+	if !containsString(subvolumes, "@") {
+		return nil, fmt.Errorf("the subvolumes need @ for the root filesystem")
+	}
+	return subvolumes, nil
+}
+
+// subvolumeTarget is where format-btrfs.sh mounts a subvolume
+func subvolumeTarget(subvolume string) string {
+	return "/" + strings.TrimPrefix(subvolume, "@")
+}
+
+// ext4MountOptions mirrors format-ext4.sh, MOUNT_OPTIONS holds btrfs options
+const ext4MountOptions = "noatime"
+
+func partitionDevice(device string, number int) string {
+	return device + getPartitionSuffix(device) + strconv.Itoa(number)
+}
+
+// buildDiskPlan mirrors partition-<format>.sh and format-<format>.sh
+func buildDiskPlan(answers map[string]string) (*diskPlan, error) {
+	device := answers["DEVICE"]
+	if device == "" {
+		device = answers["INSTALL_DEVICE"]
+	}
+	if device == "" {
+		return nil, fmt.Errorf("no install device configured")
+	}
+
+	partition := func(key string, number int) string {
+		if answers[key] != "" {
+			return answers[key]
+		}
+		return partitionDevice(device, number)
+	}
+	efi := partition("PARTITION_EFI", 2)
+	root := partition("PARTITION_ROOT", 3)
+
+	// Both partition scripts create the same partitions. The swap partition
+	// is made before the root partition, which takes the rest of the disk.
+	plan := &diskPlan{Device: device, FormatType: answers["FORMAT_TYPE"]}
+	plan.Partitions = []plannedPartition{
+		{Number: 1, Device: partitionDevice(device, 1), Start: "0", Size: "+1M", TypeCode: "ef02", Label: "BIOSBOOT"},
+		{Number: 2, Device: efi, Start: "0", Size: "+512M", TypeCode: "ef00", Label: "EFIBOOT"},
+	}
+	swap := ""
+	if size := answers["SWAP_SIZE"]; size != "" {
+		if !swapSize.MatchString(size) {
+			return nil, fmt.Errorf("invalid SWAP_SIZE %q, use a size like 8G or 512M", size)
+		}
+		swap = partition("PARTITION_SWAP", 5)
+		plan.Partitions = append(plan.Partitions, plannedPartition{Number: 5, Device: swap, Start: "-" + size, Size: "0", TypeCode: "8200", Label: "SWAP"})
+	}
+	plan.Partitions = append(plan.Partitions, plannedPartition{Number: 3, Device: root, Start: "0", Size: "0", TypeCode: "8300", Label: "ROOT"})
+
+	switch plan.FormatType {
+	case "btrfs":
+		subvolumes, err := parseSubvolumes(answers["SUBVOLUMES"])
+		if err != nil {
+			return nil, err
+		}
+		plan.Filesystems = []plannedFilesystem{
+			{Device: efi, Type: "vfat", Label: "EFIBOOT"},
+			{Device: root, Type: "btrfs", Label: "ROOT"},
+		}
+		plan.Subvolumes = subvolumes
+		// The root is mounted first, whatever its place in the list
+		mount := func(subvolume string) {
+			plan.Mounts = append(plan.Mounts, plannedMount{
+				Source:    root,
+				Target:    subvolumeTarget(subvolume),
+				FSType:    "btrfs",
+				Options:   answers["MOUNT_OPTIONS"] + ",subvol=" + subvolume,
+				Subvolume: subvolume,
+			})
+		}
+		mount("@")
+		for _, subvolume := range subvolumes {
+			if subvolume != "@" {
+				mount(subvolume)
+			}
+		}
+		plan.Mounts = append(plan.Mounts, plannedMount{Source: efi, Target: "/boot/efi", FSType: "vfat", Options: "defaults"})
+	case "ext4":
+		plan.Filesystems = []plannedFilesystem{
+			{Device: efi, Type: "vfat", Label: "EFIBOOT"},
+			{Device: root, Type: "ext4", Label: "ROOT"},
+		}
+		plan.Mounts = []plannedMount{
+			{Source: root, Target: "/", FSType: "ext4", Options: ext4MountOptions},
+			{Source: efi, Target: "/boot/efi", FSType: "vfat", Options: "defaults"},
+		}
+	default:
+		return nil, fmt.Errorf("no disk layout for format type %q", plan.FormatType)
+	}
+	if swap != "" {
+		plan.Filesystems = append(plan.Filesystems, plannedFilesystem{Device: swap, Type: "swap", Label: "SWAP"})
+	}
+	return plan, nil
+}
+
+// sizeText is the human readable size of the sgdisk start and end
+func (p plannedPartition) sizeText() string {
+	switch {
+	case strings.HasPrefix(p.Start, "-"):
+		return p.Start[1:] + " at the end of the disk"
+	case p.Size == "0":
+		return "rest of disk"
+	}
+	return p.Size[1:]
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// dotfilesStepName is the built-in step of 7-post-setup that imports the
+// [dotfiles] section: the source is copied or cloned to ~/.dotfiles of the
+// target user and its files are linked or copied into the home directory.
+const (
+	dotfilesStepName = "dotfiles"
+	dotfilesDir      = ".dotfiles"
+)
+
+// dotfilesConfig is the [dotfiles] section of arch_config.toml
+type dotfilesConfig struct {
+	Source string `toml:"source"`           // directory or git repository on the ISO
+	User   string `toml:"user,omitempty"`   // defaults to USERNAME
+	Method string `toml:"method,omitempty"` // stow (default) or copy
+}
+
+// targetUser is an account of the installed system
+type targetUser struct {
+	Name string
+	UID  int
+	GID  int
+	Home string
+}
+
+// lookupTargetUser reads a user from the passwd file of the system at root
+func lookupTargetUser(root, name string) (*targetUser, error) {
+	data, err := os.ReadFile(filepath.Join(root, "etc", "passwd"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading the users of the target: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 || fields[0] != name {
+			continue
+		}
+		uid, uidErr := strconv.Atoi(fields[2])
+		gid, gidErr := strconv.Atoi(fields[3])
+		if uidErr != nil || gidErr != nil {
+			return nil, fmt.Errorf("invalid passwd entry for %s", name)
+		}
+		return &targetUser{Name: name, UID: uid, GID: gid, Home: fields[5]}, nil
+	}
+	return nil, fmt.Errorf("user %s does not exist on the target", name)
+}
+
+// isGitSource tells whether source is a git repository, a working tree or
+// a bare one, so it is cloned rather than copied.
+func isGitSource(source string) bool {
+	for _, marker := range []string{".git", "HEAD"} {
+		if _, err := os.Stat(filepath.Join(source, marker)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// dotfilesPackages returns the directories whose contents mirror the home
+// directory. A repository with dot entries at its top, git and stow
+// metadata aside, is itself the mirror; otherwise every top-level directory
+// is a package, as stow sees it, and top-level files such as a README are
+// left out.
+func dotfilesPackages(repo string) ([]string, error) {
+	entries, err := os.ReadDir(repo)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", repo, err)
+	}
+	var packages []string
+	for _, entry := range entries {
+		switch {
+		case strings.HasPrefix(entry.Name(), ".git"), strings.HasPrefix(entry.Name(), ".stow"):
+			continue
+		case strings.HasPrefix(entry.Name(), "."):
+			return []string{repo}, nil
+		case entry.IsDir():
+			packages = append(packages, filepath.Join(repo, entry.Name()))
+		}
+	}
+	return packages, nil
+}
+
+// dotfilesInstaller applies the packages of a dotfiles repository to the
+// home directory of a user, home being the path as seen from the live
+// system.
+type dotfilesInstaller struct {
+	user     *targetUser
+	home     string
+	method   string
+	linked   int
+	backedUp []string
+}
+
+// install links or copies every file of a package, directories are
+// created as needed so a package never replaces a whole directory.
+func (d *dotfilesInstaller) install(pkg string) error {
+	return filepath.WalkDir(pkg, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(pkg, path)
+		if entry.IsDir() {
+			if entry.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return d.mkdir(filepath.Join(d.home, rel))
+		}
+		return d.place(path, filepath.Join(d.home, rel))
+	})
+}
+
+func (d *dotfilesInstaller) mkdir(dir string) error {
+	if _, err := os.Lstat(dir); err == nil {
+		return nil
+	}
+	if err := d.mkdir(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return fmt.Errorf("error creating %s: %v", dir, err)
+	}
+	return os.Lchown(dir, d.user.UID, d.user.GID)
+}
+
+// place puts one file at target. Links are relative so they still resolve
+// once the target is booted; a file already at target is kept as .orig,
+// unless an earlier attempt already kept one.
+func (d *dotfilesInstaller) place(source, target string) error {
+	link, err := filepath.Rel(filepath.Dir(target), source)
+	if err != nil {
+		return err
+	}
+	if current, err := os.Readlink(target); err == nil && current == link && d.method != "copy" {
+		return nil
+	}
+	if _, err := os.Lstat(target); err == nil {
+		if _, err := os.Lstat(target + ".orig"); err == nil {
+			err = os.Remove(target)
+		} else {
+			err = os.Rename(target, target+".orig")
+			d.backedUp = append(d.backedUp, target)
+		}
+		if err != nil {
+			return fmt.Errorf("error backing up %s: %v", target, err)
+		}
+	}
+
+	if d.method == "copy" {
+		err = copyDotfile(source, target)
+	} else {
+		err = os.Symlink(link, target)
+	}
+	if err != nil {
+		return fmt.Errorf("error installing %s: %v", target, err)
+	}
+	d.linked++
+	return os.Lchown(target, d.user.UID, d.user.GID)
+}
+
+// copyDotfile copies a regular file with its mode, a symlink as a symlink
+func copyDotfile(source, target string) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	}
+	if err := copyFile(source, target); err != nil {
+		return err
+	}
+	return os.Chmod(target, info.Mode().Perm())
+}
+
+// chownTree hands a directory tree to the user
+func chownTree(root string, uid, gid int) error {
+	return filepath.WalkDir(root, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+// importDotfiles copies or clones source to repo, replacing an earlier
+// import so a retried step starts over.
+func importDotfiles(source, repo string, out io.Writer) error {
+	if err := os.RemoveAll(repo); err != nil {
+		return fmt.Errorf("error removing %s: %v", repo, err)
+	}
+	var cmd *exec.Cmd
+	if isGitSource(source) {
+		cmd = exec.Command("git", "clone", "--quiet", source, repo)
+	} else {
+		if err := os.MkdirAll(repo, 0755); err != nil {
+			return fmt.Errorf("error creating %s: %v", repo, err)
+		}
+		cmd = exec.Command("cp", "-a", strings.TrimSuffix(source, "/")+"/.", repo)
+	}
+	fmt.Fprintf(out, "==> %s\n", strings.Join(cmd.Args, " "))
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error importing dotfiles from %s: %v", source, err)
+	}
+	return nil
+}
+
+// dotfilesSettings returns the source, user and method of the [dotfiles]
+// section with their defaults.
+func dotfilesSettings(answers map[string]string) (source, user, method string, err error) {
+	source, user, method = answers["DOTFILES_SOURCE"], answers["DOTFILES_USER"], answers["DOTFILES_METHOD"]
+	if user == "" {
+		user = answers["USERNAME"]
+	}
+	if method == "" {
+		method = "stow"
+	}
+	if method != "stow" && method != "copy" {
+		return "", "", "", fmt.Errorf("unknown dotfiles method %q, use stow or copy", method)
+	}
+	return source, user, method, nil
+}
+
+// dotfilesStep is the dotfiles step, it does nothing without a source
+func (r *stageRunner) dotfilesStep(index int, step installStep) error {
+	source, user, method, err := dotfilesSettings(r.answers)
+	if err != nil {
+		return err
+	}
+	if source == "" {
+		fmt.Fprintln(r.stdout, "==> No dotfiles source configured, skipping")
+		return nil
+	}
+	if _, err := os.Stat(source); err != nil {
+		if !r.dryRun {
+			return fmt.Errorf("dotfiles source: %v", err)
+		}
+		fmt.Fprintf(r.stdout, "[DRY RUN] Dotfiles source: %v\n", err)
+	}
+	if r.dryRun {
+		fmt.Fprintf(r.stdout, "[DRY RUN] Would import %s to ~%s/%s and %s its files into the home directory\n", source, user, dotfilesDir, method)
+		return nil
+	}
+
+	account, err := lookupTargetUser("/mnt", user)
+	if err != nil {
+		return err
+	}
+	home := filepath.Join("/mnt", account.Home)
+	repo := filepath.Join(home, dotfilesDir)
+	if err := importDotfiles(source, repo, r.stdout); err != nil {
+		return err
+	}
+	if err := chownTree(repo, account.UID, account.GID); err != nil {
+		return fmt.Errorf("error handing %s to %s: %v", repo, user, err)
+	}
+
+	packages, err := dotfilesPackages(repo)
+	if err != nil {
+		return err
+	}
+	installer := &dotfilesInstaller{user: account, home: home, method: method}
+	for _, pkg := range packages {
+		if err := installer.install(pkg); err != nil {
+			return err
+		}
+	}
+	for _, file := range installer.backedUp {
+		r.recordEvent(index, step, installEvent{Type: eventWarning, Message: fmt.Sprintf("dotfiles: kept the existing %s as %s.orig", strings.TrimPrefix(file, "/mnt"), filepath.Base(file))})
+	}
+	fmt.Fprintf(r.stdout, "==> Dotfiles: %d files (%s) from %d packages into %s, %d existing files kept as .orig\n",
+		installer.linked, method, len(packages), account.Home, len(installer.backedUp))
+	return nil
+}
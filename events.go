@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// The install scripts write one JSON object per line to the file descriptor
+// named by ARCH_MATIC_EVENT_FD, see emit_event in lib.sh. The runner adds the
+// stage events itself and fills in the stage and script of each event.
+const (
+	eventFD      = 3
+	eventFDEnv   = "ARCH_MATIC_EVENT_FD"
+	eventLogName = "install-events.jsonl"
+)
+
+// Event types
+const (
+	eventStageStart   = "stage_start"
+	eventStageEnd     = "stage_end"
+	eventProcessStart = "process_start"
+	eventProcessEnd   = "process_end"
+	eventStepStart    = "step_start"
+	eventStepEnd      = "step_end"
+	eventWarning      = "warning"
+	eventError        = "error"
+	eventProgress     = "progress"
+	eventRetry        = "retry"
+	eventCheck        = "check"
+	eventPackage      = "package"
+	eventDryRun       = "dry_run" // a command a dry run skipped, as written
+)
+
+type installEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Stage    string    `json:"stage,omitempty"`
+	Script   string    `json:"script,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	Percent  *float64  `json:"percent,omitempty"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+	Passed   *bool     `json:"passed,omitempty"`
+}
+
+// decodeEvents reads events until r is closed. A line that is not valid
+// JSON is passed on as a warning so a broken emitter does not go unnoticed.
+func decodeEvents(r io.Reader, fn func(installEvent)) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var event installEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil || event.Type == "" {
+			event = installEvent{Type: eventWarning, Message: "invalid install event: " + line}
+		}
+		if event.Time.IsZero() {
+			event.Time = time.Now()
+		}
+		fn(event)
+	}
+}
+
+// writeEvent appends an event to the JSON lines log
+func writeEvent(w io.Writer, event installEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
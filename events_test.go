@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The decoders of a script and its background children record events
+// while the run loop records its own, run with -race.
+func TestRecordEventConcurrently(t *testing.T) {
+	runner := newStageRunner(t.TempDir(), map[string]string{}, true, false)
+	var log bytes.Buffer
+	runner.eventLog = &log
+	var received sync.Map
+	runner.onEvent = func(event runnerEvent) { received.Store(event.Event.Message, true) }
+
+	step := installStep{Stage: "4-post", Script: "aur-pkgs.sh"}
+	const writers, events = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < events; j++ {
+				runner.recordEvent(0, step, installEvent{Type: eventPackage, Message: fmt.Sprintf("package-%d-%d", i, j)})
+			}
+		}()
+	}
+	wg.Wait()
+
+	count := 0
+	decodeEvents(strings.NewReader(log.String()), func(event installEvent) {
+		count++
+		if event.Type != eventPackage || event.Script != "aur-pkgs.sh" {
+			t.Errorf("garbled event %+v", event)
+		}
+		if _, ok := received.Load(event.Message); !ok {
+			t.Errorf("%s was logged but not passed on", event.Message)
+		}
+	})
+	if count != writers*events || len(runner.packages) != writers*events {
+		t.Errorf("logged %d events and %d packages, want %d", count, len(runner.packages), writers*events)
+	}
+}
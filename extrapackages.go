@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// userPackagesConfig is the [packages] section of arch_config.toml: the
+// team's own packages on top of the groups and the desktop profile.
+type userPackagesConfig struct {
+	Official []string `toml:"official,omitempty"`
+	AUR      []string `toml:"aur,omitempty"`
+	Lists    []string `toml:"lists,omitempty"` // files or http(s) URLs of package lists
+}
+
+// configSections are the tables of arch_config.toml besides [install] and
+// [variables]. They reach the scripts flattened into variables.
+type configSections struct {
+	Packages   *userPackagesConfig `toml:"packages,omitempty"`
+	Dotfiles   *dotfilesConfig     `toml:"dotfiles,omitempty"`
+	Repository *repositoryConfig   `toml:"repository,omitempty"`
+}
+
+// flatten adds the sections to variables as EXTRA_*, DOTFILES_*,
+// PACMAN_MIRROR, LOCAL_REPO and REUSE_ISO_CACHE
+func (s configSections) flatten(variables map[string]string) map[string]string {
+	if variables == nil {
+		variables = make(map[string]string)
+	}
+	if s.Packages != nil {
+		variables["EXTRA_PACKAGES"] = strings.Join(s.Packages.Official, " ")
+		variables["EXTRA_AUR_PACKAGES"] = strings.Join(s.Packages.AUR, " ")
+		variables["EXTRA_PACKAGE_LISTS"] = strings.Join(s.Packages.Lists, " ")
+	}
+	if s.Dotfiles != nil {
+		variables["DOTFILES_SOURCE"] = s.Dotfiles.Source
+		variables["DOTFILES_USER"] = s.Dotfiles.User
+		variables["DOTFILES_METHOD"] = s.Dotfiles.Method
+	}
+	if s.Repository != nil {
+		variables["PACMAN_MIRROR"] = s.Repository.Mirror
+		variables["LOCAL_REPO"] = s.Repository.Local
+		variables["REUSE_ISO_CACHE"] = fmt.Sprintf("%t", s.Repository.ISOCache)
+	}
+	return variables
+}
+
+// splitConfigSections is the reverse of flatten for saving a config
+func splitConfigSections(answers map[string]string) (map[string]string, configSections) {
+	variables := make(map[string]string, len(answers))
+	for key, value := range answers {
+		variables[key] = value
+	}
+
+	var sections configSections
+	take := func(key string) string {
+		value := variables[key]
+		delete(variables, key)
+		return value
+	}
+	official, aur, lists := take("EXTRA_PACKAGES"), take("EXTRA_AUR_PACKAGES"), take("EXTRA_PACKAGE_LISTS")
+	if official+aur+lists != "" {
+		sections.Packages = &userPackagesConfig{
+			Official: strings.Fields(official),
+			AUR:      strings.Fields(aur),
+			Lists:    strings.Fields(lists),
+		}
+	}
+	source, user, method := take("DOTFILES_SOURCE"), take("DOTFILES_USER"), take("DOTFILES_METHOD")
+	if source != "" {
+		sections.Dotfiles = &dotfilesConfig{Source: source, User: user, Method: method}
+	}
+	mirror, local, isoCache := take("PACMAN_MIRROR"), take("LOCAL_REPO"), take("REUSE_ISO_CACHE")
+	if mirror != "" || local != "" || isoCache == "true" {
+		sections.Repository = &repositoryConfig{Mirror: mirror, Local: local, ISOCache: isoCache == "true"}
+	}
+	return variables, sections
+}
+
+// normalizeConfig returns answers the way saving and loading the config
+// does: empty sections are dropped and their lists respaced.
+func normalizeConfig(answers map[string]string) map[string]string {
+	variables, sections := splitConfigSections(answers)
+	return sections.flatten(variables)
+}
+
+// readPackageList reads a package list from a file or an http(s) URL. One
+// package per line, # starts a comment; "aur/name" marks an AUR package and
+// other repository prefixes such as "extra/name" are dropped, so the output
+// of pacman -Qqe or paru -Sl can be used as is.
+func readPackageList(location string) (official, aur []string, err error) {
+	var r io.Reader
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		client := http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Get(location)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error fetching package list %s: %v", location, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil, fmt.Errorf("error fetching package list %s: %s", location, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		file, err := os.Open(strings.TrimPrefix(location, "file://"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading package list: %v", err)
+		}
+		defer file.Close()
+		r = file
+	}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		repo, name, found := strings.Cut(fields[0], "/")
+		if !found {
+			repo, name = "", fields[0]
+		}
+		if !packageNamePattern.MatchString(name) {
+			return nil, nil, fmt.Errorf("%s:%d: invalid package name %q", location, line, fields[0])
+		}
+		if repo == "aur" {
+			aur = append(aur, name)
+		} else {
+			official = append(official, name)
+		}
+	}
+	return official, aur, scanner.Err()
+}
+
+// setUserPackageAnswers resolves the [packages] section into USER_PACKAGES,
+// installed by system-pkgs.sh, and USER_AUR_PACKAGES for aur-pkgs.sh.
+// Names are kept once, in the order they are listed.
+func setUserPackageAnswers(answers map[string]string) error {
+	official := strings.Fields(answers["EXTRA_PACKAGES"])
+	aur := strings.Fields(answers["EXTRA_AUR_PACKAGES"])
+	for _, location := range strings.Fields(answers["EXTRA_PACKAGE_LISTS"]) {
+		listOfficial, listAUR, err := readPackageList(location)
+		if err != nil {
+			return err
+		}
+		official = append(official, listOfficial...)
+		aur = append(aur, listAUR...)
+	}
+	for _, name := range append(append([]string{}, official...), aur...) {
+		if !packageNamePattern.MatchString(name) {
+			return fmt.Errorf("[packages] invalid package name %q", name)
+		}
+	}
+	if helper := answers["AUR_HELPER"]; len(aur) > 0 && (helper == "" || helper == "none" || answers[optionalScriptKey("aur-pkgs.sh")] == "false") {
+		return fmt.Errorf("[packages] needs an AUR helper and aur-pkgs.sh for %s", strings.Join(aur, " "))
+	}
+
+	answers["USER_PACKAGES"] = strings.Join(uniqueStrings(official), " ")
+	answers["USER_AUR_PACKAGES"] = strings.Join(uniqueStrings(aur), " ")
+	return nil
+}
+
+func uniqueStrings(values []string) []string {
+	var unique []string
+	for _, value := range values {
+		if !containsString(unique, value) {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testPackageList = `# team packages, pacman -Qqe style
+htop
+extra/ripgrep   # repository prefixes are dropped
+aur/spotify
+
+core/base
+`
+
+func TestReadPackageList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "packages.txt")
+	if err := os.WriteFile(path, []byte(testPackageList), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/packages.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, testPackageList)
+	}))
+	defer server.Close()
+
+	for _, location := range []string{path, "file://" + path, server.URL + "/packages.txt"} {
+		official, aur, err := readPackageList(location)
+		if err != nil {
+			t.Errorf("%s: %v", location, err)
+			continue
+		}
+		if !reflect.DeepEqual(official, []string{"htop", "ripgrep", "base"}) || !reflect.DeepEqual(aur, []string{"spotify"}) {
+			t.Errorf("%s: official %v, aur %v", location, official, aur)
+		}
+	}
+
+	if _, _, err := readPackageList(server.URL + "/missing.txt"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("missing URL: got %v", err)
+	}
+	bad := filepath.Join(t.TempDir(), "bad.txt")
+	os.WriteFile(bad, []byte("htop\nNot A Package\n"), 0644)
+	if _, _, err := readPackageList(bad); err == nil || !strings.Contains(err.Error(), ":2: invalid package name") {
+		t.Errorf("invalid name: got %v", err)
+	}
+}
+
+func TestSetUserPackageAnswers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "packages.txt")
+	if err := os.WriteFile(path, []byte(testPackageList), 0644); err != nil {
+		t.Fatal(err)
+	}
+	answers := map[string]string{
+		"EXTRA_PACKAGES":      "htop git",
+		"EXTRA_PACKAGE_LISTS": path,
+		"AUR_HELPER":          "paru",
+	}
+	if err := setUserPackageAnswers(answers); err != nil {
+		t.Fatal(err)
+	}
+	if answers["USER_PACKAGES"] != "htop git ripgrep base" || answers["USER_AUR_PACKAGES"] != "spotify" {
+		t.Errorf("USER_PACKAGES %q, USER_AUR_PACKAGES %q", answers["USER_PACKAGES"], answers["USER_AUR_PACKAGES"])
+	}
+
+	answers["AUR_HELPER"] = "none"
+	if err := setUserPackageAnswers(answers); err == nil {
+		t.Errorf("AUR packages without a helper: expected an error")
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fstabStepName is the built-in step of 3-base that writes /etc/fstab from
+// the disk plan. generate-fstab.sh leaves an fstab carrying fstabHeader
+// alone and only falls back on genfstab without it.
+const (
+	fstabStepName = "write-fstab"
+	fstabHeader   = "# Generated by arch-matic from the disk plan"
+)
+
+// espOptions keep the ESP readable by root only. genfstab copies the
+// options of the live mount instead, and the vfat defaults there
+// (fmask=0022,dmask=0022) leave it readable by everyone.
+const espOptions = "rw,relatime,umask=0077,codepage=437,iocharset=ascii,shortname=mixed,utf8,errors=remount-ro"
+
+type fstabEntry struct {
+	Source  string
+	Target  string
+	FSType  string
+	Options string
+	Dump    int
+	Pass    int
+	Device  string // the block device Source resolves to, if any
+}
+
+func (e fstabEntry) String() string {
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%d %d", e.Source, e.Target, e.FSType, e.Options, e.Dump, e.Pass)
+}
+
+// subvolume returns the subvol= option without its leading slash
+func (e fstabEntry) subvolume() string {
+	for _, option := range strings.Split(e.Options, ",") {
+		if value, found := strings.CutPrefix(option, "subvol="); found {
+			return strings.TrimPrefix(value, "/")
+		}
+	}
+	return ""
+}
+
+// blockIDs reads UUID, PARTUUID and LABEL of a device with blkid
+func blockIDs(device string) (map[string]string, error) {
+	output, err := exec.Command("blkid", "-o", "export", device).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error reading the ids of %s: %v", device, err)
+	}
+	ids := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if key, value, found := strings.Cut(strings.TrimSpace(line), "="); found {
+			ids[key] = value
+		}
+	}
+	return ids, nil
+}
+
+// fstabSource names device the way FSTAB_ID asks for: uuid (the default),
+// partuuid or label.
+func fstabSource(device, idType string, ids map[string]string) (string, error) {
+	key := strings.ToUpper(idType)
+	if key == "" {
+		key = "UUID"
+	}
+	if key != "UUID" && key != "PARTUUID" && key != "LABEL" {
+		return "", fmt.Errorf("unknown FSTAB_ID %q, use uuid, partuuid or label", idType)
+	}
+	if ids[key] == "" {
+		return "", fmt.Errorf("%s has no %s", device, key)
+	}
+	return key + "=" + ids[key], nil
+}
+
+// buildFstab turns the disk plan into fstab entries. lookup returns the
+// blkid ids of a device; a dry run passes nil and gets the device paths.
+func buildFstab(plan *diskPlan, idType string, lookup func(device string) (map[string]string, error)) ([]fstabEntry, error) {
+	source := func(device string) (string, error) {
+		if lookup == nil {
+			return device, nil
+		}
+		ids, err := lookup(device)
+		if err != nil {
+			return "", err
+		}
+		return fstabSource(device, idType, ids)
+	}
+
+	var entries []fstabEntry
+	hasTmp := false
+	for _, m := range plan.Mounts {
+		src, err := source(m.Source)
+		if err != nil {
+			return nil, err
+		}
+		entry := fstabEntry{Source: src, Target: m.Target, FSType: m.FSType, Device: m.Source}
+		switch {
+		case m.Subvolume != "":
+			entry.Options = "rw," + strings.TrimSuffix(m.Options, ",subvol="+m.Subvolume) + ",subvol=/" + m.Subvolume
+		case m.FSType == "vfat":
+			entry.Options = espOptions
+			entry.Pass = 2
+		default:
+			entry.Options = m.Options
+			if m.Target == "/" {
+				entry.Pass = 1
+			} else {
+				entry.Pass = 2
+			}
+		}
+		hasTmp = hasTmp || m.Target == "/tmp"
+		entries = append(entries, entry)
+	}
+
+	for _, fs := range plan.Filesystems {
+		if fs.Type != "swap" {
+			continue
+		}
+		src, err := source(fs.Device)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fstabEntry{Source: src, Target: "none", FSType: "swap", Options: "defaults", Device: fs.Device})
+	}
+	// Without a /tmp subvolume or partition /tmp lives in memory
+	if !hasTmp {
+		entries = append(entries, fstabEntry{Source: "tmpfs", Target: "/tmp", FSType: "tmpfs", Options: "rw,nosuid,nodev,size=50%"})
+	}
+	return entries, validateFstab(plan, entries)
+}
+
+// validateFstab catches plans whose fstab would not boot: a mount point
+// used twice, no root filesystem or a btrfs subvolume that is not mounted.
+func validateFstab(plan *diskPlan, entries []fstabEntry) error {
+	var problems []string
+	seen := make(map[string]bool)
+	mounted := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.FSType == "swap" {
+			continue
+		}
+		if seen[entry.Target] {
+			problems = append(problems, "duplicate mount point "+entry.Target)
+		}
+		seen[entry.Target] = true
+		mounted[entry.subvolume()] = true
+	}
+	if !seen["/"] {
+		problems = append(problems, "no root filesystem")
+	}
+	for _, subvolume := range plan.Subvolumes {
+		if !mounted[subvolume] {
+			problems = append(problems, "subvolume "+subvolume+" is not mounted")
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid fstab: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// parseFstab reads fstab lines, comments and blank lines are skipped
+func parseFstab(text string) []fstabEntry {
+	var entries []fstabEntry
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		entry := fstabEntry{Source: fields[0], Target: fields[1], FSType: fields[2], Options: fields[3]}
+		if len(fields) >= 6 {
+			fmt.Sscan(fields[4], &entry.Dump)
+			fmt.Sscan(fields[5], &entry.Pass)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// diffFstab compares the generated entries with what genfstab sees mounted
+// under /mnt. Devices are compared rather than the sources so any FSTAB_ID
+// can be checked against genfstab -U; options other than subvol are left to
+// the config.
+func diffFstab(generated, mounted []fstabEntry, devices map[string]string) []string {
+	key := func(e fstabEntry) string {
+		if e.FSType == "swap" {
+			return "swap " + e.Device
+		}
+		return e.Target
+	}
+
+	var problems []string
+	want := make(map[string]fstabEntry)
+	for _, entry := range generated {
+		if entry.Device != "" {
+			want[key(entry)] = entry
+		}
+	}
+	have := make(map[string]fstabEntry)
+	for _, entry := range mounted {
+		if !strings.Contains(entry.Source, "=") && !strings.HasPrefix(entry.Source, "/dev/") {
+			continue
+		}
+		entry.Device = devices[entry.Source]
+		if entry.Device == "" {
+			entry.Device, _ = resolveDevice(entry.Source)
+		}
+		if _, dup := have[key(entry)]; dup {
+			problems = append(problems, fmt.Sprintf("%s is mounted twice", entry.Target))
+		}
+		have[key(entry)] = entry
+	}
+
+	var keys []string
+	for k := range want {
+		keys = append(keys, k)
+	}
+	for k := range have {
+		if _, ok := want[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		w, inPlan := want[k]
+		h, isMounted := have[k]
+		switch {
+		case !isMounted:
+			problems = append(problems, fmt.Sprintf("%s is in the plan but not mounted", k))
+		case !inPlan:
+			problems = append(problems, fmt.Sprintf("%s (%s) is mounted but not in the plan", k, h.Source))
+		case w.Device != h.Device:
+			problems = append(problems, fmt.Sprintf("%s: planned %s, mounted %s", k, w.Device, h.Device))
+		case w.FSType != h.FSType:
+			problems = append(problems, fmt.Sprintf("%s: planned %s, mounted %s", k, w.FSType, h.FSType))
+		case w.subvolume() != h.subvolume():
+			problems = append(problems, fmt.Sprintf("%s: planned subvolume %q, mounted %q", k, w.subvolume(), h.subvolume()))
+		}
+	}
+	return problems
+}
+
+func formatFstab(entries []fstabEntry) string {
+	var b strings.Builder
+	b.WriteString(fstabHeader + "\n")
+	b.WriteString("# <file system>\t<dir>\t<type>\t<options>\t<dump> <pass>\n")
+	for _, entry := range entries {
+		b.WriteString(entry.String() + "\n")
+	}
+	return b.String()
+}
+
+// fstabStep is the write-fstab step: it writes /mnt/etc/fstab from the disk
+// plan and fails when genfstab -U disagrees with it.
+func (r *stageRunner) fstabStep(index int, step installStep) error {
+	plan, err := buildDiskPlan(r.answers)
+	if err != nil {
+		return err
+	}
+
+	if r.dryRun {
+		entries, err := buildFstab(plan, r.answers["FSTAB_ID"], nil)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(r.stdout, "[DRY RUN] Would write /mnt/etc/fstab and compare it with genfstab -U /mnt:")
+		fmt.Fprint(r.stdout, formatFstab(entries))
+		return nil
+	}
+
+	devices := make(map[string]string)
+	lookup := func(device string) (map[string]string, error) {
+		ids, err := blockIDs(device)
+		for _, key := range []string{"UUID", "PARTUUID", "LABEL"} {
+			if ids[key] != "" {
+				devices[key+"="+ids[key]] = device
+			}
+		}
+		return ids, err
+	}
+	entries, err := buildFstab(plan, r.answers["FSTAB_ID"], lookup)
+	if err != nil {
+		return err
+	}
+
+	output, err := exec.Command("genfstab", "-U", "/mnt").Output()
+	if err != nil {
+		return fmt.Errorf("error running genfstab: %v", err)
+	}
+	if problems := diffFstab(entries, parseFstab(string(output)), devices); len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(r.stdout, "  [FAIL] %s\n", problem)
+			r.recordEvent(index, step, installEvent{Type: eventError, Message: "fstab: " + problem})
+		}
+		return fmt.Errorf("fstab does not match the mounted target: %d problems", len(problems))
+	}
+
+	fstab := filepath.Join("/mnt", "etc", "fstab")
+	if err := os.MkdirAll(filepath.Dir(fstab), 0755); err != nil {
+		return fmt.Errorf("error creating %s: %v", filepath.Dir(fstab), err)
+	}
+	if err := os.WriteFile(fstab, []byte(formatFstab(entries)), 0644); err != nil {
+		return fmt.Errorf("error writing %s: %v", fstab, err)
+	}
+	fmt.Fprintf(r.stdout, "==> Wrote %s with %d entries, matches genfstab -U\n", fstab, len(entries))
+	return nil
+}
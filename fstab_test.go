@@ -0,0 +1,196 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testBlockIDs(device string) (map[string]string, error) {
+	ids := map[string]map[string]string{
+		"/dev/nvme0n1p2": {"UUID": "ABCD-1234", "PARTUUID": "part-2", "LABEL": "EFIBOOT"},
+		"/dev/nvme0n1p3": {"UUID": "root-uuid", "PARTUUID": "part-3", "LABEL": "ROOT"},
+	}
+	return ids[device], nil
+}
+
+func TestBuildFstab(t *testing.T) {
+	plan, err := buildDiskPlan(planTestAnswers("btrfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := buildFstab(plan, "", testBlockIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, entry := range entries {
+		lines = append(lines, entry.String())
+	}
+	want := []string{
+		"UUID=root-uuid\t/\tbtrfs\trw,noatime,compress=zstd,ssd,commit=120,subvol=/@\t0 0",
+		"UUID=root-uuid\t/home\tbtrfs\trw,noatime,compress=zstd,ssd,commit=120,subvol=/@home\t0 0",
+		"UUID=root-uuid\t/var\tbtrfs\trw,noatime,compress=zstd,ssd,commit=120,subvol=/@var\t0 0",
+		"UUID=root-uuid\t/tmp\tbtrfs\trw,noatime,compress=zstd,ssd,commit=120,subvol=/@tmp\t0 0",
+		"UUID=root-uuid\t/.snapshots\tbtrfs\trw,noatime,compress=zstd,ssd,commit=120,subvol=/@.snapshots\t0 0",
+		"UUID=ABCD-1234\t/boot/efi\tvfat\t" + espOptions + "\t0 2",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("buildFstab =\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+
+	labels, err := buildFstab(plan, "label", testBlockIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labels[0].Source != "LABEL=ROOT" || labels[5].Source != "LABEL=EFIBOOT" {
+		t.Errorf("label sources = %s, %s", labels[0].Source, labels[5].Source)
+	}
+
+	if _, err := buildFstab(plan, "path", testBlockIDs); err == nil {
+		t.Errorf("FSTAB_ID path: expected an error")
+	}
+	if _, err := buildFstab(plan, "partuuid", func(string) (map[string]string, error) { return nil, nil }); err == nil {
+		t.Errorf("device without ids: expected an error")
+	}
+}
+
+func TestValidateFstab(t *testing.T) {
+	plan, err := buildDiskPlan(planTestAnswers("btrfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := buildFstab(plan, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Mount @home twice and lose @var
+	broken := append([]fstabEntry(nil), entries...)
+	broken[2] = broken[1]
+	err = validateFstab(plan, broken)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, problem := range []string{"duplicate mount point /home", "subvolume @var is not mounted"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("%v does not mention %q", err, problem)
+		}
+	}
+
+	if err := validateFstab(plan, entries[1:]); err == nil || !strings.Contains(err.Error(), "no root filesystem") {
+		t.Errorf("without / got %v", err)
+	}
+}
+
+func TestParseFstab(t *testing.T) {
+	text := `# Static information about the filesystems.
+# <file system> <dir> <type> <options> <dump> <pass>
+
+# /dev/nvme0n1p3 LABEL=ROOT
+UUID=root-uuid	/	btrfs	rw,noatime,subvol=/@	0 0
+UUID=ABCD-1234	/boot/efi	vfat	rw,umask=0077	0 2
+tmpfs /tmp tmpfs rw
+`
+	want := []fstabEntry{
+		{Source: "UUID=root-uuid", Target: "/", FSType: "btrfs", Options: "rw,noatime,subvol=/@"},
+		{Source: "UUID=ABCD-1234", Target: "/boot/efi", FSType: "vfat", Options: "rw,umask=0077", Pass: 2},
+		{Source: "tmpfs", Target: "/tmp", FSType: "tmpfs", Options: "rw"},
+	}
+	if got := parseFstab(text); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFstab = %+v, want %+v", got, want)
+	}
+}
+
+func TestDiffFstab(t *testing.T) {
+	plan, err := buildDiskPlan(planTestAnswers("btrfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := buildFstab(plan, "partuuid", testBlockIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := map[string]string{"UUID=root-uuid": "/dev/nvme0n1p3", "UUID=ABCD-1234": "/dev/nvme0n1p2"}
+
+	// genfstab -U of the planned mounts, with its own option spelling
+	genfstab := `UUID=root-uuid	/	btrfs	rw,noatime,compress=zstd:3,ssd,space_cache=v2,subvolid=256,subvol=/@	0 0
+UUID=root-uuid	/home	btrfs	rw,noatime,compress=zstd:3,ssd,subvolid=257,subvol=/@home	0 0
+UUID=root-uuid	/var	btrfs	rw,noatime,subvolid=258,subvol=/@var	0 0
+UUID=root-uuid	/tmp	btrfs	rw,noatime,subvolid=259,subvol=/@tmp	0 0
+UUID=root-uuid	/.snapshots	btrfs	rw,noatime,subvolid=260,subvol=/@.snapshots	0 0
+UUID=ABCD-1234	/boot/efi	vfat	rw,relatime,fmask=0022	0 2
+`
+	if problems := diffFstab(generated, parseFstab(genfstab), devices); len(problems) > 0 {
+		t.Errorf("matching mounts reported %v", problems)
+	}
+
+	mismatched := strings.NewReplacer(
+		"subvol=/@var", "subvol=/@",
+		"UUID=root-uuid\t/.snapshots", "UUID=ABCD-1234\t/.snapshots",
+		"UUID=ABCD-1234\t/boot/efi", "UUID=ABCD-1234\t/efi",
+	).Replace(genfstab)
+	want := []string{
+		`/.snapshots: planned /dev/nvme0n1p3, mounted /dev/nvme0n1p2`,
+		`/boot/efi is in the plan but not mounted`,
+		`/efi (UUID=ABCD-1234) is mounted but not in the plan`,
+		`/var: planned subvolume "@var", mounted "@"`,
+	}
+	if got := diffFstab(generated, parseFstab(mismatched), devices); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffFstab =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	twice := genfstab + "UUID=root-uuid\t/home\tbtrfs\trw,subvol=/@home\t0 0\n"
+	if got := diffFstab(generated, parseFstab(twice), devices); len(got) != 1 || got[0] != "/home is mounted twice" {
+		t.Errorf("duplicate mount reported %v", got)
+	}
+}
+
+func TestBuildFstabSwapAndSubvolumes(t *testing.T) {
+	answers := planTestAnswers("btrfs")
+	answers["SUBVOLUMES"] = "@home,@,@log"
+	answers["SWAP_SIZE"] = "8G"
+	plan, err := buildDiskPlan(answers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := buildFstab(plan, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, entry := range entries {
+		lines = append(lines, entry.Source+" "+entry.Target+" "+entry.FSType)
+	}
+	want := []string{
+		"/dev/nvme0n1p3 / btrfs",
+		"/dev/nvme0n1p3 /home btrfs",
+		"/dev/nvme0n1p3 /log btrfs",
+		"/dev/nvme0n1p2 /boot/efi vfat",
+		"/dev/nvme0n1p5 none swap",
+		"tmpfs /tmp tmpfs",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("buildFstab =\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+	if swap := plan.Partitions[2]; swap.Number != 5 || swap.Start != "-8G" || swap.sizeText() != "8G at the end of the disk" {
+		t.Errorf("swap partition = %+v", swap)
+	}
+
+	for value, problem := range map[string]string{
+		"@home,@var":    "need @ for the root",
+		"@,@home,@home": "@home is listed twice",
+		"@,home":        `invalid subvolume "home"`,
+		"@,@var/log":    `invalid subvolume "@var/log"`,
+	} {
+		if _, err := parseSubvolumes(value); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("parseSubvolumes(%q) = %v, want an error with %q", value, err, problem)
+		}
+	}
+	answers["SWAP_SIZE"] = "8 GB"
+	if _, err := buildDiskPlan(answers); err == nil {
+		t.Errorf("SWAP_SIZE 8 GB: expected an error")
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// EFI global variable GUID used by SecureBoot, SetupMode, etc.
+const efiGlobalVariableGUID = "8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+var efiVarsDir = "/sys/firmware/efi/efivars"
+
+type firmwareInfo struct {
+	UEFI       bool `json:"uefi" toml:"uefi"`
+	SetupMode  bool `json:"setup_mode" toml:"setup_mode"`
+	SecureBoot bool `json:"secure_boot" toml:"secure_boot"`
+}
+
+func getFirmwareInfo() firmwareInfo {
+	info := firmwareInfo{}
+	if _, err := os.Stat("/sys/firmware/efi"); err != nil {
+		return info
+	}
+	info.UEFI = true
+	info.SetupMode = readEFIVarBool("SetupMode")
+	info.SecureBoot = readEFIVarBool("SecureBoot")
+	return info
+}
+
+// readEFIVarBool reads a one byte EFI global variable. The efivarfs file
+// starts with a 4 byte attribute header followed by the variable data.
+func readEFIVarBool(name string) bool {
+	data, err := os.ReadFile(filepath.Join(efiVarsDir, name+"-"+efiGlobalVariableGUID))
+	if err != nil || len(data) < 5 {
+		return false
+	}
+	return data[4] == 1
+}
+
+//go:embed gpu_ids.toml
+var gpuIDTable []byte
+
+var pciDevicesDir = "/sys/bus/pci/devices"
+
+// PCI vendor IDs of the GPU vendors we know drivers for
+var gpuVendors = map[uint64]string{
+	0x1002: "amd",
+	0x8086: "intel",
+	0x10de: "nvidia",
+}
+
+type gpuDevice struct {
+	Slot       string `json:"slot" toml:"slot"`
+	Vendor     string `json:"vendor" toml:"vendor"`
+	VendorID   uint64 `json:"vendor_id" toml:"vendor_id"`
+	DeviceID   uint64 `json:"device_id" toml:"device_id"`
+	Generation string `json:"generation,omitempty" toml:"generation,omitempty"`
+	Driver     string `json:"driver,omitempty" toml:"driver,omitempty"`
+}
+
+func (g gpuDevice) String() string {
+	name := fmt.Sprintf("%s %04x:%04x", g.Vendor, g.VendorID, g.DeviceID)
+	if g.Generation != "" {
+		name += " (" + g.Generation + ")"
+	}
+	return name
+}
+
+type nvidiaGeneration struct {
+	Generation string `toml:"generation"`
+	First      uint64 `toml:"first"`
+	Last       uint64 `toml:"last"`
+	Driver     string `toml:"driver"`
+}
+
+func loadNvidiaGenerations() ([]nvidiaGeneration, error) {
+	var table struct {
+		Nvidia []nvidiaGeneration `toml:"nvidia"`
+	}
+	if _, err := toml.Decode(string(gpuIDTable), &table); err != nil {
+		return nil, fmt.Errorf("error decoding GPU ID table: %v", err)
+	}
+	return table.Nvidia, nil
+}
+
+// getGPUs lists every PCI display controller (class 0x03xxxx).
+func getGPUs() []gpuDevice {
+	entries, err := os.ReadDir(pciDevicesDir)
+	if err != nil {
+		return nil
+	}
+	// Errors go to stderr, stdout may be the probe report
+	generations, err := loadNvidiaGenerations()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading NVIDIA generations: %v\n", err)
+	}
+
+	var gpus []gpuDevice
+	for _, entry := range entries {
+		dir := filepath.Join(pciDevicesDir, entry.Name())
+		class, err := readSysfsHex(filepath.Join(dir, "class"))
+		if err != nil || class>>16 != 0x03 {
+			continue
+		}
+		vendorID, err := readSysfsHex(filepath.Join(dir, "vendor"))
+		if err != nil {
+			continue
+		}
+		deviceID, _ := readSysfsHex(filepath.Join(dir, "device"))
+
+		gpu := gpuDevice{Slot: entry.Name(), VendorID: vendorID, DeviceID: deviceID}
+		gpu.Vendor = gpuVendors[vendorID]
+		if gpu.Vendor == "" {
+			gpu.Vendor = fmt.Sprintf("unknown-%04x", vendorID)
+		}
+		if gpu.Vendor == "nvidia" {
+			gpu.Generation, gpu.Driver = nvidiaDriverFor(deviceID, generations)
+		}
+		gpus = append(gpus, gpu)
+	}
+	sort.Slice(gpus, func(i, j int) bool { return gpus[i].Slot < gpus[j].Slot })
+	return gpus
+}
+
+// nvidiaDriverFor looks up the generation of an NVIDIA device ID. IDs that
+// are not in the table fall back on their position relative to Maxwell and
+// Turing.
+func nvidiaDriverFor(deviceID uint64, generations []nvidiaGeneration) (string, string) {
+	for _, g := range generations {
+		if deviceID >= g.First && deviceID <= g.Last {
+			return g.Generation, g.Driver
+		}
+	}
+	switch {
+	case deviceID >= 0x1E00:
+		return "", "nvidia-open"
+	case deviceID >= 0x1340:
+		return "", "nvidia"
+	}
+	return "", "nouveau"
+}
+
+func readSysfsHex(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(string(data)), "0x"), 16, 64)
+}
+
+// recommendGPU picks the GPU and GPU_DRIVER answers for the detected
+// display controllers. Hybrid laptops get "<integrated>-nvidia" with the
+// NVIDIA driver, the integrated GPU driver is installed alongside it.
+func recommendGPU(gpus []gpuDevice) (gpu string, driver string) {
+	vendors := make(map[string]bool)
+	for _, g := range gpus {
+		vendors[g.Vendor] = true
+		if g.Vendor == "nvidia" && driver == "" {
+			driver = g.Driver
+		}
+	}
+
+	switch {
+	case vendors["nvidia"] && vendors["intel"]:
+		return "intel-nvidia", driver
+	case vendors["nvidia"] && vendors["amd"]:
+		return "amd-nvidia", driver
+	case vendors["nvidia"]:
+		return "nvidia", driver
+	case vendors["amd"]:
+		return "amd", "amdgpu"
+	case vendors["intel"]:
+		return "intel", "intel"
+	}
+	return "", ""
+}
+
+// gpuDriverOptions lists the GPU_DRIVER values that work with each GPU answer
+var gpuDriverOptions = map[string][]string{
+	"amd":          {"amdgpu"},
+	"intel":        {"intel"},
+	"nvidia":       {"nvidia-open", "nvidia", "nouveau"},
+	"intel-nvidia": {"nvidia-open", "nvidia", "nouveau"},
+	"amd-nvidia":   {"nvidia-open", "nvidia", "nouveau"},
+}
+
+func describeGPUs(gpus []gpuDevice) string {
+	if len(gpus) == 0 {
+		return "none"
+	}
+	var names []string
+	for _, g := range gpus {
+		names = append(names, g.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// getMemoryMiB returns MemTotal from /proc/meminfo.
+func getMemoryMiB() uint64 {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			return kb / 1024
+		}
+	}
+	return 0
+}
+
+// DMI vendor/product strings of the hypervisors we know about, mapped to
+// the names systemd-detect-virt uses.
+var dmiHypervisors = []struct {
+	match string
+	virt  string
+}{
+	{"QEMU", "qemu"},
+	{"KVM", "kvm"},
+	{"VirtualBox", "oracle"},
+	{"innotek", "oracle"},
+	{"VMware", "vmware"},
+	{"Virtual Machine", "microsoft"},
+}
+
+// getVirtualization reports the hypervisor we run under, or "none" on bare
+// metal. systemd-detect-virt is preferred, DMI is the fallback.
+func getVirtualization() string {
+	output, err := exec.Command("systemd-detect-virt", "--vm").Output()
+	if virt := strings.TrimSpace(string(output)); virt != "" {
+		return virt
+	}
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			// Exit status 1 with "none" means bare metal
+			return "none"
+		}
+	}
+
+	var dmi string
+	for _, name := range []string{"sys_vendor", "product_name"} {
+		data, _ := os.ReadFile(filepath.Join("/sys/class/dmi/id", name))
+		dmi += strings.TrimSpace(string(data)) + " "
+	}
+	for _, h := range dmiHypervisors {
+		if strings.Contains(dmi, h.match) {
+			return h.virt
+		}
+	}
+	return "none"
+}
+
+// vmGuestProfile lists the guest tools for a hypervisor
+type vmGuestProfile struct {
+	Packages []string
+	Services []string
+}
+
+// vmGuestProfiles is keyed by the systemd-detect-virt name. The QEMU guest
+// agent and spice-vdagent are started by udev and socket activation, so
+// they have no services to enable.
+var vmGuestProfiles = map[string]vmGuestProfile{
+	"kvm":       {Packages: []string{"qemu-guest-agent", "spice-vdagent"}},
+	"qemu":      {Packages: []string{"qemu-guest-agent", "spice-vdagent"}},
+	"oracle":    {Packages: []string{"virtualbox-guest-utils"}, Services: []string{"vboxservice"}},
+	"vmware":    {Packages: []string{"open-vm-tools"}, Services: []string{"vmtoolsd", "vmware-vmblock-fuse"}},
+	"microsoft": {Packages: []string{"hyperv"}, Services: []string{"hv_kvp_daemon", "hv_vss_daemon"}},
+}
+
+type networkInterface struct {
+	Name     string `json:"name" toml:"name"`
+	MAC      string `json:"mac" toml:"mac"`
+	State    string `json:"state" toml:"state"`
+	Wireless bool   `json:"wireless" toml:"wireless"`
+}
+
+func getNetworkInterfaces() []networkInterface {
+	entries, err := os.ReadDir("/sys/class/net")
+	if err != nil {
+		return nil
+	}
+
+	var interfaces []networkInterface
+	for _, entry := range entries {
+		if entry.Name() == "lo" {
+			continue
+		}
+		dir := filepath.Join("/sys/class/net", entry.Name())
+		iface := networkInterface{Name: entry.Name()}
+		iface.MAC = readSysfsString(filepath.Join(dir, "address"))
+		iface.State = readSysfsString(filepath.Join(dir, "operstate"))
+		if _, err := os.Stat(filepath.Join(dir, "wireless")); err == nil {
+			iface.Wireless = true
+		}
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces
+}
+
+func hasBluetooth() bool {
+	entries, err := os.ReadDir("/sys/class/bluetooth")
+	return err == nil && len(entries) > 0
+}
+
+func hasBattery() bool {
+	entries, err := os.ReadDir("/sys/class/power_supply")
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if readSysfsString(filepath.Join("/sys/class/power_supply", entry.Name(), "type")) == "Battery" {
+			return true
+		}
+	}
+	return false
+}
+
+// isRotational reports whether /sys/block/<name> is a spinning disk.
+func isRotational(device string) bool {
+	name := filepath.Base(device)
+	return readSysfsString(filepath.Join("/sys/block", name, "queue", "rotational")) == "1"
+}
+
+// getSMARTHealth runs smartctl's overall health check, it is best effort as
+// smartctl is not always installed and virtual disks have no SMART data.
+func getSMARTHealth(device string) string {
+	if _, err := exec.LookPath("smartctl"); err != nil {
+		return "unavailable"
+	}
+	output, _ := exec.Command("smartctl", "-H", device).Output()
+	switch {
+	case strings.Contains(string(output), "PASSED"), strings.Contains(string(output), ": OK"):
+		return "passed"
+	case strings.Contains(string(output), "FAILED"):
+		return "failed"
+	}
+	return "unavailable"
+}
+
+func readSysfsString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
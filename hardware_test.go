@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNvidiaDriverFor(t *testing.T) {
+	generations, err := loadNvidiaGenerations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		deviceID   uint64
+		generation string
+		driver     string
+	}{
+		{0x0DE1, "Fermi and older", "nouveau"},  // GT 430
+		{0x1180, "Kepler", "nouveau"},           // GTX 680
+		{0x1380, "Maxwell", "nvidia"},           // GTX 750 Ti
+		{0x1B80, "Pascal", "nvidia"},            // GTX 1080
+		{0x1E84, "Turing", "nvidia-open"},       // RTX 2070 Super
+		{0x2204, "Ampere", "nvidia-open"},       // RTX 3090
+		{0x2330, "Hopper", "nvidia-open"},       // H100 SXM5
+		{0x2484, "Ampere", "nvidia-open"},       // RTX 3070
+		{0x2684, "Ada Lovelace", "nvidia-open"}, // RTX 4090
+	}
+	for _, tt := range tests {
+		generation, driver := nvidiaDriverFor(tt.deviceID, generations)
+		if generation != tt.generation || driver != tt.driver {
+			t.Errorf("nvidiaDriverFor(%#x) = %s, %s, want %s, %s", tt.deviceID, generation, driver, tt.generation, tt.driver)
+		}
+	}
+
+	// Without the table the driver follows from the ID alone
+	for deviceID, want := range map[uint64]string{0x1180: "nouveau", 0x1B80: "nvidia", 0x2684: "nvidia-open"} {
+		if _, driver := nvidiaDriverFor(deviceID, nil); driver != want {
+			t.Errorf("nvidiaDriverFor(%#x, nil) = %s, want %s", deviceID, driver, want)
+		}
+	}
+}
+
+func TestParseDriveInfo(t *testing.T) {
+	output := `NAME="zram0" SIZE="4G" TYPE="disk" MODEL=""
+NAME="loop0" SIZE="812.6M" TYPE="loop" MODEL=""
+NAME="sr0" SIZE="1.1G" TYPE="rom" MODEL="QEMU DVD-ROM"
+NAME="nvme0n1" SIZE="953.9G" TYPE="disk" MODEL="Samsung SSD 980 PRO 1TB"
+NAME="vda" SIZE="256G" TYPE="disk" MODEL=""
+`
+	want := []string{"/dev/nvme0n1 (953.9G - Samsung SSD 980 PRO 1TB)", "/dev/vda (256G)"}
+	if got := parseDriveInfo(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDriveInfo = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// diskImage is a sparse file attached to a loop device that the install
+// uses in place of a real disk.
+type diskImage struct {
+	path   string
+	size   int64
+	device string
+	dryRun bool
+}
+
+// parseSize parses sizes like 20G, 512M or a plain number of bytes
+func parseSize(value string) (int64, error) {
+	number := strings.TrimSpace(strings.ToUpper(value))
+	number = strings.TrimSuffix(strings.TrimSuffix(number, "B"), "I")
+	multiplier := int64(1)
+	if number != "" {
+		if shift := strings.IndexByte("KMGT", number[len(number)-1]); shift >= 0 {
+			multiplier = 1 << (10 * (shift + 1))
+			number = number[:len(number)-1]
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// attach creates the image if needed, growing it to size, and attaches it
+// with partition scanning so the partitions show up as loopNpM.
+func (img *diskImage) attach(out io.Writer) error {
+	if img.dryRun {
+		img.device = "/dev/loop0"
+		fmt.Fprintf(out, "[DRY RUN] Would create %s (%d bytes) and execute: losetup --find --show --partscan %s\n", img.path, img.size, img.path)
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("attaching a disk image needs root")
+	}
+
+	file, err := os.OpenFile(img.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", img.path, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", img.path, err)
+	}
+	if info.Size() < img.size {
+		if err := file.Truncate(img.size); err != nil {
+			return fmt.Errorf("error resizing %s: %v", img.path, err)
+		}
+	}
+
+	output, err := exec.Command("losetup", "--find", "--show", "--partscan", img.path).Output()
+	if err != nil {
+		return fmt.Errorf("error attaching %s: %v", img.path, err)
+	}
+	img.device = strings.TrimSpace(string(output))
+	fmt.Fprintf(out, "==> Attached %s as %s\n", img.path, img.device)
+	return nil
+}
+
+// detach unmounts what the install left on the loop device and detaches it
+func (img *diskImage) detach(answers map[string]string, out io.Writer) error {
+	if img.device == "" {
+		return nil
+	}
+	cleanupErr := cleanupTarget(answers, img.dryRun, out)
+	if img.dryRun {
+		fmt.Fprintf(out, "[DRY RUN] Would execute: losetup --detach %s\n", img.device)
+		return cleanupErr
+	}
+	if output, err := exec.Command("losetup", "--detach", img.device).CombinedOutput(); err != nil {
+		return fmt.Errorf("error detaching %s: %v: %s", img.device, err, strings.TrimSpace(string(output)))
+	}
+	fmt.Fprintf(out, "==> Detached %s\n", img.device)
+	return cleanupErr
+}
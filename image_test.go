@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetPartitionSuffix(t *testing.T) {
+	for device, want := range map[string]string{
+		"/dev/sda":     "",
+		"/dev/vda":     "",
+		"/dev/nvme0n1": "p",
+		"/dev/mmcblk0": "p",
+		"/dev/loop0":   "p",
+		"":             "",
+	} {
+		if got := getPartitionSuffix(device); got != want {
+			t.Errorf("getPartitionSuffix(%q) = %q, want %q", device, got, want)
+		}
+	}
+}
+
+func TestSetDeviceAnswers(t *testing.T) {
+	answers := map[string]string{"DEVICE": "/dev/sda", "PARTITION_ROOT": "/dev/sda3", "HOSTNAME": "arch"}
+	setDeviceAnswers(answers, "/dev/loop7")
+	want := map[string]string{
+		"INSTALL_DEVICE": "/dev/loop7",
+		"DEVICE":         "/dev/loop7",
+		"PARTITION_EFI":  "/dev/loop7p2",
+		"PARTITION_ROOT": "/dev/loop7p3",
+		"HOSTNAME":       "arch",
+	}
+	for key, value := range want {
+		if answers[key] != value {
+			t.Errorf("%s = %q, want %q", key, answers[key], value)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for value, want := range map[string]int64{"20G": 20 << 30, "512M": 512 << 20, "1GiB": 1 << 30, "4096": 4096, " 2t ": 2 << 40} {
+		if got, err := parseSize(value); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "G", "-1G", "0", "ten"} {
+		if _, err := parseSize(value); err == nil {
+			t.Errorf("parseSize(%q): expected an error", value)
+		}
+	}
+}
+
+func TestImagePlanLeavesLiveSystemAlone(t *testing.T) {
+	answers := planTestAnswers("btrfs")
+	answers["PACMAN_MIRROR"] = "http://mirror.lan/$repo/os/$arch"
+	changesHost := func(op planOperation) bool {
+		return !op.Chroot && (strings.HasPrefix(op.Path, "/etc/") ||
+			strings.Contains(op.Command, "timedatectl") ||
+			strings.Contains(op.Command, "setfont") ||
+			strings.HasPrefix(op.Command, "pacman "))
+	}
+	hostChanges := func(answers map[string]string) []string {
+		plan, err := buildInstallPlan(answers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var changes []string
+		for _, step := range plan.Steps {
+			for _, op := range step.Operations {
+				if changesHost(op) {
+					changes = append(changes, step.Script+": "+op.Summary)
+				}
+			}
+		}
+		return changes
+	}
+
+	if len(hostChanges(answers)) == 0 {
+		t.Fatal("the live install plan changes nothing on the host")
+	}
+	answers["TARGET_IMAGE"] = "disk.img"
+	if changes := hostChanges(answers); len(changes) > 0 {
+		t.Errorf("the image install changes the host:\n%s", strings.Join(changes, "\n"))
+	}
+
+	// pre-setup.sh has to skip the same commands
+	script := expandedScript(t, "install/scripts/1-pre/pre-setup.sh", map[string]string{"TARGET_IMAGE": "disk.img"})
+	guard := strings.Index(script, `if [ -n "disk.img" ]; then`)
+	end := guard + strings.Index(script[guard+1:], "\n    fi\n")
+	for _, setup := range []string{"repository_setup ||", "initial_setup ||", "mirror_setup ||"} {
+		if i := strings.Index(script, setup); guard < 0 || i < guard || i > end {
+			t.Errorf("pre-setup.sh runs %s for a disk image", strings.TrimSuffix(setup, " ||"))
+		}
+	}
+}
@@ -14,6 +14,15 @@ DRY_RUN="${DRY_RUN:-false}"
 DEBUG_MODE="${DEBUG_MODE:-false}"
 VERBOSE="${VERBOSE:-false}"
 
+# The installer passes its configuration as CONFIG_FILE only. It is read
+# into shell variables, not exported, so the passwords in it never reach the
+# environment of child processes. The chosen SHELL, EDITOR and MAKEFLAGS are
+# LOGIN_SHELL, TARGET_EDITOR and TARGET_MAKEFLAGS in it.
+if [ -n "$CONFIG_FILE" ] && [ -f "$CONFIG_FILE" ]; then
+    # shellcheck source=/dev/null
+    . "$CONFIG_FILE"
+fi
+
 # Script-related variables
 SCRIPT_NAME=$(basename "$0")
 SCRIPT_VERSION="1.0.0"
@@ -125,6 +134,41 @@ log() {
     
 }
 export -f log
+# @description Escape a string for use in a JSON string value
+# @arg $1 string Text to escape
+json_escape() {
+    local text="$1"
+    text=${text//\\/\\\\}
+    text=${text//\"/\\\"}
+    text=${text//$'\n'/\\n}
+    text=${text//$'\t'/\\t}
+    text=${text//[$'\001'-$'\037']/}
+    printf '%s' "$text"
+}
+export -f json_escape
+# @description Emit a JSON event for the Go frontend on ARCH_MATIC_EVENT_FD
+# @arg $1 string Event type (process_start, step_end, warning, progress, ...)
+# @arg $2 string Message
+# @arg $3 string Extra JSON fields, e.g. "\"exit_code\":1" (optional)
+emit_event() {
+    local type="$1"
+    local message="${2:-}"
+    local extra="${3:-}"
+    local fd="${ARCH_MATIC_EVENT_FD:-}"
+
+    [[ "$fd" =~ ^[0-9]+$ ]] || return 0
+    printf '{"time":"%s","type":"%s","name":"%s","message":"%s"%s}\n' \
+        "$(date -u '+%Y-%m-%dT%H:%M:%SZ')" "$type" "$(json_escape "${CURRENT_PROCESS:-}")" \
+        "$(json_escape "$message")" "${extra:+,$extra}" 2>/dev/null >&"$fd" || true
+}
+export -f emit_event
+# @description Report the progress of the current process
+# @arg $1 number Percentage (0-100)
+# @arg $2 string Message (optional)
+emit_progress() {
+    emit_event progress "${2:-}" "\"percent\":${1:-0}"
+}
+export -f emit_progress
 # @description Print formatted messages
 # @param type Message type
 # @param message Message to print
@@ -167,6 +211,12 @@ print_message() {
         log "$type" "$message"
     fi
 
+    # Warnings and errors also go to the Go frontend
+    case "$type" in
+        WARNING) emit_event warning "$message" ;;
+        ERROR) emit_event error "$message" ;;
+    esac
+
 }
 export -f print_message
 export COLORS
@@ -331,6 +381,7 @@ process_init() {
 
     print_message PROC "Starting process: " "$process_name (ID: $process_id)"
     printf "%b\n" "$process_id:$process_name:started" >> "$PROCESS_LOG"
+    emit_event process_start "$process_name"
     print_message DEBUG "======================= Starting $process_name  ======================="
 }
 # @description Run process.
@@ -359,6 +410,7 @@ process_end() {
         print_message PROC "ERROR: Process failed: " "$process_name (ID: $process_id, Exit code: $exit_code)"
         printf "%b\n" "$process_id:$process_name:failed:$exit_code" >> "$PROCESS_LOG"
     fi
+    emit_event process_end "$process_name" "\"exit_code\":${exit_code}"
 
     #init_log_trace false
     trap 'exit_handler $?' EXIT
@@ -370,7 +422,8 @@ process_end() {
     print_message DEBUG "======================= Ending $process_name  ======================="
 
     print_message INFO "All processes allmost completed....." 
-    sleep 2
+    # A dry run has nothing to wait for
+    [[ "$DRY_RUN" == true ]] || sleep 2
     # Reset the current process variables
     CURRENT_PROCESS=""
     CURRENT_PROCESS_ID=""
@@ -466,43 +519,32 @@ load_config() {
     fi
 
     # Source the configuration file to load all variables
-    # This reads the config file and sets the variables in the current shell
-    set -o allexport
+    # This reads the config file and sets the variables in the current shell,
+    # without exporting them
     . "$CONFIG_FILE"
-    set +o allexport
 
     # Set default values for variables that might not be in the config file
-    export auto_run="${auto_run:-false}"
-    export PARALLEL_JOBS="${PARALLEL_JOBS:-4}"
-    export FORMAT_TYPE="${FORMAT_TYPE:-btrfs}"
-    export COUNTRY_ISO="${COUNTRY_ISO:-US}"
-    export MOUNT_OPTIONS="${MOUNT_OPTIONS:-noatime,compress=zstd,ssd,commit=120}"
-    export LOCALE="${LOCALE:-en_US.UTF-8}"
-    export TIMEZONE="${TIMEZONE:-UTC}"
-    export KEYMAP="${KEYMAP:-us}"
-    export USERNAME="${USERNAME:-user}"
-    export PASSWORD="${PASSWORD:-changeme}"
-    export HOSTNAME="${HOSTNAME:-arch}"
-    export TERMINAL="${TERMINAL:-alacritty}"
-    export SUBVOLUME="${SUBVOLUME:-@,@home,@var,@.snapshots}"
-    export LUKS="${LUKS:-false}"
-    export LUKS_PASSWORD="${LUKS_PASSWORD:-changeme}"
-    export SHELL="${SHELL:-bash}"
-    export DESKTOP_ENVIRONMENT="${DESKTOP_ENVIRONMENT:-none}"
-
-    # Export variables without default values
-    export DEVICE
-    export PARTITION_BIOSBOOT
-    export PARTITION_EFI
-    export PARTITION_ROOT
-    export PARTITION_HOME
-    export PARTITION_SWAP
-    export MICROCODE
-    export GPU_DRIVER
-
-    # Debug output for all variables
+    auto_run="${auto_run:-false}"
+    PARALLEL_JOBS="${PARALLEL_JOBS:-4}"
+    FORMAT_TYPE="${FORMAT_TYPE:-btrfs}"
+    COUNTRY_ISO="${COUNTRY_ISO:-US}"
+    MOUNT_OPTIONS="${MOUNT_OPTIONS:-noatime,compress=zstd,ssd,commit=120}"
+    LOCALE="${LOCALE:-en_US.UTF-8}"
+    TIMEZONE="${TIMEZONE:-UTC}"
+    KEYMAP="${KEYMAP:-us}"
+    USERNAME="${USERNAME:-user}"
+    PASSWORD="${PASSWORD:-changeme}"
+    HOSTNAME="${HOSTNAME:-arch}"
+    TERMINAL="${TERMINAL:-alacritty}"
+    SUBVOLUMES="${SUBVOLUMES:-@,@home,@var,@tmp,@.snapshots}"
+    LUKS="${LUKS:-false}"
+    LUKS_PASSWORD="${LUKS_PASSWORD:-changeme}"
+    LOGIN_SHELL="${LOGIN_SHELL:-bash}"
+    DESKTOP_ENVIRONMENT="${DESKTOP_ENVIRONMENT:-none}"
+
+    # Debug output for all variables, the passwords left out
     print_message DEBUG "Configuration variables after loading:"
-    for var in PARALLEL_JOBS FORMAT_TYPE COUNTRY_ISO DEVICE PARTITION_BIOSBOOT PARTITION_EFI PARTITION_ROOT PARTITION_HOME PARTITION_SWAP MOUNT_OPTIONS LOCALE TIMEZONE KEYMAP USERNAME PASSWORD HOSTNAME MICROCODE GPU_DRIVER TERMINAL SUBVOLUME LUKS LUKS_PASSWORD SHELL DESKTOP_ENVIRONMENT; do
+    for var in PARALLEL_JOBS FORMAT_TYPE COUNTRY_ISO DEVICE PARTITION_BIOSBOOT PARTITION_EFI PARTITION_ROOT PARTITION_HOME PARTITION_SWAP MOUNT_OPTIONS LOCALE TIMEZONE KEYMAP USERNAME HOSTNAME MICROCODE GPU_DRIVER TERMINAL SUBVOLUMES SWAP_SIZE LUKS LOGIN_SHELL DESKTOP_ENVIRONMENT; do
         print_message DEBUG "  $var=${!var}"
     done
 
@@ -712,7 +754,10 @@ ask_question() {
     read -r -p "${blue}$*${nc} " var
     printf "%b\n" "$var"
 }
-# @description Execute commands with error handling
+# @description Execute commands with error handling. A failing command is
+# reported and the next one runs; --critical aborts the install instead and
+# --propagate stops at the failing command and returns its status, so the
+# runner can retry the script.
 # @arg $1 string Process name
 # @arg $@ string Commands to execute
 execute_process() {
@@ -721,6 +766,7 @@ execute_process() {
     local use_chroot=false
     local debug=false
     local critical=${critical:-false}
+    local propagate=false
     local error_message="Process failed"
     local success_message="Process completed successfully"
     local exit_code=0
@@ -731,6 +777,7 @@ execute_process() {
             --use-chroot) use_chroot=true; shift ;;
             --debug) debug=true; shift ;;
             --critical) critical=true; shift ;;
+            --propagate) propagate=true; shift ;;
             --error-message) error_message="$2"; shift 2 ;;
             --success-message) success_message="$2"; shift 2 ;;
             *) printf "%b\n" "Unknown option: $1"; return 1 ;;
@@ -740,9 +787,11 @@ execute_process() {
     # Collect remaining arguments as commands
     commands=("$@")
     print_message INFO "Starting: $process_name"
+    emit_event step_start "$process_name"
     # If no commands provided, return 0
     if [[ ${#commands[@]} -eq 0 ]]; then
         print_message WARNING "No commands provided for execution"
+        emit_event step_end "$process_name" "\"exit_code\":0"
         return 0
     fi
     # Execute commands
@@ -750,6 +799,7 @@ execute_process() {
         # If DRY_RUN is true, print the command
         if [[ "$DRY_RUN" == true ]]; then
             print_message ACTION "[DRY RUN] Would execute: $cmd"
+            emit_event dry_run "$cmd"
         else
             # If debug is true, print the command
             if [[ "$debug" == true ]]; then
@@ -757,8 +807,14 @@ execute_process() {
             fi
             # If use_chroot is true, execute the command in chroot
             if [[ "$use_chroot" == true ]]; then
-                if ! arch-chroot /mnt /bin/bash -c "$cmd"; then
+                local status=0
+                arch-chroot /mnt /bin/bash -c "$cmd" || status=$?
+                if [[ $status -ne 0 ]]; then
                     print_message ERROR "${error_message} ${process_name}: $cmd"
+                    if [[ "$propagate" == true ]]; then
+                        exit_code=$status
+                        break
+                    fi
                     # If critical is true, handle critical error
                     if [[ "$critical" == true ]]; then
                         handle_critical_error "${error_message} ${process_name}: $cmd"
@@ -768,8 +824,14 @@ execute_process() {
                 fi
             else
                 # If use_chroot is false, execute the command in the current shell
-                if ! eval "$cmd"; then
+                local status=0
+                eval "$cmd" || status=$?
+                if [[ $status -ne 0 ]]; then
                     print_message ERROR "${error_message} ${process_name}: ${cmd}"
+                    if [[ "$propagate" == true ]]; then
+                        exit_code=$status
+                        break
+                    fi
                     # If critical is true, handle critical error
                     if [[ "$critical" == true ]]; then
                         handle_critical_error "${error_message} ${process_name} failed: ${cmd}"
@@ -784,6 +846,7 @@ execute_process() {
     if [[ $exit_code -eq 0 ]]; then
         print_message OK "${success_message} ${process_name} completed"
     fi
+    emit_event step_end "$process_name" "\"exit_code\":${exit_code}"
     return $exit_code
 }
 # @description Execute step.
@@ -793,278 +856,13 @@ execute_step() {
     eval "$STEP"
     printf "%b\n" "${BLUE}# ${STEP} step${NC}"
 }
-# @description Process installation stages.
-# @arg $1 string Format type
-# @arg $2 string Desktop environment
-process_installation_stages() {
-    local format_type="$1"
-    local desktop_environment="$2"
-    local stage_name
-    local stage_type
-    local scripts
-    local script
-    local script_path
-
-    # Define the stages and their corresponding scripts
-    declare -A stages=(
-        ["1-pre,o"]="run-checks.sh"
-        ["1-pre,m"]="pre-setup.sh"
-        ["2-drive,m"]="partition-{format_type}.sh format-{format_type}.sh"
-        ["3-base,m"]="bootstrap-pkgs.sh generate-fstab.sh"
-        ["4-post,o"]="terminal.sh"
-        ["4-post,m"]="system-config.sh system-pkgs.sh"
-        ["5-desktop,m"]="{desktop_environment}.sh"
-        ["6-final,m"]="last-cleanup.sh"
-        ["7-post-setup,o"]="post-setup.sh"
-    )
-    # Process installation stages
-    for stage in $(printf "%s\n" "${!stages[@]}" | sort); do
-        stage_name="${stage%,*}"
-        stage_type="${stage##*,}"
-        # Check if the stage directory exists
-        [[ ! -d "${SCRIPTS_DIR}/${stage_name}" ]] && {
-            print_message WARNING "Stage directory not found: ${SCRIPTS_DIR}/${stage_name}"
-            continue
-        }
-        # Read the scripts into an array    
-        IFS=' ' read -ra scripts <<< "${stages[$stage]}"
-        for script in "${scripts[@]}"; do
-            script=${script//\{format_type\}/$format_type}
-            script=${script//\{desktop_environment\}/$desktop_environment}
-            script_path="${SCRIPTS_DIR}/${stage_name}/${script}"
-
-            print_message INFO "Executing: ${stage_name}/${script}"
-
-            # Check if the script exists
-            [[ ! -f "$script_path" ]] && {
-                print_message ERROR "Script not found: $script_path"
-                print_message DEBUG "Directory contents: $(ls -la "$(dirname "$script_path")")"
-                return 1
-            }
-            # Execute the script
-            if bash "$script_path"; then
-                print_message ACTION "Successfully executed: $script_path"
-            else
-                print_message ERROR "Failed to execute: $script_path"
-                return 1
-            fi
-        done
-    done
-
-    return 0
-}
-# @description Execute scripts for a given stage.
-# @arg $1 string Stage (directory name)
-# @arg $2 string Script name
-execute_script() {
-    local stage="$1"
-    local script="$2"
-    local script_path="${SCRIPTS_DIR}/$stage/$script"
-
-    if [[ "$DRY_RUN" == "true" ]]; then
-        print_message ACTION "[DRY-RUN] Would execute: $script_path"
-        return 0
-    fi
-
-    if [[ ! -f "$script_path" ]]; then
-        print_message ERROR "Error: Script not found: $script_path"
-        print_message DEBUG "Current directory contents:"
-        ls -la "$(dirname "$script_path")"
-        return 1
-    fi
-
-    if [[ ! -x "$script_path" ]]; then
-        print_message ERROR "Error: Script is not executable: $script_path"
-        return 1
-    fi
-
-    if bash "$script_path"; then
-        print_message ACTION "Successfully executed: $script_path"
-        return 0
-    else
-        print_message ERROR "Failed to execute: $script_path"
-        return 1
-    fi
-}
-# @description Run install scripts.
-# @arg $1 string Format type
-# @arg $2 string Desktop environment
-# shellcheck source=../scripts
-run_install_scripts() {
-    local format_type="$1"
-    local desktop_environment="$2"
-
-    for stage in $(printf "%s\n" "${!INSTALL_SCRIPTS[@]}" | sort); do
-        stage_name="${stage%,*}"
-        stage_type="${stage##*,}"
-
-        print_message INFO "Processing stage: $stage_name ($stage_type)"
-
-        IFS=' ' read -ra scripts <<< "${INSTALL_SCRIPTS[$stage]}"
-        for script in "${scripts[@]}"; do
-            script=$(replace_placeholders "$script" "$format_type" "$desktop_environment")
-            
-            if [[ "$stage_type" == "o" ]]; then
-                print_message INFO "Optional script: $stage_name/$script"
-            fi
-
-            print_message INFO "Executing: $stage_name/$script"
-            if ! execute_script "$stage_name" "$script"; then
-                if [[ $DRY_RUN == true ]]; then
-                    print_message WARNING "Dry run: Continuing despite error in $script"
-                else
-                    print_message ERROR "Failed to execute: $script in stage $stage_name"
-                    return 1
-                fi
-            fi
-        done
-    done
-}
-# @description Replace placeholders in script names.
-# @arg $1 string Script name
-# @arg $2 string Format type
-# @arg $3 string Desktop environment
-# @return string Script name with placeholders replaced 
-replace_placeholders() {
-    local script="$1"
-    local format_type="$2"
-    local desktop_environment="$3"
-
-    script="${script//\{format_type\}/$format_type}"
-    script="${script//\{desktop_environment\}/$desktop_environment}"
-    printf "%s" "$script"
-}
-# @description Check if an optional script should run.
-# @arg $1 string Script name
-# @return 0 if the script should run, 1 otherwise   
-should_run_optional_script() {
-    local script="$1"
-    local config_var
-    local install_script
-
-    config_var="INSTALL_$(printf "%s" "${script%.*}" | tr '[:lower:]' '[:upper:]' | tr '-' '_')"
-    install_script=$(get_config_value "$config_var" "true")
-    print_message DEBUG "Checking optional script: $script, config_var: $config_var, value: $install_script"
-    [ "$install_script" == "true" ] && return 0 || return 1
-}
-# @description Parse TOML file and populate INSTALL_SCRIPTS
-# @arg $1 string Path to the TOML file
-# @return 0 on success, 1 on failure
-parse_stages_toml() {
-    local toml_file="$1"
-    declare -gA INSTALL_SCRIPTS FORMAT_TYPES DESKTOP_ENVIRONMENTS
-
-    print_message DEBUG "Parsing stages TOML file: $toml_file"
-
-    if [[ ! -f "$toml_file" ]]; then
-        print_message ERROR "TOML file not found: $toml_file"
-        return 1
-    fi
-
-    local current_section=""
-    while IFS= read -r line || [[ -n "$line" ]]; do
-        # Trim whitespace
-        line=$(printf "%s" "$line" | sed -e 's/^[[:space:]]*//' -e 's/[[:space:]]*$//')
-
-        # Skip empty lines and comments
-        [[ -z "$line" || "$line" == \#* ]] && continue
-
-        if [[ "$line" =~ ^\[([^]]+)\]$ ]]; then
-            current_section="${BASH_REMATCH[1]}"
-            print_message DEBUG "Entering section: [$current_section]"
-            continue
-        fi
-
-        case "$current_section" in
-            stages)
-                if [[ "$line" =~ ^\"([^\"]+)\"[[:space:]]*=[[:space:]]*\{([^}]+)\}$ ]]; then
-                    local stage="${BASH_REMATCH[1]}"
-                    local content="${BASH_REMATCH[2]}"
-                    print_message DEBUG "Parsing stage: $stage"
-                    
-                    if [[ "$content" =~ mandatory[[:space:]]*=[[:space:]]*\[([^\]]+)\] ]]; then
-                        local mandatory_scripts="${BASH_REMATCH[1]}"
-                        mandatory_scripts=$(printf "%s" "$mandatory_scripts" | sed 's/"//g' | sed 's/,/ /g')
-                        INSTALL_SCRIPTS["$stage,m"]="$mandatory_scripts"
-                        print_message DEBUG "Mandatory scripts for stage '$stage': $mandatory_scripts"
-                    fi
-                    if [[ "$content" =~ optional[[:space:]]*=[[:space:]]*\[([^\]]+)\] ]]; then
-                        local optional_scripts="${BASH_REMATCH[1]}"
-                        optional_scripts=$(printf "%s" "$optional_scripts" | sed 's/"//g' | sed 's/,/ /g')
-                        INSTALL_SCRIPTS["$stage,o"]="$optional_scripts"
-                        print_message DEBUG "Optional scripts for stage '$stage': $optional_scripts"
-                    fi
-                elif [[ "$line" =~ ^\"([^\"]+)\"[[:space:]]*=[[:space:]]*\{[[:space:]]*mandatory[[:space:]]*=[[:space:]]*\[([^\]]+)\][[:space:]]*\}$ ]]; then
-                    local stage="${BASH_REMATCH[1]}"
-                    local mandatory_scripts="${BASH_REMATCH[2]}"
-                    mandatory_scripts=$(printf "%s" "$mandatory_scripts" | sed 's/"//g' | sed 's/,/ /g')
-                    INSTALL_SCRIPTS["$stage,m"]="$mandatory_scripts"
-                    print_message DEBUG "Parsing stage: $stage"
-                    print_message DEBUG "Mandatory scripts for stage '$stage': $mandatory_scripts"
-                else
-                    print_message WARNING "Line did not match stage pattern: $line"
-                fi
-                ;;
-            format_types|desktop_environments)
-                if [[ "$line" =~ ^([^=]+)[[:space:]]*=[[:space:]]*(\[.+\])$ ]]; then
-                    local key="${BASH_REMATCH[1]}"
-                    local value="${BASH_REMATCH[2]}"
-                    key=$(printf "%s" "$key" | sed -e 's/^[[:space:]]*//' -e 's/[[:space:]]*$//')
-                    value=$(printf "%s" "$value" | sed -e 's/^\[//' -e 's/\]$//' -e 's/"//g' -e 's/,/ /g')
-                    
-                    if [ "$current_section" == "format_types" ]; then
-                        FORMAT_TYPES["$key"]="$value"
-                        print_message DEBUG "Format type '$key' scripts: ${FORMAT_TYPES[$key]}"
-                    else
-                        DESKTOP_ENVIRONMENTS["$key"]="$value"
-                        print_message DEBUG "Desktop environment '$key' scripts: ${DESKTOP_ENVIRONMENTS[$key]}"
-                    fi
-                else
-                    print_message WARNING "Line did not match ${current_section} pattern: $line"
-                fi
-                ;;
-            *)
-                print_message WARNING "Unknown section: $current_section"
-                ;;
-        esac
-    done < "$toml_file"
-
-     # Remove extra spaces from keys in associative arrays
-    for key in "${!FORMAT_TYPES[@]}"; do
-        new_key="${key%% }"
-        FORMAT_TYPES["$new_key"]="${FORMAT_TYPES[$key]}"
-        [ "$new_key" != "$key" ] && unset "FORMAT_TYPES[$key]"
-    done
-
-    for key in "${!DESKTOP_ENVIRONMENTS[@]}"; do
-        new_key="${key%% }"
-        DESKTOP_ENVIRONMENTS["$new_key"]="${DESKTOP_ENVIRONMENTS[$key]}"
-        [ "$new_key" != "$key" ] && unset "DESKTOP_ENVIRONMENTS[$key]"
-    done
-
-    print_message DEBUG "Parsed stages:"
-    for key in "${!INSTALL_SCRIPTS[@]}"; do
-        print_message DEBUG "  Stage '$key': ${INSTALL_SCRIPTS[$key]}"
-    done
-
-    print_message DEBUG "Parsed format types:"
-    for format in "${!FORMAT_TYPES[@]}"; do
-        print_message DEBUG "  Format '$format': ${FORMAT_TYPES[$format]}"
-    done
-
-    print_message DEBUG "Parsed desktop environments:"
-    for de in "${!DESKTOP_ENVIRONMENTS[@]}"; do
-        print_message DEBUG "  Desktop environment '$de': ${DESKTOP_ENVIRONMENTS[$de]}"
-    done
-
-    return 0
-}
 # @description Run command with dry run support.
 # @arg DRY_RUN bool
 # @arg $1 string Command
 run_command() {
     if [ "$DRY_RUN" == "true" ]; then
         print_message ACTION "[DRY RUN] Would execute: " "$*"
+        emit_event dry_run "$*"
         return 0
     else
         if ! "$@"; then
@@ -1214,85 +1012,6 @@ ensure_log_directory() {
         }
     fi
 }
-# @description Check for missing required scripts.
-# @return 0 if all scripts are present, 1 if any are missing
-# shellcheck disable=SC2034
-check_required_scripts() {
-    local missing_required_scripts=()
-    local missing_optional_scripts=()
-    print_message DEBUG "=== Checking for missing required scripts ==="
-    # Check for missing required scripts
-    for stage in "${!INSTALL_SCRIPTS[@]}"; do
-        local stage_name="${stage%,*}"
-        local script_type="${stage##*,}"
-        print_message DEBUG "  Stage: $stage_name ($script_type)"
-        # Get the scripts for the current stage and split them into an array
-        IFS=' ' read -ra scripts <<< "${INSTALL_SCRIPTS[$stage]}"
-        # Loop through each script in the stage
-        for script in "${scripts[@]}"; do
-            print_message DEBUG "    Checking script: $script"
-            # Check if the script is a format script
-            if [[ "$script" == *"{format_type}"* ]]; then
-                # Get the format scripts for the current format and split them into an array
-                # if you "" this it will break the script
-                local format_scripts=(${FORMAT_TYPES[$FORMAT_TYPE]})
-                # Loop through each format script in the array
-                for format_script in "${format_scripts[@]}"; do
-                    if [[ ! -f "$SCRIPTS_DIR/$stage_name/$format_script" ]]; then
-                        if [[ "$script_type" == "m" ]]; then
-                            missing_required_scripts+=("$stage_name/$format_script")
-                        else
-                            missing_optional_scripts+=("$stage_name/$format_script")
-                        fi
-                    fi
-                done
-            # Check if the script is a desktop environment script
-            elif [[ "$script" == *"{desktop_environment}"* ]]; then
-                # Get the desktop environment script for the current desktop environment
-                local de_script="${DESKTOP_ENVIRONMENTS[$DESKTOP_ENVIRONMENT]}"
-                # Check if the script file exists
-                if [[ ! -f "$SCRIPTS_DIR/$stage_name/$de_script" ]]; then
-                    if [[ "$script_type" == "m" ]]; then
-                        missing_required_scripts+=("$stage_name/$de_script")
-                    else
-                        missing_optional_scripts+=("$stage_name/$de_script")
-                    fi
-                fi
-            # Check if the script is a generic script
-            else
-                # Check if the script file exists
-                if [[ ! -f "$SCRIPTS_DIR/$stage_name/$script" ]]; then
-                    if [[ "$script_type" == "m" ]]; then
-                        missing_required_scripts+=("$stage_name/$script")
-                    else
-                        missing_optional_scripts+=("$stage_name/$script")
-                    fi
-                fi
-            fi
-        done
-    done
-
-    # Check for missing required scripts
-    if [[ ${#missing_required_scripts[@]} -gt 0 ]]; then
-        print_message ERROR "The following required scripts are missing:"
-        # Print the missing required scripts
-        for script in "${missing_required_scripts[@]}"; do
-            print_message ERROR "  - $script"
-        done
-        return 1
-    fi
-
-    # Check for missing optional scripts
-    if [[ ${#missing_optional_scripts[@]} -gt 0 ]]; then
-        print_message WARNING "The following optional scripts are missing:"
-        # Print the missing optional scripts
-        for script in "${missing_optional_scripts[@]}"; do
-            print_message WARNING "  - $script"
-        done
-    fi
-
-    return 0
-}
 # @description Check internet connection.   
 # @return 0 if internet connection is available, 1 if not
 check_internet_connection() {
@@ -19,6 +19,29 @@ else
     exit 1
 fi
 
+# The [repository] section of the config: a LAN or file:// mirror and the
+# directory of "arch-matic cache build" go first in the mirrorlist, so the
+# live system and pacstrap install from them. last-cleanup.sh restores the
+# mirrorlist of the target from the backup.
+repository_setup() {
+    local commands=()
+
+    if [ -z "$PACMAN_MIRROR" ] && [ -z "$LOCAL_REPO" ]; then
+        return 0
+    fi
+    [ -f /etc/pacman.d/mirrorlist.backup ] || commands+=("cp /etc/pacman.d/mirrorlist /etc/pacman.d/mirrorlist.backup")
+    commands+=("cp /etc/pacman.d/mirrorlist.backup /etc/pacman.d/mirrorlist")
+    [ -n "$PACMAN_MIRROR" ] && commands+=("sed -i '1i Server = ${PACMAN_MIRROR}' /etc/pacman.d/mirrorlist")
+    [ -n "$LOCAL_REPO" ] && commands+=("sed -i '1i Server = file://${LOCAL_REPO%/}/\$repo/os/\$arch' /etc/pacman.d/mirrorlist")
+
+    print_message INFO "Setting up the package repository"
+    execute_process "Repository setup" \
+        --error-message "Repository setup failed" \
+        --success-message "Repository setup completed" \
+        "${commands[@]}"
+}
+# The pacman commands fail the script, so the runner retries it when a
+# mirror or the network is down.
 initial_setup() {
     print_message INFO "Starting initial setup"
     # Initial setup
@@ -26,12 +49,26 @@ initial_setup() {
         --debug \
         --error-message "Initial setup failed" \
         --success-message "Initial setup completed" \
-        "timedatectl set-ntp true" \
+        "timedatectl set-ntp true"
+    execute_process "Live system packages" \
+        --debug \
+        --propagate \
+        --error-message "Installing the live system packages failed" \
+        --success-message "Live system packages installed" \
         "pacman -Sy archlinux-keyring --noconfirm" \
-        "pacman -S --noconfirm --needed pacman-contrib terminus-font rsync reflector gptfdisk btrfs-progs glibc" \
+        "pacman -S --noconfirm --needed pacman-contrib terminus-font rsync reflector gptfdisk btrfs-progs glibc" || return 1
+    execute_process "Console and pacman setup" \
+        --debug \
+        --error-message "Console and pacman setup failed" \
+        --success-message "Console and pacman setup completed" \
         "setfont ter-v22b" \
-        "sed -i -e '/^#ParallelDownloads/s/^#//' -e '/^#Color/s/^#//' /etc/pacman.conf" \
-        "pacman -Syy"
+        "sed -i -e 's/^#\?ParallelDownloads.*/ParallelDownloads = ${PARALLEL_DOWNLOADS:-5}/' -e '/^#Color/s/^#//' /etc/pacman.conf"
+    execute_process "Sync package databases" \
+        --debug \
+        --propagate \
+        --error-message "Syncing the package databases failed" \
+        --success-message "Package databases synced" \
+        "pacman -Syy" || return 1
 }
 mirror_setup() {
 
@@ -39,7 +76,7 @@ mirror_setup() {
         --error-message "Mirror setup failed" \
         --success-message "Mirror setup completed" \
         "curl -4 'https://ifconfig.co/country-iso' > COUNTRY_ISO" \
-        "cp /etc/pacman.d/mirrorlist /etc/pacman.d/mirrorlist.backup"
+        "[ -f /etc/pacman.d/mirrorlist.backup ] || cp /etc/pacman.d/mirrorlist /etc/pacman.d/mirrorlist.backup"
         
 
 }
@@ -47,9 +84,10 @@ prepare_drive() {
     print_message INFO "Preparing drive"
     
     if [ "$auto_run" = false ]; then
-        # Determine if we're dealing with a hdd/virtio drive or an ssd/nvme drive
-        if [[ "$INSTALL_DEVICE" == nvme* ]]; then
-            # NVME/SSD  drive
+        # Disks whose name ends in a digit (nvme0n1, mmcblk0) use a "p" separator,
+        # sdX and virtio vdX drives append the partition number directly
+        if [[ "$INSTALL_DEVICE" =~ [0-9]$ ]]; then
+            # NVME/MMC drive
             DEVICE="/dev/${INSTALL_DEVICE}"
             PARTITION_EFI="${DEVICE}p2"
             PARTITION_ROOT="${DEVICE}p3"
@@ -86,8 +124,15 @@ main() {
     print_message INFO "Starting pre-setup process"
     print_message INFO "DRY_RUN in $(basename "$0") is set to: ${YELLOW}$DRY_RUN"
 
-    initial_setup || { print_message ERROR "Initial setup failed"; return 1; }
-    mirror_setup || { print_message ERROR "Mirror setup failed"; return 1; }
+    # The live system setup changes the clock, console font, pacman.conf and
+    # mirrorlist of this machine, a disk image install leaves them alone
+    if [ -n "$TARGET_IMAGE" ]; then
+        print_message WARNING "Installing into $TARGET_IMAGE, skipping the live system setup"
+    else
+        repository_setup || { print_message ERROR "Repository setup failed"; return 1; }
+        initial_setup || { print_message ERROR "Initial setup failed"; return 1; }
+        mirror_setup || { print_message ERROR "Mirror setup failed"; return 1; }
+    fi
     #show_drive_list || { print_message ERROR "Drive selection failed"; return 1; }
     prepare_drive || { print_message ERROR "Drive preparation failed"; return 1; }
 
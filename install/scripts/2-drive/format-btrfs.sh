@@ -23,6 +23,9 @@ fi
 # Ensure DRY_RUN is exported
 export DRY_RUN="${DRY_RUN:-false}"
 
+# Configs saved before SUBVOLUMES was used get the subvolumes made until then
+SUBVOLUMES="${SUBVOLUMES:-@,@home,@var,@tmp,@.snapshots}"
+
 
 luks_setup() {
     print_message INFO "Setting up LUKS"
@@ -33,40 +36,50 @@ formating() {
     print_message DEBUG "Before Format ROOT: $PARTITION_ROOT as btrfs"
     print_message DEBUG "Before Format EFIBOOT: $PARTITION_EFI as vfat"
 
+    local commands=("mkfs.vfat -F32 -n EFIBOOT $PARTITION_EFI" "mkfs.btrfs -f -L ROOT $PARTITION_ROOT")
+    [ -n "$SWAP_SIZE" ] && commands+=("mkswap -L SWAP $PARTITION_SWAP")
+
     execute_process "Formatting partitions btrfs" \
         --error-message "Formatting partitions btrfs failed" \
         --success-message "Formatting partitions btrfs completed" \
         --critical \
-        "mkfs.vfat -F32 -n EFIBOOT $PARTITION_EFI" \
-        "mkfs.btrfs -f -L ROOT $PARTITION_ROOT" \
+        "${commands[@]}" \
         "mount -t btrfs $PARTITION_ROOT /mnt" 
     
 }
+# SUBVOLUMES lists the subvolumes, comma separated. "@" is the root, every
+# other one is mounted on its name without the @.
 subvolumes_setup() {
+    local commands=()
+    local subvolume
+
+    for subvolume in ${SUBVOLUMES//,/ }; do
+        commands+=("btrfs subvolume create /mnt/$subvolume")
+    done
 
     execute_process "Creating subvolumes" \
         --error-message "Creating subvolumes failed" \
         --success-message "Creating subvolumes completed" \
-        "btrfs subvolume create /mnt/@" \
-        "btrfs subvolume create /mnt/@home" \
-        "btrfs subvolume create /mnt/@var" \
-        "btrfs subvolume create /mnt/@tmp" \
-        "btrfs subvolume create /mnt/@.snapshots" \
+        "${commands[@]}" \
         "umount /mnt"
 
 }
 mounting() {
+    local commands=("mount -o $MOUNT_OPTIONS,subvol=@ $PARTITION_ROOT /mnt")
+    local subvolume
+
+    for subvolume in ${SUBVOLUMES//,/ }; do
+        [ "$subvolume" == "@" ] && continue
+        commands+=("mkdir -p /mnt/${subvolume#@}" "mount -o $MOUNT_OPTIONS,subvol=$subvolume $PARTITION_ROOT /mnt/${subvolume#@}")
+    done
+    commands+=("mkdir -p /mnt/boot/efi" "mount -t vfat $PARTITION_EFI /mnt/boot/efi")
+    # Active swap is what genfstab puts in the fstab
+    [ -n "$SWAP_SIZE" ] && commands+=("swapon $PARTITION_SWAP")
 
     execute_process "Mounting subvolumes btrfs" \
         --error-message "Mounting subvolumes btrfs failed" \
         --success-message "Mounting subvolumes btrfs completed" \
-        "mount -o $MOUNT_OPTIONS,subvol=@ $PARTITION_ROOT /mnt" \
-        "mkdir -p /mnt/{home,var,tmp,.snapshots,boot/efi}" \
-        "mount -o $MOUNT_OPTIONS,subvol=@home $PARTITION_ROOT /mnt/home" \
-        "mount -o $MOUNT_OPTIONS,subvol=@tmp $PARTITION_ROOT /mnt/tmp" \
-        "mount -o $MOUNT_OPTIONS,subvol=@var $PARTITION_ROOT /mnt/var" \
-        "mount -o $MOUNT_OPTIONS,subvol=@.snapshots $PARTITION_ROOT /mnt/.snapshots" \
-        "mount -t vfat -L EFIBOOT /mnt/boot/efi"
+        "${commands[@]}"
 
 }
 main() {
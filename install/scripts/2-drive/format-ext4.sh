@@ -0,0 +1,69 @@
+#!/bin/bash
+# Format Ext4 Script
+# Author: ssnow
+# Date: 2024
+# Description: Format Ext4 script for Arch Linux installation
+
+set -eo pipefail  # Exit on error, pipe failure
+
+# Determine the correct path to lib.sh
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+LIB_PATH="$(dirname "$(dirname "$SCRIPT_DIR")")/lib/lib.sh"
+
+# Source the library functions
+# shellcheck source=../../lib/lib.sh
+if [ -f "$LIB_PATH" ]; then
+    . "$LIB_PATH"
+else
+    echo "Error: Cannot find lib.sh at $LIB_PATH" >&2
+    exit 1
+fi
+
+# Enable dry run mode for testing purposes (set to false to disable)
+# Ensure DRY_RUN is exported
+export DRY_RUN="${DRY_RUN:-false}"
+
+
+formating() {
+
+    print_message DEBUG "Before Format ROOT: $PARTITION_ROOT as ext4"
+    print_message DEBUG "Before Format EFIBOOT: $PARTITION_EFI as vfat"
+
+    local commands=("mkfs.vfat -F32 -n EFIBOOT $PARTITION_EFI" "mkfs.ext4 -F -L ROOT $PARTITION_ROOT")
+    [ -n "$SWAP_SIZE" ] && commands+=("mkswap -L SWAP $PARTITION_SWAP")
+
+    execute_process "Formatting partitions ext4" \
+        --error-message "Formatting partitions ext4 failed" \
+        --success-message "Formatting partitions ext4 completed" \
+        --critical \
+        "${commands[@]}"
+
+}
+mounting() {
+
+    # MOUNT_OPTIONS holds the btrfs options, ext4 only gets noatime
+    local commands=("mount -o noatime $PARTITION_ROOT /mnt" "mkdir -p /mnt/boot/efi" "mount -t vfat $PARTITION_EFI /mnt/boot/efi")
+    # Active swap is what genfstab puts in the fstab
+    [ -n "$SWAP_SIZE" ] && commands+=("swapon $PARTITION_SWAP")
+
+    execute_process "Mounting partitions ext4" \
+        --error-message "Mounting partitions ext4 failed" \
+        --success-message "Mounting partitions ext4 completed" \
+        "${commands[@]}"
+
+}
+main() {
+    process_init "Formatting partitions ext4"
+    show_logo "Formatting partitions ext4"
+    print_message INFO "Starting formatting partitions ext4 process"
+    print_message INFO "DRY_RUN in $(basename "$0") is set to: ${YELLOW}$DRY_RUN"
+
+    formating || { print_message ERROR "Formatting partitions ext4 failed"; return 1; }
+    mounting || { print_message ERROR "Mounting partitions ext4 failed"; return 1; }
+
+    print_message OK "Formatting partitions ext4 process completed successfully"
+    process_end $?
+}
+# Run the main function
+main "$@"
+exit $?
\ No newline at end of file
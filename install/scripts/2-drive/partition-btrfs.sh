@@ -28,15 +28,22 @@ partitioning() {
 
     print_message INFO "Install device set to: $DEVICE"
 
+    local commands=(
+        "if mountpoint -q /mnt; then umount -A --recursive /mnt; else echo '/mnt is not mounted'; fi"
+        "sgdisk -Z ${DEVICE}"
+        "sgdisk -n1:0:+1M -t1:ef02 -c1:'BIOSBOOT' ${DEVICE}"
+        "sgdisk -n2:0:+512M -t2:ef00 -c2:'EFIBOOT' ${DEVICE}"
+    )
+    # SWAP_SIZE puts a swap partition at the end of the disk, the root
+    # partition takes the rest
+    [ -n "$SWAP_SIZE" ] && commands+=("sgdisk -n5:-${SWAP_SIZE}:0 -t5:8200 -c5:'SWAP' ${DEVICE}")
+    commands+=("sgdisk -n3:0:0 -t3:8300 -c3:'ROOT' ${DEVICE}")
+
     print_message INFO "Partitioning $DEVICE"
     execute_process "Partitioning" \
         --error-message "Partitioning failed" \
         --success-message "Partitioning completed" \
-        "if mountpoint -q /mnt; then umount -A --recursive /mnt; else echo '/mnt is not mounted'; fi" \
-        "sgdisk -Z ${DEVICE}" \
-        "sgdisk -n1:0:+1M -t1:ef02 -c1:'BIOSBOOT' ${DEVICE}" \
-        "sgdisk -n2:0:+512M -t2:ef00 -c2:'EFIBOOT' ${DEVICE}" \
-        "sgdisk -n3:0:0 -t3:8300 -c3:'ROOT' ${DEVICE}"
+        "${commands[@]}"
 
 }
 luks_setup() {
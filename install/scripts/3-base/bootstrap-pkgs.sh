@@ -39,12 +39,29 @@ set_microcode() {
 
 bootstrap_pkgs() {
 
+    local kernels="${KERNELS:-linux}"
+    local microcode_pkg=""
+    local cache_option=""
+
+    # Virtual machines have no microcode to load
+    [[ "$MICROCODE" == "amd" || "$MICROCODE" == "intel" ]] && microcode_pkg="${MICROCODE}-ucode"
+
+    # -c installs from the package cache of the live ISO
+    [[ "$REUSE_ISO_CACHE" == "true" ]] && cache_option="-c"
+
     print_message DEBUG "Bootstraping microcode: ${MICROCODE}"
+    print_message DEBUG "Bootstraping kernels: ${kernels} ${KERNEL_HEADERS}"
     execute_process "Installing base system" \
+        --propagate \
         --error-message "Base system installation failed" \
         --success-message "Base system installation completed" \
-        "pacstrap /mnt base base-devel linux linux-firmware efibootmgr grub ${MICROCODE}-ucode --noconfirm --needed"
+        "pacstrap ${cache_option} /mnt base base-devel ${kernels} ${KERNEL_HEADERS} linux-firmware efibootmgr grub ${microcode_pkg} --noconfirm --needed" || return 1
 
+    # pacstrap can leave a half-bootstrapped /mnt behind
+    if [[ "$DRY_RUN" != true ]] && [ ! -x /mnt/usr/bin/pacman ]; then
+        print_message ERROR "pacstrap did not install pacman into /mnt"
+        return 1
+    fi
 }
 
 main() {
@@ -25,7 +25,13 @@ export DRY_RUN="${DRY_RUN:-false}"
 
 
 generate_fstab() {
-    
+
+    # The installer's write-fstab step has already written and checked it
+    if grep -q "^# Generated by arch-matic" /mnt/etc/fstab 2>/dev/null; then
+        print_message INFO "fstab written by arch-matic, skipping genfstab"
+        return 0
+    fi
+
     print_message INFO "Generating fstab"
     execute_process "Generating fstab" \
         --error-message "fstab generation failed" \
@@ -34,12 +40,25 @@ generate_fstab() {
 
 }
 grub_setup() {
+    local default_kernel="${DEFAULT_KERNEL:-linux}"
+    local grub_options=""
+
+    # A disk image must not get a boot entry in the NVRAM of this machine,
+    # it boots from the fallback path instead
+    [ -n "$TARGET_IMAGE" ] && grub_options=" --removable --no-nvram"
+    # secure-boot.sh signs GRUB with its own keys, without shim; GRUB then
+    # needs the TPM module built in and an SBAT section
+    [ "$SECURE_BOOT" == "true" ] && grub_options+=" --modules=tpm --disable-shim-lock --sbat /usr/share/grub/sbat.csv"
 
+    # Give every installed kernel a top level entry and boot the default one first
     execute_process "Installing GRUB" \
         --use-chroot \
         --error-message "GRUB installation failed" \
         --success-message "GRUB installation completed" \
-        "grub-install --target=x86_64-efi --efi-directory=/boot/efi --bootloader-id=GRUB" \
+        "grub-install --target=x86_64-efi --efi-directory=/boot/efi --bootloader-id=GRUB${grub_options}" \
+        "sed -i '/^GRUB_DISABLE_SUBMENU=/d;/^GRUB_TOP_LEVEL=/d' /etc/default/grub" \
+        "echo 'GRUB_DISABLE_SUBMENU=y' >> /etc/default/grub" \
+        "echo 'GRUB_TOP_LEVEL=\"/boot/vmlinuz-${default_kernel}\"' >> /etc/default/grub" \
         "grub-mkconfig -o /boot/grub/grub.cfg" 
 
 }
@@ -0,0 +1,221 @@
+#!/bin/bash
+# Secure Boot Script
+# Author: ssnow
+# Date: 2024
+# Description: Build unified kernel images and sign them for Secure Boot
+
+set -eo pipefail  # Exit on error, pipe failure
+
+# Determine the correct path to lib.sh
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+LIB_PATH="$(dirname "$(dirname "$SCRIPT_DIR")")/lib/lib.sh"
+
+# Source the library functions
+# shellcheck source=../../lib/lib.sh
+if [ -f "$LIB_PATH" ]; then
+    . "$LIB_PATH"
+else
+    echo "Error: Cannot find lib.sh at $LIB_PATH" >&2
+    exit 1
+fi
+
+# Enable dry run mode for testing purposes (set to false to disable)
+# Ensure DRY_RUN is exported
+export DRY_RUN="${DRY_RUN:-false}"
+
+ESP_DIRECTORY="/boot/efi"
+UKI_DIRECTORY="$ESP_DIRECTORY/EFI/Linux"
+
+# @description Write a file on the target system, honouring DRY_RUN.
+# @arg $1 string File path (inside /mnt)
+# @arg $2 string File contents
+write_target_file() {
+    local file="$1"
+    local contents="$2"
+
+    if [[ "$DRY_RUN" == true ]]; then
+        print_message ACTION "[DRY RUN] Would write: /mnt$file"
+        return 0
+    fi
+    mkdir -p "$(dirname "/mnt$file")"
+    printf "%s\n" "$contents" > "/mnt$file"
+    print_message ACTION "Wrote: /mnt$file"
+}
+uki_packages() {
+
+    execute_process "Installing UKI and Secure Boot packages" \
+        --use-chroot \
+        --error-message "UKI package installation failed" \
+        --success-message "UKI package installation completed" \
+        "pacman -S --noconfirm --needed sbctl efibootmgr"
+
+}
+kernel_cmdline() {
+    local root_uuid
+    local cmdline
+
+    if [[ "$DRY_RUN" == true ]]; then
+        root_uuid="<root-uuid>"
+    else
+        root_uuid=$(blkid -s UUID -o value "$PARTITION_ROOT")
+    fi
+
+    cmdline="root=UUID=${root_uuid} rw"
+    [ "$FORMAT_TYPE" == "btrfs" ] && cmdline+=" rootflags=subvol=@"
+    print_message DEBUG "Kernel cmdline: $cmdline"
+
+    write_target_file "/etc/kernel/cmdline" "$cmdline"
+}
+uki_presets() {
+    local kernel
+
+    # The firmware boots the UKIs, the GRUB menu entries still boot the
+    # kernel with its initramfs, so the presets build both
+    print_message INFO "Configuring mkinitcpio presets for UKIs"
+    for kernel in ${KERNELS:-linux}; do
+        write_target_file "/etc/mkinitcpio.d/${kernel}.preset" "# mkinitcpio preset file for the '${kernel}' package (arch-matic)
+ALL_kver=\"/boot/vmlinuz-${kernel}\"
+
+PRESETS=('default' 'fallback')
+
+default_image=\"/boot/initramfs-${kernel}.img\"
+default_uki=\"${UKI_DIRECTORY}/arch-${kernel}.efi\"
+
+fallback_image=\"/boot/initramfs-${kernel}-fallback.img\"
+fallback_uki=\"${UKI_DIRECTORY}/arch-${kernel}-fallback.efi\"
+fallback_options=\"-S autodetect\""
+    done
+
+    execute_process "Building unified kernel images" \
+        --use-chroot \
+        --error-message "Building UKIs failed" \
+        --success-message "Building UKIs completed" \
+        "mkdir -p ${UKI_DIRECTORY}" \
+        "mkinitcpio -P"
+}
+uki_boot_entries() {
+    local kernel
+    local default_kernel="${DEFAULT_KERNEL:-linux}"
+    local ordered=()
+
+    # efibootmgr puts new entries first in BootOrder, so create the default last
+    for kernel in ${KERNELS:-linux}; do
+        [ "$kernel" != "$default_kernel" ] && ordered+=("$kernel")
+    done
+    ordered+=("$default_kernel")
+
+    if [ -n "$TARGET_IMAGE" ]; then
+        print_message WARNING "Installing into $TARGET_IMAGE, skipping firmware boot entries"
+        return 0
+    fi
+
+    print_message INFO "Creating firmware boot entries for UKIs"
+    for kernel in "${ordered[@]}"; do
+        execute_process "Creating boot entry for $kernel" \
+            --use-chroot \
+            --error-message "Creating boot entry for $kernel failed" \
+            --success-message "Boot entry for $kernel created" \
+            "efibootmgr --create --disk $DEVICE --part 2 --label 'Arch Linux ($kernel)' --loader '\\EFI\\Linux\\arch-${kernel}.efi' --unicode"
+    done
+}
+secure_boot_keys() {
+
+    if [ -n "$SECURE_BOOT_KEYS" ]; then
+        print_message INFO "Importing Secure Boot keys from: $SECURE_BOOT_KEYS"
+        execute_process "Importing Secure Boot keys" \
+            --error-message "Copying Secure Boot keys failed" \
+            --success-message "Secure Boot keys copied" \
+            "cp -r '$SECURE_BOOT_KEYS' /mnt/root/sbkeys"
+        execute_process "Importing Secure Boot keys" \
+            --use-chroot \
+            --critical \
+            --error-message "Importing Secure Boot keys failed" \
+            --success-message "Secure Boot keys imported" \
+            "sbctl import-keys --directory /root/sbkeys" \
+            "rm -rf /root/sbkeys"
+    else
+        print_message INFO "Generating Secure Boot keys"
+        execute_process "Generating Secure Boot keys" \
+            --use-chroot \
+            --critical \
+            --error-message "Generating Secure Boot keys failed" \
+            --success-message "Secure Boot keys generated" \
+            "sbctl create-keys"
+    fi
+
+    # Keys can only be enrolled while the firmware is in Setup Mode,
+    # provided keys are expected to already be enrolled otherwise.
+    if [ -n "$TARGET_IMAGE" ]; then
+        print_message WARNING "Installing into $TARGET_IMAGE, skipping key enrollment"
+    elif [ "$SECURE_BOOT_SETUP_MODE" == "true" ]; then
+        execute_process "Enrolling Secure Boot keys" \
+            --use-chroot \
+            --critical \
+            --error-message "Enrolling Secure Boot keys failed" \
+            --success-message "Secure Boot keys enrolled" \
+            "sbctl enroll-keys --microsoft"
+    else
+        print_message WARNING "Firmware is not in Setup Mode, skipping key enrollment"
+    fi
+}
+secure_boot_sign() {
+    local kernel
+    local files=("${ESP_DIRECTORY}/EFI/GRUB/grubx64.efi")
+
+    # grub-install --removable of an image install
+    [ -n "$TARGET_IMAGE" ] && files=("${ESP_DIRECTORY}/EFI/BOOT/BOOTX64.EFI")
+
+    # GRUB has the firmware verify the kernels it loads, the UKIs are
+    # booted by the firmware itself
+    for kernel in ${KERNELS:-linux}; do
+        files+=("/boot/vmlinuz-${kernel}" "${UKI_DIRECTORY}/arch-${kernel}.efi" "${UKI_DIRECTORY}/arch-${kernel}-fallback.efi")
+    done
+
+    # sbctl sign -s records the files so the pacman hook re-signs them on updates
+    local commands=()
+    for file in "${files[@]}"; do
+        commands+=("sbctl sign -s $file")
+    done
+    commands+=("sbctl verify")
+
+    execute_process "Signing bootloader and UKIs" \
+        --use-chroot \
+        --error-message "Signing failed" \
+        --success-message "Signing completed" \
+        "${commands[@]}"
+}
+
+main() {
+    process_init "Secure Boot"
+    show_logo "Secure Boot"
+    print_message INFO "Starting secure boot process"
+    print_message INFO "DRY_RUN in $(basename "$0") is set to: ${YELLOW}$DRY_RUN"
+
+    if [ "$UKI" != "true" ] && [ "$SECURE_BOOT" != "true" ]; then
+        print_message INFO "UKI and Secure Boot are disabled, nothing to do"
+        process_end 0
+        return 0
+    fi
+    if [ "$BIOS_TYPE" == "bios" ]; then
+        print_message ERROR "UKIs and Secure Boot require UEFI firmware"
+        return 1
+    fi
+
+    uki_packages || { print_message ERROR "UKI package installation failed"; return 1; }
+    kernel_cmdline || { print_message ERROR "Writing kernel cmdline failed"; return 1; }
+    uki_presets || { print_message ERROR "Building UKIs failed"; return 1; }
+    uki_boot_entries || { print_message ERROR "Creating UKI boot entries failed"; return 1; }
+
+    if [ "$SECURE_BOOT" == "true" ]; then
+        secure_boot_keys || { print_message ERROR "Secure Boot key setup failed"; return 1; }
+        secure_boot_sign || { print_message ERROR "Secure Boot signing failed"; return 1; }
+    fi
+    local status=$?
+
+    print_message OK "Secure boot process completed successfully"
+    process_end $status
+}
+
+# Run the main function
+main "$@"
+exit $?
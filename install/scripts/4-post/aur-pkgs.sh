@@ -0,0 +1,133 @@
+#!/bin/bash
+# AUR Packages Script
+# Author: ssnow
+# Date: 2024
+# Description: Install the AUR helper and the selected AUR packages
+
+set -eo pipefail  # Exit on error, pipe failure
+
+# Determine the correct path to lib.sh
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+LIB_PATH="$(dirname "$(dirname "$SCRIPT_DIR")")/lib/lib.sh"
+
+# Source the library functions
+# shellcheck source=../../lib/lib.sh
+if [ -f "$LIB_PATH" ]; then
+    . "$LIB_PATH"
+else
+    echo "Error: Cannot find lib.sh at $LIB_PATH" >&2
+    exit 1
+fi
+
+# Enable dry run mode for testing purposes (set to false to disable)
+# Ensure DRY_RUN is exported
+export DRY_RUN="${DRY_RUN:-false}"
+
+# makepkg and the helper run as the new user, pacman needs sudo without a
+# password for that. The drop-in only exists while this script runs.
+SUDOERS_DROP_IN="/mnt/etc/sudoers.d/99-arch-matic-aur"
+
+remove_sudoers_drop_in() {
+    rm -f "$SUDOERS_DROP_IN"
+}
+
+add_sudoers_drop_in() {
+    if [[ "$DRY_RUN" == true ]]; then
+        print_message ACTION "[DRY RUN] Would allow ${USERNAME} passwordless sudo in ${SUDOERS_DROP_IN}"
+        return 0
+    fi
+    trap remove_sudoers_drop_in EXIT
+    trap 'exit 130' INT TERM
+    mkdir -p "$(dirname "$SUDOERS_DROP_IN")"
+    printf '%s ALL=(ALL) NOPASSWD: ALL\n' "$USERNAME" > "$SUDOERS_DROP_IN"
+    chmod 440 "$SUDOERS_DROP_IN"
+}
+
+install_helper() {
+    local helper="$AUR_HELPER"
+    local build_dir="/tmp/${helper}-bin"
+
+    execute_process "Install AUR build tools" \
+        --use-chroot \
+        --error-message "Installing AUR build tools failed" \
+        --success-message "AUR build tools installed" \
+        "pacman -S --noconfirm --needed git base-devel"
+
+    execute_process "Build ${helper}" \
+        --use-chroot \
+        --error-message "Building ${helper} failed" \
+        --success-message "${helper} installed" \
+        "command -v ${helper} >/dev/null || su - ${USERNAME} -c 'rm -rf ${build_dir} && git clone https://aur.archlinux.org/${helper}-bin.git ${build_dir} && cd ${build_dir} && makepkg -si --noconfirm'" \
+        "rm -rf ${build_dir}"
+
+    if [[ "$DRY_RUN" != true ]] && ! arch-chroot /mnt /bin/bash -c "command -v ${helper}" >/dev/null; then
+        print_message ERROR "${helper} is not installed"
+        return 1
+    fi
+}
+
+# The AUR packages of the desktop profile and of the [packages] section
+# follow those of the selected groups.
+# Every package is installed on its own so one failing build does not stop
+# the others, each result is reported to the installer as a package event.
+install_aur_packages() {
+    local failed=()
+    local total=0
+    local count=0
+    local package
+
+    for package in $AUR_PACKAGES $DESKTOP_AUR_PACKAGES $USER_AUR_PACKAGES; do
+        total=$((total + 1))
+    done
+
+    for package in $AUR_PACKAGES $DESKTOP_AUR_PACKAGES $USER_AUR_PACKAGES; do
+        emit_progress $((count * 100 / total)) "AUR: ${package}"
+        if [[ "$DRY_RUN" == true ]]; then
+            print_message ACTION "[DRY RUN] Would execute: su - ${USERNAME} -c '${AUR_HELPER} -S --noconfirm --needed ${package}'"
+            emit_event dry_run "su - ${USERNAME} -c '${AUR_HELPER} -S --noconfirm --needed ${package}'"
+            emit_event package "$package" "\"exit_code\":0"
+        elif arch-chroot /mnt /bin/bash -c "su - ${USERNAME} -c '${AUR_HELPER} -S --noconfirm --needed ${package}'"; then
+            print_message OK "AUR package ${package} installed"
+            emit_event package "$package" "\"exit_code\":0"
+        else
+            local code=$?
+            print_message ERROR "AUR package ${package} failed with exit code ${code}"
+            emit_event package "$package" "\"exit_code\":${code}"
+            failed+=("$package")
+        fi
+        count=$((count + 1))
+    done
+    emit_progress 100 "AUR packages done"
+
+    if [[ ${#failed[@]} -gt 0 ]]; then
+        print_message ERROR "AUR packages failed: ${failed[*]}"
+        return 1
+    fi
+}
+
+main() {
+    process_init "AUR Packages"
+    show_logo "AUR Packages"
+    print_message INFO "Starting AUR packages process"
+    print_message INFO "DRY_RUN in $(basename "$0") is set to: ${YELLOW}$DRY_RUN"
+
+    if [[ -z "$AUR_HELPER" || "$AUR_HELPER" == "none" ]]; then
+        print_message INFO "No AUR helper selected, skipping AUR packages"
+        process_end 0
+        return 0
+    fi
+
+    add_sudoers_drop_in || { print_message ERROR "Adding the sudoers drop-in failed"; return 1; }
+    install_helper || { print_message ERROR "Installing ${AUR_HELPER} failed"; return 1; }
+    if [[ -n "$AUR_PACKAGES$DESKTOP_AUR_PACKAGES$USER_AUR_PACKAGES" ]]; then
+        install_aur_packages || { print_message ERROR "AUR packages process failed"; return 1; }
+    fi
+    remove_sudoers_drop_in
+
+    print_message OK "AUR packages process completed successfully"
+    process_end $?
+}
+
+# Run the main function
+main "$@"
+exit $?
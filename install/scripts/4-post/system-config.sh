@@ -24,29 +24,55 @@ fi
 export DRY_RUN="${DRY_RUN:-false}"
 
 gpu_setup() {
-    local gpu_info
-    gpu_info=${GPU_DRIVER}
+    local command
+    local packages=""
 
-    case "$gpu_info" in
-        *NVIDIA*|*GeForce*)
-            print_message ACTION "Installing NVIDIA drivers"
-            command="pacman -S --noconfirm --needed nvidia-dkms nvidia-utils lib32-nvidia-utils"
+    # GPU_DRIVER and GPU are chosen (and cross-checked) by the installer
+    case "$GPU_DRIVER" in
+        none)
+            print_message INFO "No GPU driver selected, skipping GPU setup"
+            return 0
             ;;
-        *AMD*|*ATI*)
+        nvidia)
+            print_message ACTION "Installing NVIDIA proprietary drivers"
+            packages="nvidia-dkms nvidia-utils lib32-nvidia-utils"
+            ;;
+        nvidia-open)
+            print_message ACTION "Installing NVIDIA open kernel module drivers"
+            packages="nvidia-open-dkms nvidia-utils lib32-nvidia-utils"
+            ;;
+        nouveau)
+            print_message ACTION "Installing nouveau drivers for a legacy NVIDIA GPU"
+            packages="xf86-video-nouveau mesa lib32-mesa vulkan-nouveau lib32-vulkan-nouveau"
+            ;;
+        amdgpu)
             print_message ACTION "Installing AMD drivers"
-            command="pacman -S --noconfirm --needed xf86-video-amdgpu mesa lib32-mesa vulkan-radeon lib32-vulkan-radeon"
+            packages="xf86-video-amdgpu mesa lib32-mesa vulkan-radeon lib32-vulkan-radeon"
             ;;
-        *Intel*)
+        intel)
             print_message ACTION "Installing Intel drivers"
-            command="pacman -S --noconfirm --needed xf86-video-intel mesa lib32-mesa vulkan-intel lib32-vulkan-intel"
+            packages="mesa lib32-mesa vulkan-intel lib32-vulkan-intel intel-media-driver"
             ;;
         *)
-            print_message WARNING "Unknown GPU. Installing generic drivers"
-            command="pacman -S --noconfirm --needed xf86-video-vesa mesa"
+            print_message WARNING "Unknown GPU driver: ${GPU_DRIVER}. Installing generic drivers"
+            packages="xf86-video-vesa mesa"
             ;;
     esac
-    print_message DEBUG "GPU type: ${gpu_info}"
 
+    # Hybrid laptops also need the integrated GPU stack and PRIME offloading
+    case "$GPU" in
+        intel-nvidia)
+            print_message ACTION "Adding Intel integrated GPU drivers for hybrid graphics"
+            packages+=" mesa lib32-mesa vulkan-intel lib32-vulkan-intel intel-media-driver nvidia-prime"
+            ;;
+        amd-nvidia)
+            print_message ACTION "Adding AMD integrated GPU drivers for hybrid graphics"
+            packages+=" mesa lib32-mesa vulkan-radeon lib32-vulkan-radeon nvidia-prime"
+            ;;
+    esac
+    print_message DEBUG "GPU type: ${GPU}, driver: ${GPU_DRIVER}"
+
+    command="pacman -S --noconfirm --needed ${packages}"
     execute_process "GPU Setup" \
         --use-chroot \
         --error-message "GPU setup failed" \
@@ -55,7 +81,7 @@ gpu_setup() {
 }
 system_config() {
 
-    print_message DEBUG "Chroot operations: $HOSTNAME, $LOCALE, $TIMEZONE, $KEYMAP, $USERNAME, $PASSWORD"
+    print_message DEBUG "Chroot operations: $HOSTNAME, $LOCALE, $TIMEZONE, $KEYMAP, $USERNAME"
     execute_process "System config" \
         --use-chroot \
         --error-message "System config failed" \
@@ -66,20 +92,56 @@ system_config() {
         "echo 'LANG=$LOCALE' > /etc/locale.conf" \
         "ln -sf /usr/share/zoneinfo/$TIMEZONE /etc/localtime" \
         "echo 'KEYMAP=$KEYMAP' > /etc/vconsole.conf" \
-        "useradd -m -G wheel -s /bin/bash $USERNAME" \
+        "pacman -S --noconfirm --needed ${LOGIN_SHELL:-bash}" \
+        "useradd -m -G wheel -s /usr/bin/${LOGIN_SHELL:-bash} $USERNAME" \
         "echo 'root:$PASSWORD' | chpasswd" \
         "echo '$USERNAME:$PASSWORD' | chpasswd" \
         "sed -i 's/^# %wheel ALL=(ALL) ALL/%wheel ALL=(ALL) ALL/' /etc/sudoers"
 
 }
 
+vm_guest_setup() {
+    local commands=()
+    local service
+
+    if [ -z "$GUEST_PACKAGES" ]; then
+        print_message DEBUG "Not a virtual machine guest (${VM_GUEST:-none}), skipping guest tools"
+        return 0
+    fi
+
+    print_message ACTION "Installing ${VM_GUEST} guest tools: ${GUEST_PACKAGES}"
+    commands+=("pacman -S --noconfirm --needed ${GUEST_PACKAGES}")
+    for service in ${GUEST_SERVICES}; do
+        commands+=("systemctl enable ${service}")
+    done
+
+    execute_process "VM guest setup" \
+        --use-chroot \
+        --error-message "VM guest setup failed" \
+        --success-message "VM guest setup completed" \
+        "${commands[@]}"
+}
+build_config() {
+
+    print_message DEBUG "ParallelDownloads: ${PARALLEL_DOWNLOADS:-5}, MAKEFLAGS: ${TARGET_MAKEFLAGS:--j$(nproc)}"
+    execute_process "Build config" \
+        --use-chroot \
+        --error-message "Build config failed" \
+        --success-message "Build config completed" \
+        "sed -i 's/^#\?ParallelDownloads.*/ParallelDownloads = ${PARALLEL_DOWNLOADS:-5}/' /etc/pacman.conf" \
+        "sed -i 's/^#\?MAKEFLAGS=.*/MAKEFLAGS=\"${TARGET_MAKEFLAGS:--j$(nproc)}\"/' /etc/makepkg.conf"
+
+}
+
 main() {
     process_init "System Config"
     show_logo "System Config"
     print_message INFO "Starting system config process"
     print_message INFO "DRY_RUN in $(basename "$0") is set to: ${YELLOW}$DRY_RUN"
 
+    build_config || { print_message ERROR "Build config failed"; return 1; }
     gpu_setup || { print_message ERROR "GPU setup failed"; return 1; }
+    vm_guest_setup || { print_message ERROR "VM guest setup failed"; return 1; }
     system_config || { print_message ERROR "System config process failed"; return 1; }
 
     print_message OK "System config process completed successfully"
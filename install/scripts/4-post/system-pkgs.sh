@@ -23,82 +23,31 @@ fi
 # Ensure DRY_RUN is exported
 export DRY_RUN="${DRY_RUN:-false}"
 
-    # Define packages to install
-declare -A PACKAGE_GROUPS
-PACKAGE_GROUPS=(
-    ["base"]="eza fzf zoxide bat exa"
-    ["system_tools"]="reflector openssh rsync"
-    ["boot"]="plymouth grub os-prober"
-    ["bluetooth"]="bluez bluez-utils"
-    ["audio"]="pipewire wireplumber pipewire-pulse pipewire-alsa pipewire-jack"
-    ["utilities"]="fastfetch ntp cronie ${TERMINAL} kitty thunar"
-    ["browser"]="firefox"
-    ["desktop"]="gnome gnome-tweaks gdm"
-    ["development"]="git vim neovim"
-    ["office"]="libreoffice-fresh pinta"
-    ["multimedia"]="vlc"
-    ["communication"]="discord thunderbird"
-    ["security"]="bitwarden"
-    ["networking"]="networkmanager network-manager-applet dhclient"
-    ["printer"]="cups"
-    ["scanner"]=""
-    ["virtualization"]="qemu virt-manager"
-    ["containerization"]="docker"
-    ["fonts"]="terminus-font ttf-font-awesome ttf-nerd-fonts-symbols ttf-jetbrains-mono-nerd ttf-meslo-nerd ttf-firacode-nerd ttf-nerd-fonts-symbols-common"
-    ["filesystem"]="btrfs-progs dosfstools ntfs-3g"
-    ["xdg"]="xdg-user-dirs"
-    ["theme"]="papirus-icon-theme"
-    ["gaming"]="steam lutris"
-)
-# User-configurable options
-INSTALL_GROUPS=(
-    "base" 
-    "bluetooth" 
-    "audio" 
-    "utilities" 
-    "browser" 
-    "desktop" 
-    "development" 
-    "office" 
-    "multimedia" 
-    "communication" 
-    "security" 
-    "networking" 
-    "printer"  
-    "fonts" 
-    "filesystem" 
-    "xdg"
-)  # Default groups
-
-# Function to install packages
-install_package_group() {
-    local group_name="$1"
-    local packages="${PACKAGE_GROUPS[$group_name]}"
-    # Check if packages are defined for the group
-    if [ -n "$packages" ]; then
-        print_message INFO "Installing $group_name packages: $packages"
-        execute_process "Install $group_name packages" \
-            --use-chroot \
-            --error-message "Failed to install $group_name packages" \
-            --success-message "$group_name packages installed successfully" \
-            "pacman -S --noconfirm --needed $packages"
-    else
-        print_message WARNING "No packages defined for group: $group_name"
-    fi
-}
-# Function to install all selected package groups
-# Modify the install_selected_packages function
+# PACKAGE_GROUPS and SYSTEM_PACKAGES are resolved by the installer from
+# install/package_groups.toml and the groups selected in the wizard,
+# USER_PACKAGES from the [packages] section of the config. A failed pacman
+# fails the script so the runner can retry it.
 install_selected_packages() {
     print_message INFO "Starting package installation"
-    # Install packages for each group
-    for group in "${INSTALL_GROUPS[@]}"; do
-        if [[ -v "PACKAGE_GROUPS[$group]" ]]; then
-            print_message INFO "Installing group: $group"
-            install_package_group "$group"
-        else
-            print_message WARNING "Skipping unknown package group: $group"
-        fi
-    done
+    if [ -z "$SYSTEM_PACKAGES" ]; then
+        print_message WARNING "No package groups selected"
+    else
+        print_message INFO "Package groups: ${PACKAGE_GROUPS}"
+        execute_process "Install system packages" \
+            --use-chroot \
+            --propagate \
+            --error-message "Failed to install system packages" \
+            --success-message "System packages installed successfully" \
+            "pacman -S --noconfirm --needed ${SYSTEM_PACKAGES}" || return 1
+    fi
+    if [ -n "$USER_PACKAGES" ]; then
+        execute_process "Install user packages" \
+            --use-chroot \
+            --propagate \
+            --error-message "Failed to install user packages" \
+            --success-message "User packages installed successfully" \
+            "pacman -S --noconfirm --needed ${USER_PACKAGES}" || return 1
+    fi
     print_message OK "Package installation completed"
 }
 # Function to execute commands with error handling
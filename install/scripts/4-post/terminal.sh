@@ -30,10 +30,10 @@ terminal() {
     execute_process "Installing Terminal" \
         --error-message "Terminal installation failed" \
         --success-message "Terminal installation completed" \
-        "pacman -S --noconfirm --needed ${TERMINAL} kitty ${SHELL} starship" \
+        "pacman -S --noconfirm --needed ${TERMINAL} kitty ${LOGIN_SHELL:-bash} starship" \
         "cp -r ${SCRIPT_DIR}/config/${TERMINAL} ~/.config/${TERMINAL}" \
         "cp -r ${SCRIPT_DIR}/config/starship.toml ~/.config/starship.toml" \
-        "cp -r ${SCRIPT_DIR}/config/${SHELL}rc ~/.${SHELL}rc"
+        "cp -r ${SCRIPT_DIR}/config/${LOGIN_SHELL:-bash}rc ~/.${LOGIN_SHELL:-bash}rc"
 }
 
 main() {
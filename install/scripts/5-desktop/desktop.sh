@@ -0,0 +1,70 @@
+#!/bin/bash
+# Desktop Script
+# Author: ssnow
+# Date: 2024
+# Description: Install the desktop profile selected for Arch Linux
+
+set -eo pipefail  # Exit on error, pipe failure
+
+# Determine the correct path to lib.sh
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+LIB_PATH="$(dirname "$(dirname "$SCRIPT_DIR")")/lib/lib.sh"
+
+# Source the library functions
+# shellcheck source=../../lib/lib.sh
+if [ -f "$LIB_PATH" ]; then
+    . "$LIB_PATH"
+else
+    echo "Error: Cannot find lib.sh at $LIB_PATH" >&2
+    exit 1
+fi
+
+# Enable dry run mode for testing purposes (set to false to disable)
+# Ensure DRY_RUN is exported
+export DRY_RUN="${DRY_RUN:-false}"
+
+# DESKTOP_PACKAGES is resolved by the installer from the profile of
+# DESKTOP_ENVIRONMENT in install/desktop_profiles.toml, with its extras
+# unless DESKTOP_EXTRAS is false. AUR packages of the profile are installed
+# by aur-pkgs.sh, the display manager is enabled by last-cleanup.sh.
+install_desktop() {
+    if [ -z "$DESKTOP_PACKAGES" ]; then
+        print_message INFO "Desktop profile ${DESKTOP_ENVIRONMENT} installs no packages"
+        return 0
+    fi
+    print_message INFO "Installing desktop profile ${DESKTOP_ENVIRONMENT}"
+    execute_process "Install desktop profile ${DESKTOP_ENVIRONMENT}" \
+        --use-chroot \
+        --propagate \
+        --error-message "Desktop profile ${DESKTOP_ENVIRONMENT} installation failed" \
+        --success-message "Desktop profile ${DESKTOP_ENVIRONMENT} installed" \
+        "pacman -S --noconfirm --needed ${DESKTOP_PACKAGES}" || return 1
+}
+# greetd only runs a greeter, tuigreet logs in to the session of the profile
+configure_greetd() {
+    if [ "$DISPLAY_MANAGER" != "greetd" ]; then
+        return 0
+    fi
+    execute_process "Configure greetd" \
+        --use-chroot \
+        --propagate \
+        --error-message "greetd configuration failed" \
+        --success-message "greetd starts ${DESKTOP_SESSION}" \
+        "sed -i 's|^command = .*|command = \"tuigreet --time --remember --cmd ${DESKTOP_SESSION}\"|' /etc/greetd/config.toml" || return 1
+}
+
+main() {
+    process_init "Desktop"
+    show_logo "Desktop"
+    print_message INFO "Starting desktop process"
+    print_message INFO "DRY_RUN in $(basename "$0") is set to: ${YELLOW}$DRY_RUN"
+
+    install_desktop || { print_message ERROR "Desktop installation failed"; return 1; }
+    configure_greetd || { print_message ERROR "greetd configuration failed"; return 1; }
+    print_message OK "Desktop process completed successfully"
+    process_end $?
+}
+
+# Run the main function
+main "$@"
+exit $?
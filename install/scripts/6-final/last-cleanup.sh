@@ -24,20 +24,60 @@ fi
 export DRY_RUN="${DRY_RUN:-false}"
 
 
+# The base services are enabled only when the package that provides them is
+# installed, the networking, system_tools, utilities and bluetooth groups can
+# be turned off. DISPLAY_MANAGER and DESKTOP_SERVICES come from the desktop
+# profile, the none profile has neither.
 enable_services() {
-    local display_message="gdm"
+    local base_services=("NetworkManager:networkmanager" "sshd:openssh" "cronie:cronie" "bluetooth:bluez")
+    local installed=" ${SYSTEM_PACKAGES} ${USER_PACKAGES} ${DESKTOP_PACKAGES} "
+    local commands=()
+    local entry
+    local service
+
+    for entry in "${base_services[@]}"; do
+        if [[ "$installed" == *" ${entry#*:} "* ]]; then
+            commands+=("systemctl enable ${entry%%:*}")
+        else
+            print_message INFO "${entry#*:} is not installed, not enabling ${entry%%:*}"
+        fi
+    done
+    for service in $DISPLAY_MANAGER $DESKTOP_SERVICES; do
+        commands+=("systemctl enable ${service}")
+    done
 
     print_message INFO "Enable and start services"
     execute_process "Enable and start services" \
         --use-chroot \
         --error-message "Enable and start services failed" \
         --success-message "Enable and start services completed" \
-        "systemctl enable NetworkManager" \
-        "systemctl enable sshd" \
-        "systemctl enable cronie" \
-        "systemctl enable bluetooth" \
-        "systemctl enable ${display_message}"
+        "${commands[@]}"
+
+}
+# Undoes the package-sources step: the local repository and the ISO cache
+# are unmounted and the target gets the original mirrorlist, behind the
+# [repository] mirror when there is one.
+restore_package_sources() {
+    local commands=()
+
+    if [ -z "$PACMAN_MIRROR" ] && [ -z "$LOCAL_REPO" ] && [ "$REUSE_ISO_CACHE" != "true" ]; then
+        return 0
+    fi
+    [ -n "$LOCAL_REPO" ] && commands+=("umount /mnt${LOCAL_REPO%/}")
+    if [ "$REUSE_ISO_CACHE" = "true" ]; then
+        commands+=("umount /mnt/var/cache/pacman/iso")
+        commands+=("sed -i '/^# arch-matic iso cache\$/,+2d' /mnt/etc/pacman.conf")
+    fi
+    if [ -f /etc/pacman.d/mirrorlist.backup ]; then
+        commands+=("cp /etc/pacman.d/mirrorlist.backup /mnt/etc/pacman.d/mirrorlist")
+        [ -n "$PACMAN_MIRROR" ] && commands+=("sed -i '1i Server = ${PACMAN_MIRROR}' /mnt/etc/pacman.d/mirrorlist")
+    fi
 
+    print_message INFO "Restoring the package sources of the target"
+    execute_process "Restore package sources" \
+        --error-message "Restoring the package sources failed" \
+        --success-message "Package sources restored" \
+        "${commands[@]}"
 }
 last_cleanup() {
     print_message INFO "Last cleanup"
@@ -58,6 +98,7 @@ main() {
     print_message INFO "DRY_RUN in $(basename "$0") is set to: ${YELLOW}$DRY_RUN"
 
     enable_services || { print_message ERROR "Enable and start services failed"; return 1; }
+    restore_package_sources || { print_message ERROR "Restoring the package sources failed"; return 1; }
     last_cleanup || { print_message ERROR "Last cleanup failed"; return 1; }
 
     print_message OK "Last cleanup completed successfully"
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Lines kept in the log pane, the full output goes to install.log
+const maxLogLines = 2000
+
+const (
+	stepPending  = "pending"
+	stepRunning  = "running"
+	stepDone     = "done"
+	stepFailed   = "failed"
+	stepSkipped  = "skipped"
+	phaseConfirm = "confirm"
+	phaseRunning = "running"
+	phaseDone    = "done"
+	phaseFailed  = "failed"
+)
+
+type installEventMsg runnerEvent
+type installLogMsg string
+type installDoneMsg struct{ err error }
+type installTickMsg time.Time
+
+// lineWriter splits the script output into lines for the log pane and
+// copies it unchanged to the log file. Progress output redraws a line with
+// carriage returns, only the last redraw of a line is kept.
+type lineWriter struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	file   io.Writer
+	onLine func(string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		w.file.Write(p)
+	}
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep the incomplete line for the next write
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			break
+		}
+		w.emit(line)
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) emit(line string) {
+	line = strings.TrimRight(line, "\r\n")
+	if i := strings.LastIndex(line, "\r"); i >= 0 {
+		line = line[i+1:]
+	}
+	w.onLine(line)
+}
+
+// flush passes on a last line that did not end with a newline
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		w.emit(w.buf.String())
+		w.buf.Reset()
+	}
+}
+
+// installFailure is what the failure screen shows
+type installFailure struct {
+	step      installStep
+	exitCode  int
+	lastError string
+	tail      []string
+}
+
+type installModel struct {
+	runner   *stageRunner
+	steps    []installStep
+	status   []string
+	started  []time.Time
+	finished []time.Time
+	log      []string
+	viewport viewport.Model
+	phase    string
+	start    time.Time
+	end      time.Time
+	err      error
+	failure  *installFailure
+	notice   string
+	logFile  string
+
+	// From pacman's output
+	pacman pacmanProgress
+
+	// From the script events
+	action    string
+	percent   *float64
+	warnings  int
+	lastError string
+
+	width, height int
+}
+
+func newInstallModel(runner *stageRunner, steps []installStep, logFile string) installModel {
+	m := installModel{
+		runner:   runner,
+		steps:    steps,
+		status:   make([]string, len(steps)),
+		started:  make([]time.Time, len(steps)),
+		finished: make([]time.Time, len(steps)),
+		viewport: viewport.New(60, 15),
+		phase:    phaseConfirm,
+		logFile:  logFile,
+	}
+	for i := range m.status {
+		m.status[i] = stepPending
+	}
+	if runner.yes {
+		m.phase = phaseRunning
+		m.start = time.Now()
+	}
+	return m
+}
+
+// startRun runs the steps in the background, installDoneMsg reports the end
+func (m installModel) startRun() tea.Cmd {
+	runner, steps := m.runner, m.steps
+	return tea.Batch(installTick(), func() tea.Msg {
+		return installDoneMsg{err: runner.run(steps)}
+	})
+}
+
+// runWithView runs the steps with the live install view. Script output is
+// shown in the log pane and written to install.log in the install directory.
+// Without a terminal the output is printed as it comes and nothing is asked.
+func runWithView(runner *stageRunner, steps []installStep) error {
+	// A resumed install keeps the log of the run it continues
+	logFile := filepath.Join(runner.archDir, "install.log")
+	mode := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if runner.resume {
+		mode = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(logFile, mode, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", logFile, err)
+	}
+	defer file.Close()
+
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		output := io.MultiWriter(os.Stdout, file)
+		runner.stdout = output
+		runner.stderr = output
+		return runner.run(steps)
+	}
+
+	// The runner handles the signals, it has to stop the scripts and clean up
+	p := tea.NewProgram(newInstallModel(runner, steps, logFile), tea.WithAltScreen(), tea.WithoutSignalHandler())
+	output := &lineWriter{file: file, onLine: func(line string) { p.Send(installLogMsg(line)) }}
+	runner.stdout = output
+	runner.stderr = output
+	runner.onEvent = func(event runnerEvent) {
+		output.flush()
+		p.Send(installEventMsg(event))
+	}
+
+	final, err := p.Run()
+	if err != nil {
+		return fmt.Errorf("error running install view: %v", err)
+	}
+	m := final.(installModel)
+	switch m.phase {
+	case phaseConfirm:
+		return fmt.Errorf("install cancelled")
+	case phaseFailed:
+		return m.err
+	}
+	return nil
+}
+
+func installTick() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg { return installTickMsg(t) })
+}
+
+func (m installModel) Init() tea.Cmd {
+	if m.phase == phaseRunning {
+		return m.startRun()
+	}
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (m installModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.viewport.Width = max(msg.Width-48, 40)
+		m.viewport.Height = max(msg.Height-12, 5)
+		m.viewport.SetContent(strings.Join(m.log, "\n"))
+		m.viewport.GotoBottom()
+		return m, nil
+
+	case tea.KeyMsg:
+		switch m.phase {
+		case phaseConfirm:
+			switch msg.String() {
+			case "enter":
+				m.phase = phaseRunning
+				m.start = time.Now()
+				return m, m.startRun()
+			case "q", "ctrl+c", "esc":
+				return m, tea.Quit
+			}
+		case phaseRunning:
+			if msg.String() == "ctrl+c" {
+				m.notice = "Aborting, waiting for the running script to stop..."
+				m.runner.interrupt()
+				return m, nil
+			}
+		default:
+			switch msg.String() {
+			case "q", "ctrl+c", "esc", "enter":
+				return m, tea.Quit
+			}
+		}
+		var cmd tea.Cmd
+		m.viewport, cmd = m.viewport.Update(msg)
+		return m, cmd
+
+	case tea.MouseMsg:
+		var cmd tea.Cmd
+		m.viewport, cmd = m.viewport.Update(msg)
+		return m, cmd
+
+	case installLogMsg:
+		follow := m.viewport.AtBottom()
+		m.pacman.parseLine(string(msg), time.Now())
+		m.log = append(m.log, string(msg))
+		if len(m.log) > maxLogLines {
+			m.log = m.log[len(m.log)-maxLogLines:]
+		}
+		m.viewport.SetContent(strings.Join(m.log, "\n"))
+		if follow {
+			m.viewport.GotoBottom()
+		}
+		return m, nil
+
+	case installEventMsg:
+		i := msg.Index
+		switch msg.Kind {
+		case "skipped":
+			m.status[i] = stepSkipped
+		case "started":
+			m.status[i] = stepRunning
+			m.started[i] = time.Now()
+			m.lastError = ""
+		case "finished":
+			m.finished[i] = time.Now()
+			m.status[i] = stepDone
+			if msg.Err != nil {
+				m.status[i] = stepFailed
+				m.failure = m.newFailure(msg.Step, msg.Err)
+			}
+			m.action, m.percent = "", nil
+			m.pacman = pacmanProgress{}
+		case "event":
+			m.applyEvent(msg.Event)
+		}
+		return m, nil
+
+	case installDoneMsg:
+		m.err = msg.err
+		m.end = time.Now()
+		m.phase = phaseDone
+		if msg.err != nil {
+			m.phase = phaseFailed
+		}
+		m.notice = ""
+		return m, nil
+
+	case installTickMsg:
+		if m.phase == phaseRunning {
+			return m, installTick()
+		}
+		return m, nil
+	}
+	return m, nil
+}
+
+// applyEvent tracks what the running script reports about itself
+func (m *installModel) applyEvent(event installEvent) {
+	switch event.Type {
+	case eventProcessStart, eventStepStart:
+		m.action = event.Message
+		m.percent = nil
+	case eventStepEnd:
+		m.percent = nil
+	case eventProgress:
+		m.percent = event.Percent
+		if event.Message != "" {
+			m.action = event.Message
+		}
+	case eventRetry:
+		m.action = event.Message
+		m.percent = nil
+		m.pacman = pacmanProgress{}
+		m.warnings++
+	case eventWarning:
+		m.warnings++
+	case eventError:
+		m.lastError = event.Message
+	case eventCheck:
+		if event.Passed != nil && !*event.Passed {
+			m.lastError = fmt.Sprintf("check %s failed: %s", event.Name, event.Message)
+		}
+	case eventPackage:
+		if event.ExitCode != nil && *event.ExitCode != 0 {
+			m.lastError = fmt.Sprintf("package %s failed with exit code %d", event.Message, *event.ExitCode)
+			m.warnings++
+		}
+	}
+}
+
+// newFailure collects what the failure screen shows: the last error the
+// script reported and the output leading up to it.
+func (m installModel) newFailure(step installStep, err error) *installFailure {
+	failure := &installFailure{step: step, exitCode: exitCode(err), lastError: m.lastError}
+	for i := len(m.log) - 1; i >= 0 && failure.lastError == ""; i-- {
+		if strings.Contains(m.log[i], "ERROR") {
+			failure.lastError = strings.TrimSpace(m.log[i])
+		}
+	}
+	failure.tail = m.log[max(len(m.log)-10, 0):]
+	return failure
+}
+
+// stageStatus summarises the steps of a stage
+func (m installModel) stageStatus(stage string) (string, time.Duration) {
+	status := stepPending
+	var first, last time.Time
+	pending, skipped, total := 0, 0, 0
+	for i, step := range m.steps {
+		if step.Stage != stage {
+			continue
+		}
+		total++
+		switch m.status[i] {
+		case stepFailed:
+			status = stepFailed
+		case stepRunning:
+			if status != stepFailed {
+				status = stepRunning
+			}
+		case stepPending:
+			pending++
+		case stepSkipped:
+			skipped++
+		}
+		if !m.started[i].IsZero() && (first.IsZero() || m.started[i].Before(first)) {
+			first = m.started[i]
+		}
+		if m.finished[i].After(last) {
+			last = m.finished[i]
+		}
+	}
+	if status == stepPending && pending > 0 && pending < total {
+		// Between two scripts of the stage
+		status = stepRunning
+	}
+	if status == stepPending && pending == 0 {
+		status = stepDone
+		if skipped == total {
+			status = stepSkipped
+		}
+	}
+
+	var elapsed time.Duration
+	switch {
+	case first.IsZero():
+	case status == stepRunning:
+		elapsed = time.Since(first)
+	default:
+		elapsed = last.Sub(first)
+	}
+	return status, elapsed.Round(time.Second)
+}
+
+func (m installModel) stages() []string {
+	var stages []string
+	for _, step := range m.steps {
+		if len(stages) == 0 || stages[len(stages)-1] != step.Stage {
+			stages = append(stages, step.Stage)
+		}
+	}
+	return stages
+}
+
+func statusIcon(status string) string {
+	switch status {
+	case stepRunning:
+		return lipgloss.NewStyle().Foreground(nord13).Render("▶")
+	case stepDone:
+		return lipgloss.NewStyle().Foreground(nord14).Render("✔")
+	case stepFailed:
+		return lipgloss.NewStyle().Foreground(nord11).Render("✘")
+	case stepSkipped:
+		return lipgloss.NewStyle().Foreground(nord3).Render("↷")
+	}
+	return lipgloss.NewStyle().Foreground(nord3).Render("·")
+}
+
+func (m installModel) View() string {
+	titleStyle := lipgloss.NewStyle().
+		Foreground(nord6).
+		Background(nord3).
+		Padding(0, 1).
+		Bold(true)
+
+	leftColumnStyle := lipgloss.NewStyle().
+		BorderStyle(lipgloss.RoundedBorder()).
+		BorderForeground(nord10).
+		Width(40).
+		Foreground(nord4).
+		Padding(1, 1)
+
+	rightColumnStyle := lipgloss.NewStyle().
+		BorderStyle(lipgloss.RoundedBorder()).
+		BorderForeground(nord10).
+		Foreground(nord4)
+
+	footerStyle := lipgloss.NewStyle().
+		Foreground(nord4).
+		Background(nord3).
+		Padding(0, 1)
+
+	title := "Installing Arch Linux"
+	if m.runner.dryRun {
+		title += " (dry run)"
+	}
+
+	// Stage checklist, the scripts of the running stage are listed below it
+	var left strings.Builder
+	for _, stage := range m.stages() {
+		status, elapsed := m.stageStatus(stage)
+		fmt.Fprintf(&left, "%s %s", statusIcon(status), stage)
+		if elapsed > 0 {
+			fmt.Fprintf(&left, "  %s", elapsed)
+		}
+		left.WriteString("\n")
+		if status != stepRunning && status != stepFailed {
+			continue
+		}
+		for i, step := range m.steps {
+			if step.Stage == stage {
+				fmt.Fprintf(&left, "   %s %s\n", statusIcon(m.status[i]), step.Script)
+			}
+		}
+	}
+
+	var right string
+	switch {
+	case m.phase == phaseFailed && m.failure != nil:
+		right = m.failureView()
+	case m.phase == phaseConfirm:
+		right = fmt.Sprintf("%d scripts will run, see the checklist.\n\nPress Enter to start or q to cancel.", len(m.steps))
+	case m.phase == phaseRunning && m.pacman.active:
+		header := lipgloss.NewStyle().Foreground(nord8).Render("▶ "+m.action) + "\n" +
+			progressBar(m.pacman.fraction(), 30) + " " + m.pacman.String()
+		right = header + "\n" + m.viewport.View()
+	case m.action != "":
+		action := "▶ " + m.action
+		if m.percent != nil {
+			action += fmt.Sprintf(" (%.0f%%)", *m.percent)
+		}
+		right = lipgloss.NewStyle().Foreground(nord8).Render(action) + "\n" + m.viewport.View()
+	default:
+		right = m.viewport.View()
+	}
+
+	// Progress over the scripts that are no longer pending
+	completed := 0
+	current := ""
+	for i, status := range m.status {
+		switch status {
+		case stepDone, stepSkipped, stepFailed:
+			completed++
+		case stepRunning:
+			current = fmt.Sprintf("%s  %s", m.steps[i], time.Since(m.started[i]).Round(time.Second))
+		}
+	}
+	fraction := 0.0
+	if len(m.steps) > 0 {
+		fraction = float64(completed) / float64(len(m.steps))
+	}
+	bar := progressBar(fraction, 30)
+
+	var status string
+	switch m.phase {
+	case phaseConfirm:
+		status = "Waiting to start"
+	case phaseRunning:
+		status = "Running " + current
+	case phaseDone:
+		status = fmt.Sprintf("Installation completed in %s, press q to exit", m.elapsed())
+	case phaseFailed:
+		status = lipgloss.NewStyle().Foreground(nord11).Render(fmt.Sprintf("%v, press q to exit", m.err))
+	}
+	if m.warnings > 0 {
+		status += lipgloss.NewStyle().Foreground(nord13).Render(fmt.Sprintf("  %d warnings", m.warnings))
+	}
+	if m.notice != "" {
+		status = m.notice
+	}
+
+	return lipgloss.JoinVertical(lipgloss.Left,
+		titleStyle.Render(title),
+		lipgloss.JoinHorizontal(lipgloss.Top, leftColumnStyle.Render(left.String()), rightColumnStyle.Render(right)),
+		footerStyle.Render(fmt.Sprintf("%s %d/%d  %s", bar, completed, len(m.steps), status)),
+	)
+}
+
+func progressBar(fraction float64, width int) string {
+	filled := min(max(int(fraction*float64(width)), 0), width)
+	return lipgloss.NewStyle().Foreground(nord14).Render(strings.Repeat("▰", filled)) +
+		lipgloss.NewStyle().Foreground(nord2).Render(strings.Repeat("▱", width-filled))
+}
+
+func (m installModel) elapsed() time.Duration {
+	return m.end.Sub(m.start).Round(time.Second)
+}
+
+func (m installModel) failureView() string {
+	f := m.failure
+	errorStyle := lipgloss.NewStyle().Foreground(nord11).Bold(true)
+
+	var b strings.Builder
+	if m.runner.isAborted() {
+		b.WriteString(errorStyle.Render("✘ Installation aborted during "+f.step.String()) + "\n\n")
+	} else {
+		b.WriteString(errorStyle.Render("✘ "+f.step.String()+" failed") + "\n\n")
+	}
+	fmt.Fprintf(&b, "Script:    %s\n", f.step.Path)
+	fmt.Fprintf(&b, "Exit code: %d\n", f.exitCode)
+	if f.lastError != "" {
+		fmt.Fprintf(&b, "Error:     %s\n", f.lastError)
+	}
+	b.WriteString("\nLast output:\n")
+	for _, line := range f.tail {
+		b.WriteString("  " + line + "\n")
+	}
+	fmt.Fprintf(&b, "\nFull log: %s\n", m.logFile)
+	b.WriteString("Fix the problem and continue with: " + m.runner.command)
+	return lipgloss.NewStyle().Width(m.viewport.Width).Render(b.String())
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 
@@ -56,6 +57,9 @@ type model struct {
 	confirmationMode bool
 	listItems        []string
 	selectedItem     int
+	checkedItems     map[int]bool
+	cpuModel         string
+	numCPUs          int
 }
 
 type Question struct {
@@ -65,16 +69,54 @@ type Question struct {
 	Options  []string
 	Answer   string
 	Validate func(string, map[string]string) error
+	Preview  func(option string) string // shown under the options of a select
 }
 
 func main() {
+	// Subcommands run without the configuration wizard
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "probe":
+			runProbe(os.Args[2:])
+			return
+		case "run":
+			runStages(os.Args[2:])
+			return
+		case "plan":
+			runPlan(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "packages":
+			runPackages(os.Args[2:])
+			return
+		case "cache":
+			runCache(os.Args[2:])
+			return
+		}
+	}
+
 	// Define flags
 	dryRun := flag.Bool("d", false, "Run in dry-run mode")
 	flag.BoolVar(dryRun, "dry-run", false, "Run in dry-run mode")
 	verbose := flag.Bool("v", false, "Run in verbose mode")
 	flag.BoolVar(verbose, "verbose", false, "Run in verbose mode")
+	resume := flag.Bool("resume", false, "Resume an interrupted installation")
+	yes := flag.Bool("yes", false, "Start the install without asking for confirmation")
 	flag.Parse()
 
+	// Resuming reuses the saved configuration, it must not change
+	if *resume {
+		answers, err := loadResumeConfig(filepath.Join("install", "arch_config.toml"))
+		if err != nil {
+			fmt.Printf("Error loading saved configuration: %v\n", err)
+			os.Exit(1)
+		}
+		runInstallScript(answers, *dryRun, *verbose, true, *yes)
+		return
+	}
+
 	questions := loadQuestions()
 
 	// Load default answers from arch_config.toml if it exists
@@ -82,12 +124,18 @@ func main() {
 	if err != nil && !os.IsNotExist(err) {
 		fmt.Printf("Error loading arch_config.toml: %v\n", err)
 	}
+	if defaultAnswers == nil {
+		defaultAnswers = make(map[string]string)
+	}
 
+	cpuModel, _, _, numCPUs := getCPUInfo()
 	initialModel := model{
 		questions:    questions,
 		currentIndex: 0,
 		answers:      defaultAnswers, // Use loaded answers as defaults
 		textInput:    textinput.New(),
+		cpuModel:     cpuModel,
+		numCPUs:      numCPUs,
 	}
 	initialModel.textInput.Focus()
 
@@ -99,6 +147,7 @@ func main() {
 	}
 
 	finalModel := m.(model)
+	deriveAnswers(finalModel.answers)
 	printSummary(finalModel)
 
 	config := map[string]interface{}{
@@ -112,70 +161,84 @@ func main() {
 	}
 
 	if finalModel.answers["run_install"] == "true" {
-		runInstallScript(finalModel.answers, *dryRun, *verbose)
+		runInstallScript(finalModel.answers, *dryRun, *verbose, false, *yes)
 	}
 }
 
-func getDriveInfo() []string {
-	cmd := exec.Command("bash", "-c", "lsblk -ndo NAME,SIZE,MODEL")
-	output, err := cmd.Output()
+// getDriveInfo lists the disks an install can go to as "/dev/<name> (<size>
+// - <model>)". Partitions, loop and zram devices are left out.
+func getDriveInfo() ([]string, error) {
+	output, err := exec.Command("lsblk", "-dnP", "-o", "NAME,SIZE,TYPE,MODEL").Output()
 	if err != nil {
-		fmt.Printf("Error getting drive info: %v\n", err)
-		return []string{"/dev/sda (Unknown size) Unknown model"}
+		return nil, fmt.Errorf("error listing drives: %v", err)
 	}
+	drives := parseDriveInfo(string(output))
+	if len(drives) == 0 {
+		return nil, fmt.Errorf("no drives found")
+	}
+	return drives, nil
+}
+
+var lsblkPair = regexp.MustCompile(`([A-Z]+)="([^"]*)"`)
 
+// parseDriveInfo reads the KEY="value" lines of lsblk -P
+func parseDriveInfo(output string) []string {
 	var drives []string
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-	for scanner.Scan() {
-		fields := strings.Fields(scanner.Text())
-		if len(fields) >= 2 {
-			drive := fmt.Sprintf("/dev/%s (%s", fields[0], fields[1])
-			if len(fields) >= 3 {
-				drive += fmt.Sprintf(" - %s", strings.Join(fields[2:], " "))
-			}
-			drive += ")"
-			drives = append(drives, drive)
+	for _, line := range strings.Split(output, "\n") {
+		fields := make(map[string]string)
+		for _, pair := range lsblkPair.FindAllStringSubmatch(line, -1) {
+			fields[pair[1]] = strings.TrimSpace(pair[2])
 		}
-	}
-
-	if len(drives) == 0 {
-		return []string{"/dev/sda (Unknown size) Unknown model"}
+		name := fields["NAME"]
+		if name == "" || fields["TYPE"] != "disk" || strings.HasPrefix(name, "zram") || strings.HasPrefix(name, "loop") {
+			continue
+		}
+		drive := fmt.Sprintf("/dev/%s (%s", name, fields["SIZE"])
+		if fields["MODEL"] != "" {
+			drive += " - " + fields["MODEL"]
+		}
+		drives = append(drives, drive+")")
 	}
 	return drives
 }
 
+var cpuInfoPath = "/proc/cpuinfo"
+
 func getCPUInfo() (cpuType string, vendor string, microcode string, numCPUs int) {
 	cpuType = "Unknown"
 	vendor = "Unknown"
 	microcode = "Unknown"
 	numCPUs = runtime.NumCPU()
 
-	cmd := exec.Command("sh", "-c", "lscpu | grep -E 'Model name|Vendor ID|Microcode'")
-	output, err := cmd.Output()
-	if err == nil {
-		lines := strings.Split(string(output), "\n")
-		for _, line := range lines {
-			if strings.Contains(line, "Model name") {
-				cpuType = strings.TrimSpace(strings.Split(line, ":")[1])
-			} else if strings.Contains(line, "Vendor ID") {
-				vendorFull := strings.TrimSpace(strings.Split(line, ":")[1])
-				if strings.Contains(vendorFull, "AuthenticAMD") {
-					vendor = "amd"
-				} else if strings.Contains(vendorFull, "GenuineIntel") {
-					vendor = "intel"
-				}
-			} else if strings.Contains(line, "Microcode") {
-				microcode = strings.TrimSpace(strings.Split(line, ":")[1])
-			}
-		}
+	file, err := os.Open(cpuInfoPath)
+	if err != nil {
+		return
 	}
+	defer file.Close()
 
-	// If microcode is still unknown, try alternative method for AMD
-	if microcode == "Unknown" && vendor == "amd" {
-		cmd := exec.Command("bash", "-c", "grep -m1 'microcode' /proc/cpuinfo | awk '{print $3}'")
-		output, err := cmd.Output()
-		if err == nil {
-			microcode = strings.TrimSpace(string(output))
+	// Every logical CPU repeats the same fields, the first block is enough
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "model name":
+			cpuType = value
+		case "vendor_id":
+			if strings.Contains(value, "AuthenticAMD") {
+				vendor = "amd"
+			} else if strings.Contains(value, "GenuineIntel") {
+				vendor = "intel"
+			}
+		case "microcode":
+			microcode = value
 		}
 	}
 	return
@@ -199,6 +262,8 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				switch m.questions[m.currentIndex].Type {
 				case "select":
 					return m.updateSelectQuestion(msg)
+				case "multiselect":
+					return m.updateMultiSelectQuestion(msg)
 				case "yesno":
 					return m.updateYesNoQuestion(msg)
 				default:
@@ -220,6 +285,8 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		switch m.questions[m.currentIndex].Type {
 		case "select":
 			return m.updateSelectQuestion(msg)
+		case "multiselect":
+			return m.updateMultiSelectQuestion(msg)
 		case "yesno":
 			return m.updateYesNoQuestion(msg)
 		default:
@@ -257,21 +324,22 @@ func (m *model) updateSelectQuestion(msg tea.Msg) (tea.Model, tea.Cmd) {
 			fullAnswer := m.listItems[m.selectedItem]
 			// Extract only the device name (e.g., /dev/sda) from the full answer
 			deviceName := strings.Fields(fullAnswer)[0]
+			if m.questions[m.currentIndex].Validate != nil {
+				if err := m.questions[m.currentIndex].Validate(deviceName, m.answers); err != nil {
+					m.errorMsg = err.Error()
+					return m, nil
+				}
+			}
+			m.errorMsg = ""
 			m.questions[m.currentIndex].Answer = deviceName
 			m.answers[m.questions[m.currentIndex].ID] = deviceName
 
 			// If the current question is INSTALL_DEVICE, update related fields
 			if m.questions[m.currentIndex].ID == "INSTALL_DEVICE" {
-				suffix := getPartitionSuffix(deviceName)
-				m.answers["DEVICE"] = deviceName
-				m.answers["PARTITION_BIOSBOOT"] = deviceName
-				m.answers["PARTITION_EFI"] = fmt.Sprintf("%s%s2", deviceName, suffix)
-				m.answers["PARTITION_ROOT"] = fmt.Sprintf("%s%s3", deviceName, suffix)
-				m.answers["PARTITION_HOME"] = fmt.Sprintf("%s%s4", deviceName, suffix)
-				m.answers["PARTITION_SWAP"] = fmt.Sprintf("%s%s5", deviceName, suffix)
+				setDeviceAnswers(m.answers, deviceName)
 
 				// Set mount options based on device type
-				if strings.Contains(deviceName, "nvme") || strings.Contains(deviceName, "ssd") {
+				if !isRotational(deviceName) {
 					m.answers["MOUNT_OPTIONS"] = "noatime,compress=zstd,ssd,commit=120"
 				} else {
 					m.answers["MOUNT_OPTIONS"] = "noatime,compress=zstd,nossd,commit=120"
@@ -291,6 +359,43 @@ func (m *model) updateSelectQuestion(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+func (m *model) updateMultiSelectQuestion(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "up":
+			if m.selectedItem > 0 {
+				m.selectedItem--
+			}
+		case "down":
+			if m.selectedItem < len(m.listItems)-1 {
+				m.selectedItem++
+			}
+		case " ":
+			m.checkedItems[m.selectedItem] = !m.checkedItems[m.selectedItem]
+		case "enter":
+			var selected []string
+			for i, item := range m.listItems {
+				if m.checkedItems[i] {
+					selected = append(selected, item)
+				}
+			}
+			answer := strings.Join(selected, " ")
+			if m.questions[m.currentIndex].Validate != nil {
+				if err := m.questions[m.currentIndex].Validate(answer, m.answers); err != nil {
+					m.errorMsg = err.Error()
+					return m, nil
+				}
+			}
+			m.errorMsg = ""
+			m.questions[m.currentIndex].Answer = answer
+			m.answers[m.questions[m.currentIndex].ID] = answer
+			return m, m.nextQuestion()
+		}
+	}
+	return m, nil
+}
+
 func (m *model) updateTextQuestion(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
@@ -331,10 +436,18 @@ func (m model) updateYesNoQuestion(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "y", "Y":
+			if m.questions[m.currentIndex].Validate != nil {
+				if err := m.questions[m.currentIndex].Validate("true", m.answers); err != nil {
+					m.errorMsg = err.Error()
+					return m, nil
+				}
+			}
+			m.errorMsg = ""
 			m.questions[m.currentIndex].Answer = "true"
 			m.answers[m.questions[m.currentIndex].ID] = "true"
 			return m, m.nextQuestion()
 		case "n", "N":
+			m.errorMsg = ""
 			m.questions[m.currentIndex].Answer = "false"
 			m.answers[m.questions[m.currentIndex].ID] = "false"
 			return m, m.nextQuestion()
@@ -415,8 +528,8 @@ func (m model) View() string {
 		BorderStyle(lipgloss.NormalBorder()).
 		BorderForeground(nord10)
 
-	// Create left column content (variables)
-	var leftContent string
+	// Create left column content (detected hardware and variables)
+	leftContent := fmt.Sprintf("🖥  CPU: %s (%d threads)\n\n", m.cpuModel, m.numCPUs)
 	for _, q := range m.questions {
 		value := m.answers[q.ID]
 		if q.Type == "password" {
@@ -440,6 +553,22 @@ func (m model) View() string {
 					rightContent += fmt.Sprintf("  %s\n", item)
 				}
 			}
+			if q.Preview != nil && m.selectedItem < len(m.listItems) {
+				rightContent += "\n" + lipgloss.NewStyle().Foreground(nord8).Render(q.Preview(m.listItems[m.selectedItem]))
+			}
+		case "multiselect":
+			for i, item := range m.listItems {
+				cursor := " "
+				if i == m.selectedItem {
+					cursor = ">"
+				}
+				check := " "
+				if m.checkedItems[i] {
+					check = "x"
+				}
+				rightContent += fmt.Sprintf("%s [%s] %s\n", cursor, check, item)
+			}
+			rightContent += "\nSpace to toggle, Enter to confirm"
 		case "yesno":
 			rightContent += "Press 'y' for Yes or 'n' for No"
 		default:
@@ -448,6 +577,9 @@ func (m model) View() string {
 	} else {
 		rightContent = "Configuration complete. Press Enter to save and exit."
 	}
+	if m.errorMsg != "" {
+		rightContent += "\n\n" + lipgloss.NewStyle().Foreground(nord11).Render(m.errorMsg)
+	}
 	rightColumn := rightColumnStyle.Render(rightContent)
 
 	// Create progress bar
@@ -528,6 +660,89 @@ func validateHostname(hostname string, _ map[string]string) error {
 	return nil
 }
 
+func validateKernels(kernels string, _ map[string]string) error {
+	if len(strings.Fields(kernels)) == 0 {
+		return fmt.Errorf("select at least one kernel")
+	}
+	return nil
+}
+
+func validateDefaultKernel(kernel string, answers map[string]string) error {
+	for _, k := range strings.Fields(answers["KERNELS"]) {
+		if k == kernel {
+			return nil
+		}
+	}
+	return fmt.Errorf("default kernel %s is not one of the selected kernels", kernel)
+}
+
+func validateGPUDriver(driver string, answers map[string]string) error {
+	if driver == "none" {
+		return nil
+	}
+	allowed := gpuDriverOptions[answers["GPU"]]
+	matches := false
+	for _, option := range allowed {
+		if option == driver {
+			matches = true
+		}
+	}
+	if !matches {
+		return fmt.Errorf("driver %s does not match GPU %s (use one of: %s)", driver, answers["GPU"], strings.Join(allowed, ", "))
+	}
+
+	if driver == "nvidia-open" || driver == "nvidia" {
+		for _, gpu := range getGPUs() {
+			switch {
+			case gpu.Vendor != "nvidia":
+			case gpu.Driver == "nouveau":
+				return fmt.Errorf("%s needs the legacy nvidia-470xx driver from the AUR, use nouveau", gpu)
+			case driver == "nvidia-open" && gpu.Driver == "nvidia":
+				return fmt.Errorf("%s is not supported by nvidia-open, use nvidia", gpu)
+			}
+		}
+	}
+	return nil
+}
+
+func validateSwapSize(size string, _ map[string]string) error {
+	if size != "" && !swapSize.MatchString(size) {
+		return fmt.Errorf("use a size like 8G or 512M")
+	}
+	return nil
+}
+
+func validateSubvolumes(subvolumes string, _ map[string]string) error {
+	_, err := parseSubvolumes(subvolumes)
+	return err
+}
+
+func validateSecureBootKeys(path string, _ map[string]string) error {
+	if path == "" {
+		return nil
+	}
+	for _, dir := range []string{"PK", "KEK", "db"} {
+		if info, err := os.Stat(filepath.Join(path, dir)); err != nil || !info.IsDir() {
+			return fmt.Errorf("%s does not contain a %s key directory", path, dir)
+		}
+	}
+	return nil
+}
+
+func validateSecureBoot(enabled string, answers map[string]string) error {
+	if enabled != "true" {
+		return nil
+	}
+	firmware := getFirmwareInfo()
+	if !firmware.UEFI {
+		return fmt.Errorf("secure boot requires UEFI firmware")
+	}
+	if !firmware.SetupMode && answers["SECURE_BOOT_KEYS"] == "" {
+		return fmt.Errorf("firmware is not in Setup Mode; reset the keys in the firmware setup or provide existing keys")
+	}
+	return nil
+}
+
 func saveToFile(answers map[string]string) error {
 	file, err := os.Create("arch_config.toml")
 	if err != nil {
@@ -589,6 +804,18 @@ func (m *model) prepareNextQuestion() {
 				break
 			}
 		}
+	case "multiselect":
+		m.listItems = question.Options
+		m.selectedItem = 0
+		m.checkedItems = make(map[int]bool)
+		// Check the previously answered items
+		for _, answer := range strings.Fields(question.Answer) {
+			for i, option := range question.Options {
+				if option == answer {
+					m.checkedItems[i] = true
+				}
+			}
+		}
 	case "yesno":
 		// No special preparation needed for yes/no questions
 	default:
@@ -614,20 +841,62 @@ func (m *model) clearPasswordFields() {
 	m.textInput.SetValue("")
 }
 
+// createPrivateFile truncates or creates filename readable by its owner
+// only, the saved configuration holds the user and root passwords.
+func createPrivateFile(filename string) (*os.File, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// OpenFile keeps the mode of an existing file
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
 func saveAnswersToFile(answers map[string]string, filename string) error {
+	if err := writeConfigTOML(answers, filename); err != nil {
+		return err
+	}
+	fmt.Printf("Configuration saved to %s\n", filename)
+	return nil
+}
+
+// loadResumeConfig reads the configuration of the live system, falling back
+// on the copy on the target after a reboot has lost the live one.
+func loadResumeConfig(filename string) (map[string]string, error) {
+	answers, err := loadTOMLConfig(filename)
+	if !os.IsNotExist(err) {
+		return answers, err
+	}
+	answers, err = loadTOMLConfig(targetConfigFile)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("neither %s nor %s exists, mount the target on /mnt first", filename, targetConfigFile)
+	}
+	return answers, err
+}
+
+// writeConfigTOML saves answers in the layout loadTOMLConfig reads
+func writeConfigTOML(answers map[string]string, filename string) error {
+	variables, sections := splitConfigSections(answers)
+
 	// Prepare the configuration structure
 	config := struct {
 		Install struct {
 			AutoRun bool `toml:"auto_run"`
 		} `toml:"install"`
 		Variables map[string]string `toml:"variables"`
+		configSections
 	}{
 		Install: struct {
 			AutoRun bool `toml:"auto_run"`
 		}{
 			AutoRun: answers["run_install"] == "true",
 		},
-		Variables: answers,
+		Variables:      variables,
+		configSections: sections,
 	}
 
 	// Ensure the directory exists
@@ -637,7 +906,7 @@ func saveAnswersToFile(answers map[string]string, filename string) error {
 	}
 
 	// Save the configuration file
-	file, err := os.Create(filename)
+	file, err := createPrivateFile(filename)
 	if err != nil {
 		return fmt.Errorf("error creating config file: %v", err)
 	}
@@ -648,8 +917,6 @@ func saveAnswersToFile(answers map[string]string, filename string) error {
 	if err := encoder.Encode(config); err != nil {
 		return fmt.Errorf("error encoding TOML: %v", err)
 	}
-
-	fmt.Printf("Configuration saved to %s\n", filename)
 	return nil
 }
 
@@ -659,6 +926,7 @@ func loadAnswersFromFile(filename string) (map[string]string, error) {
 			AutoRun bool `toml:"auto_run"`
 		} `toml:"install"`
 		Variables map[string]string `toml:"variables"`
+		configSections
 	}
 
 	_, err := toml.DecodeFile(filename, &config)
@@ -666,7 +934,7 @@ func loadAnswersFromFile(filename string) (map[string]string, error) {
 		return nil, err
 	}
 
-	return config.Variables, nil
+	return config.configSections.flatten(config.Variables), nil
 }
 
 func loadModelFromAnswers(answers map[string]string) model {
@@ -686,13 +954,24 @@ func loadModelFromAnswers(answers map[string]string) model {
 }
 
 func loadQuestions() []Question {
-	driveOptions := getDriveInfo()
+	driveOptions, err := getDriveInfo()
+	if err != nil {
+		fmt.Printf("Error getting drive info: %v\n", err)
+		os.Exit(1)
+	}
 	timezone := []string{"UTC", "America/New_York", "America/Toronto", "America/Vancouver", "America/Chicago", "America/Denver",
 		"America/Los_Angeles", "America/Texas", "Europe/London", "Europe/Berlin", "Asia/Tokyo"}
 	locale := []string{"en_US.UTF-8", "de_DE.UTF-8", "fr_FR.UTF-8"}
 	keymap := []string{"us", "uk", "de"}
 	filesystem := []string{"btrfs", "ext4"}
-	desktop_env := []string{"none", "gnome", "kde", "cosmic", "dwm"}
+	profiles, err := loadDesktopProfiles()
+	if err != nil {
+		fmt.Printf("Error loading desktop profiles: %v\n", err)
+		os.Exit(1)
+	}
+	desktop_env := desktopProfileNames(profiles)
+	kernels := []string{"linux", "linux-lts", "linux-zen", "linux-hardened"}
+	gpus := getGPUs()
 
 	// Your existing questions slice
 	questions := []Question{
@@ -704,6 +983,7 @@ func loadQuestions() []Question {
 		{ID: "PARTITION_ROOT", Text: "Confirm root partition:", Type: "text"},
 		{ID: "PARTITION_HOME", Text: "Confirm home partition:", Type: "text"},
 		{ID: "PARTITION_SWAP", Text: "Confirm swap partition:", Type: "text"},
+		{ID: "SWAP_SIZE", Text: "Swap partition size, e.g. 8G (leave empty for no swap):", Type: "text", Validate: validateSwapSize},
 		{ID: "MOUNT_OPTIONS", Text: "Enter mount options:", Type: "text", Answer: "noatime,compress=zstd,ssd,commit=120"},
 		{ID: "LOCALE", Text: "Select locale:", Type: "select", Options: locale},
 		{ID: "TIMEZONE", Text: "Select timezone:", Type: "select", Options: timezone},
@@ -712,25 +992,53 @@ func loadQuestions() []Question {
 		{ID: "PASSWORD", Text: "Enter password:", Type: "password", Validate: validatePassword},
 		{ID: "CONFIRM_PASSWORD", Text: "Confirm password:", Type: "password", Validate: validateConfirmPassword},
 		{ID: "HOSTNAME", Text: "Enter hostname:", Type: "text", Validate: validateHostname},
-		{ID: "MICROCODE", Text: "Select microcode:", Type: "select", Options: []string{"amd", "intel"}},
-		{ID: "GPU", Text: "Select GPU type:", Type: "select", Options: []string{"amd", "intel", "nvidia"}},
-		{ID: "GPU_DRIVER", Text: "Select GPU driver:", Type: "select", Options: []string{"nvidia", "amdgpu", "intel"}},
+		{ID: "KERNELS", Text: "Select kernels to install:", Type: "multiselect", Options: kernels, Answer: "linux", Validate: validateKernels},
+		{ID: "DEFAULT_KERNEL", Text: "Select default boot kernel:", Type: "select", Options: kernels, Answer: "linux", Validate: validateDefaultKernel},
+		{ID: "MICROCODE", Text: "Select microcode:", Type: "select", Options: []string{"amd", "intel", "none"}},
+		{ID: "GPU", Text: fmt.Sprintf("Select GPU type (detected: %s):", describeGPUs(gpus)), Type: "select", Options: []string{"amd", "intel", "nvidia", "intel-nvidia", "amd-nvidia"}},
+		{ID: "GPU_DRIVER", Text: "Select GPU driver:", Type: "select", Options: []string{"nvidia-open", "nvidia", "nouveau", "amdgpu", "intel", "none"}, Validate: validateGPUDriver},
 		{ID: "TERMINAL", Text: "Select terminal:", Type: "select", Options: []string{"alacritty", "kitty"}},
 		{ID: "SHELL", Text: "Select shell:", Type: "select", Options: []string{"bash", "zsh"}},
 		{ID: "EDITOR", Text: "Select editor:", Type: "select", Options: []string{"nvim", "vim", "nano"}},
-		{ID: "DESKTOP_ENVIRONMENT", Text: "Select desktop environment:", Type: "select", Options: desktop_env},
+		{ID: "DESKTOP_ENVIRONMENT", Text: "Select desktop environment:", Type: "select", Options: desktop_env, Preview: desktopPreview},
+		{ID: "DESKTOP_EXTRAS", Text: "Install the extras of the desktop profile?", Type: "yesno", Answer: "true"},
 		{ID: "FORMAT_TYPE", Text: "Select filesystem format:", Type: "select", Options: filesystem},
-		{ID: "SUBVOLUMES", Text: "Enter subvolumes (comma-separated):", Type: "text", Answer: "@,@home,@var,@.snapshots"},
+		{ID: "SUBVOLUMES", Text: "Enter subvolumes (comma-separated):", Type: "text", Answer: defaultSubvolumes, Validate: validateSubvolumes},
+		{ID: "FSTAB_ID", Text: "Identify filesystems in fstab by:", Type: "select", Options: []string{"uuid", "partuuid", "label"}},
 		{ID: "LUKS_PASSWORD", Text: "Enter LUKS password (leave empty if not using):", Type: "password"},
 		{ID: "LUKS", Text: "Use disk encryption?", Type: "yesno"},
-		// Add these new questions at the end
-		{
-			ID:   "run_install",
-			Text: "Do you want to run the install script?",
-			Type: "yesno",
-		},
+		{ID: "UKI", Text: "Build unified kernel images (UKI)?", Type: "yesno"},
+		{ID: "SECURE_BOOT_KEYS", Text: "Path to existing Secure Boot keys (leave empty to generate with sbctl):", Type: "text", Validate: validateSecureBootKeys},
+		{ID: "SECURE_BOOT", Text: "Enable Secure Boot (signs the bootloader and UKIs)?", Type: "yesno", Validate: validateSecureBoot},
+	}
+
+	// One toggle per optional script in stages.toml
+	if stages, err := embeddedStagesConfig(); err != nil {
+		fmt.Printf("Error loading stages: %v\n", err)
+	} else {
+		questions = append(questions, stages.optionalScriptQuestions()...)
+	}
+
+	// One toggle per package group, a broken group file stops here
+	for _, file := range []packageGroupFile{repoGroupFile, aurGroupFile} {
+		groups, err := file.load()
+		if err != nil {
+			fmt.Printf("Error loading package groups: %v\n", err)
+			os.Exit(1)
+		}
+		if file == aurGroupFile {
+			questions = append(questions, Question{ID: "AUR_HELPER", Text: "Select AUR helper:", Type: "select", Options: []string{"paru", "yay", "none"}, Answer: "paru", Validate: validateDesktopAUR})
+		}
+		questions = append(questions, file.questions(groups)...)
 	}
 
+	// Add these new questions at the end
+	questions = append(questions, Question{
+		ID:   "run_install",
+		Text: "Do you want to run the install script?",
+		Type: "yesno",
+	})
+
 	// Load default answers
 	defaultAnswers, _ := loadTOMLConfig("arch_config.toml")
 
@@ -741,6 +1049,26 @@ func loadQuestions() []Question {
 		}
 	}
 
+	// Detected hardware fills in what the saved config leaves open
+	_, cpuVendor, _, _ := getCPUInfo()
+	gpu, driver := recommendGPU(gpus)
+	if getVirtualization() != "none" {
+		// Guests get neither microcode nor physical GPU drivers
+		cpuVendor, driver = "none", "none"
+	}
+	for i, q := range questions {
+		switch {
+		case defaultAnswers[q.ID] != "":
+			continue
+		case q.ID == "MICROCODE" && cpuVendor != "Unknown":
+			questions[i].Answer = cpuVendor
+		case q.ID == "GPU" && gpu != "":
+			questions[i].Answer = gpu
+		case q.ID == "GPU_DRIVER" && driver != "":
+			questions[i].Answer = driver
+		}
+	}
+
 	return questions
 }
 
@@ -754,57 +1082,66 @@ func getInstallOptions() (bool, bool, bool) {
 	return true, dryRun, verbose
 }
 
-func runInstallScript(answers map[string]string, dryRun bool, verbose bool) {
+// prepareInstallDir extracts the embedded install files next to the binary
+// and saves the configuration they run with.
+func prepareInstallDir(answers map[string]string) (string, error) {
 	cwd, err := os.Getwd()
 	if err != nil {
-		fmt.Printf("Error getting current working directory: %v\n", err)
-		return
+		return "", fmt.Errorf("error getting current working directory: %v", err)
 	}
 
 	archDir := filepath.Join(cwd, "install")
-	scriptsDir := filepath.Join(archDir, "scripts")
 	configFile := filepath.Join(archDir, "arch_config.toml")
 
 	// **First**, extract embedded files
-	err = extractEmbeddedFiles(installFiles, "install", archDir)
-	if err != nil {
-		fmt.Printf("Error extracting files: %v\n", err)
-		return
+	if err := extractEmbeddedFiles(installFiles, "install", archDir); err != nil {
+		return "", fmt.Errorf("error extracting files: %v", err)
+	}
+
+	// Configs saved before package groups existed get the default groups
+	if !hasPackageAnswers(answers) {
+		if err := setPackageAnswers(answers); err != nil {
+			return "", err
+		}
 	}
 
 	// **Then**, save the updated configuration
 	if err := saveAnswersToFile(answers, configFile); err != nil {
-		fmt.Printf("Error saving config file: %v\n", err)
+		return "", fmt.Errorf("error saving config file: %v", err)
+	}
+	return archDir, nil
+}
+
+func runInstallScript(answers map[string]string, dryRun bool, verbose bool, resume bool, yes bool) {
+	archDir, err := prepareInstallDir(answers)
+	if err != nil {
+		fmt.Printf("Error preparing install: %v\n", err)
 		return
 	}
 
-	// Proceed with running the install script
-	installScriptPath := filepath.Join(archDir, "install.sh")
-	args := []string{installScriptPath}
+	// Resolve the stage scripts before anything is executed
+	runner := newStageRunner(archDir, answers, dryRun, verbose)
+	runner.resume = resume
+	runner.yes = yes
+	command := []string{os.Args[0], "-resume"}
 	if dryRun {
-		args = append(args, "--dry-run")
+		command = append(command, "-d")
 	}
 	if verbose {
-		args = append(args, "--verbose")
+		command = append(command, "-v")
+	}
+	if yes {
+		command = append(command, "-yes")
+	}
+	runner.command = commandLine(command)
+	steps, err := runner.loadSteps()
+	if err != nil {
+		fmt.Printf("Error loading install stages: %v\n", err)
+		return
 	}
 
-	cmd := exec.Command("/bin/bash", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("ARCH_DIR=%s", archDir),
-		fmt.Sprintf("SCRIPTS_DIR=%s", scriptsDir),
-		fmt.Sprintf("CONFIG_FILE=%s", configFile),
-	)
-
-	fmt.Println("Running install script with the following options:")
-	fmt.Printf("Dry Run: %v\n", dryRun)
-	fmt.Printf("Verbose: %v\n", verbose)
-	fmt.Println("Press Enter to continue or Ctrl+C to cancel...")
-	bufio.NewReader(os.Stdin).ReadBytes('\n')
-
-	if err := cmd.Run(); err != nil {
-		fmt.Printf("Error running install script: %v\n", err)
+	if err := runWithView(runner, steps); err != nil {
+		fmt.Printf("Error running install stages: %v\n", err)
 	}
 }
 
@@ -869,14 +1206,6 @@ func extractEmbeddedFiles(fsys embed.FS, root, destPath string) error {
 	})
 }
 
-func formatEnvVars(answers map[string]string) []string {
-	var env []string
-	for k, v := range answers {
-		env = append(env, fmt.Sprintf("%s=%s", k, v))
-	}
-	return env
-}
-
 func saveConfigAndRun(answers map[string]string, dryRun bool, verbose bool) {
 	// Set auto_run to true
 	config := map[string]interface{}{
@@ -890,7 +1219,7 @@ func saveConfigAndRun(answers map[string]string, dryRun bool, verbose bool) {
 	}
 
 	// Run the install script
-	runInstallScript(answers, dryRun, verbose)
+	runInstallScript(answers, dryRun, verbose, false, false)
 }
 
 func saveConfigWithoutInstall(answers map[string]string) {
@@ -946,7 +1275,7 @@ func saveConfig(config map[string]interface{}, message string, filePath string)
 		return fmt.Errorf("error creating directory: %v", err)
 	}
 
-	f, err := os.Create(filePath)
+	f, err := createPrivateFile(filePath)
 	if err != nil {
 		return fmt.Errorf("error creating config file: %v", err)
 	}
@@ -979,6 +1308,8 @@ func saveConfig(config map[string]interface{}, message string, filePath string)
 
 func printSummary(m model) {
 	fmt.Println("\nConfiguration Summary:")
+	fmt.Println("Hardware:")
+	fmt.Printf("  CPU: %s (%d threads)\n", m.cpuModel, m.numCPUs)
 	fmt.Println("User Settings:")
 	printSetting := func(name, key string) {
 		if value, ok := m.answers[key]; ok {
@@ -986,19 +1317,135 @@ func printSummary(m model) {
 		}
 	}
 
-	printSetting("Username", "username")
-	printSetting("Hostname", "hostname")
-	printSetting("Timezone", "timezone")
-	printSetting("Locale", "locale")
+	printSetting("Username", "USERNAME")
+	printSetting("Hostname", "HOSTNAME")
+	printSetting("Timezone", "TIMEZONE")
+	printSetting("Locale", "LOCALE")
+	printSetting("Microcode", "MICROCODE")
+
+	fmt.Println("Optional Scripts:")
+	for _, q := range m.questions {
+		if strings.HasPrefix(q.ID, "INSTALL_") && q.Type == "yesno" {
+			printSetting(q.ID, q.ID)
+		}
+	}
+
+	fmt.Println("Desktop:")
+	printSetting("Profile", "DESKTOP_ENVIRONMENT")
+	printSetting("Extras", "DESKTOP_EXTRAS")
+	printSetting("Display manager", "DISPLAY_MANAGER")
+	printSetting("Packages", "DESKTOP_PACKAGES")
+
+	fmt.Println("Package Groups:")
+	for _, q := range m.questions {
+		if strings.HasPrefix(q.ID, repoGroupFile.keyPrefix) {
+			printSetting(q.ID, q.ID)
+		}
+	}
+
+	fmt.Println("AUR:")
+	printSetting("AUR Helper", "AUR_HELPER")
+	if m.answers["AUR_HELPER"] != "none" {
+		for _, q := range m.questions {
+			if strings.HasPrefix(q.ID, aurGroupFile.keyPrefix) {
+				printSetting(q.ID, q.ID)
+			}
+		}
+	}
+
+	if m.answers["PACMAN_MIRROR"] != "" || m.answers["LOCAL_REPO"] != "" || m.answers["REUSE_ISO_CACHE"] == "true" {
+		fmt.Println("Repository:")
+		printSetting("Mirror", "PACMAN_MIRROR")
+		printSetting("Local", "LOCAL_REPO")
+		printSetting("ISO cache", "REUSE_ISO_CACHE")
+	}
 }
 
+// deriveAnswers fills in the variables that follow from the wizard answers
+// and the detected hardware rather than being asked directly.
+func deriveAnswers(answers map[string]string) {
+	firmware := getFirmwareInfo()
+	if firmware.UEFI {
+		answers["BIOS_TYPE"] = "uefi"
+	} else {
+		answers["BIOS_TYPE"] = "bios"
+	}
+	answers["SECURE_BOOT_SETUP_MODE"] = fmt.Sprintf("%t", firmware.SetupMode)
+
+	// Secure Boot signs the UKIs, so it always builds them
+	if answers["SECURE_BOOT"] == "true" {
+		answers["UKI"] = "true"
+	}
+
+	// Virtual machines get their guest tools instead of microcode and GPU drivers
+	virt := getVirtualization()
+	answers["VM_GUEST"] = virt
+	if profile, ok := vmGuestProfiles[virt]; ok {
+		answers["MICROCODE"] = "none"
+		answers["GPU_DRIVER"] = "none"
+		answers["GUEST_PACKAGES"] = strings.Join(profile.Packages, " ")
+		answers["GUEST_SERVICES"] = strings.Join(profile.Services, " ")
+	} else {
+		answers["GUEST_PACKAGES"] = ""
+		answers["GUEST_SERVICES"] = ""
+	}
+
+	answers["KERNEL_HEADERS"] = strings.Join(kernelHeaders(answers), " ")
+
+	if err := setPackageAnswers(answers); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+
+	// Scale pacman downloads and makepkg jobs with the CPU count
+	_, _, _, numCPUs := getCPUInfo()
+	answers["PARALLEL_DOWNLOADS"] = fmt.Sprintf("%d", min(max(numCPUs, 2), 10))
+	answers["MAKEFLAGS"] = fmt.Sprintf("-j%d", numCPUs)
+}
+
+// dkmsGPUDrivers are the GPU_DRIVER choices that build kernel modules
+// through DKMS and so need the headers of every installed kernel.
+var dkmsGPUDrivers = map[string]bool{
+	"nvidia":      true,
+	"nvidia-open": true,
+}
+
+func kernelHeaders(answers map[string]string) []string {
+	if !dkmsGPUDrivers[answers["GPU_DRIVER"]] {
+		return nil
+	}
+	var headers []string
+	for _, kernel := range strings.Fields(answers["KERNELS"]) {
+		headers = append(headers, kernel+"-headers")
+	}
+	return headers
+}
+
+// getPartitionSuffix returns the separator between a disk and its partition
+// numbers: disks whose name ends in a digit (nvme0n1, mmcblk0, loop0) use
+// "p", sdX and virtio vdX disks append the number directly.
 func getPartitionSuffix(device string) string {
-	if strings.Contains(device, "nvme") || strings.Contains(device, "ssd") {
+	if device == "" {
+		return ""
+	}
+	last := device[len(device)-1]
+	if last >= '0' && last <= '9' {
 		return "p"
 	}
 	return ""
 }
 
+// setDeviceAnswers points the device and partition answers at device
+func setDeviceAnswers(answers map[string]string, device string) {
+	suffix := getPartitionSuffix(device)
+	answers["INSTALL_DEVICE"] = device
+	answers["DEVICE"] = device
+	answers["PARTITION_BIOSBOOT"] = device
+	answers["PARTITION_EFI"] = fmt.Sprintf("%s%s2", device, suffix)
+	answers["PARTITION_ROOT"] = fmt.Sprintf("%s%s3", device, suffix)
+	answers["PARTITION_HOME"] = fmt.Sprintf("%s%s4", device, suffix)
+	answers["PARTITION_SWAP"] = fmt.Sprintf("%s%s5", device, suffix)
+}
+
 func (m *model) findQuestionIndex(id string) int {
 	for i, q := range m.questions {
 		if q.ID == id {
@@ -1011,12 +1458,13 @@ func (m *model) findQuestionIndex(id string) int {
 func loadTOMLConfig(filename string) (map[string]string, error) {
 	var config struct {
 		Variables map[string]string `toml:"variables"`
+		configSections
 	}
 	_, err := toml.DecodeFile(filename, &config)
 	if err != nil {
 		return nil, err
 	}
-	return config.Variables, nil
+	return config.configSections.flatten(config.Variables), nil
 }
 
 func verifyFiles(file1, file2 string) error {
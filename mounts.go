@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+type mountEntry struct {
+	Source  string
+	Target  string
+	FSType  string
+	Options string
+}
+
+// readMounts parses /proc/self/mounts. Octal escapes (\040 for spaces) are
+// left as they are since none of our mount points contain them.
+func readMounts() ([]mountEntry, error) {
+	file, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{Source: fields[0], Target: fields[1], FSType: fields[2], Options: fields[3]})
+	}
+	return mounts, scanner.Err()
+}
+
+// findMount returns the last (topmost) mount on target.
+func findMount(target string) (mountEntry, bool) {
+	mounts, err := readMounts()
+	if err != nil {
+		return mountEntry{}, false
+	}
+	var found mountEntry
+	ok := false
+	for _, m := range mounts {
+		if m.Target == target {
+			found, ok = m, true
+		}
+	}
+	return found, ok
+}
+
+func isMountpoint(target string) bool {
+	_, ok := findMount(target)
+	return ok
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// packageGroup is one table of a group file such as package_groups.toml.
+// Install is the default of the group's toggle in the wizard.
+type packageGroup struct {
+	Name     string
+	Install  bool     `toml:"install"`
+	Packages []string `toml:"packages"`
+}
+
+// Package names as pacman accepts them
+var packageNamePattern = regexp.MustCompile(`^[a-z0-9@_+][a-z0-9@._+-]*$`)
+
+// packageGroupFile is a group file of the install directory and the
+// config variables its groups are toggled with.
+type packageGroupFile struct {
+	path      string
+	keyPrefix string
+	label     string
+}
+
+var (
+	repoGroupFile = packageGroupFile{"install/package_groups.toml", "PACKAGE_GROUP_", "package group"}
+	aurGroupFile  = packageGroupFile{"install/aur_package_groups.toml", "AUR_GROUP_", "AUR package group"}
+)
+
+// load reads and validates the group file compiled into the binary
+func (f packageGroupFile) load() ([]packageGroup, error) {
+	data, err := installFiles.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading embedded %s: %v", filepath.Base(f.path), err)
+	}
+	return decodePackageGroups(data, filepath.Base(f.path))
+}
+
+// decodePackageGroups keeps the groups in file order and rejects unknown
+// keys, empty or malformed package names and packages listed twice.
+func decodePackageGroups(data []byte, filename string) ([]packageGroup, error) {
+	var tables map[string]packageGroup
+	meta, err := toml.Decode(string(data), &tables)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", filename, err)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("%s: unknown key %s", filename, undecoded[0])
+	}
+
+	var groups []packageGroup
+	var problems []string
+	owner := make(map[string]string)
+	for _, key := range meta.Keys() {
+		if len(key) != 1 {
+			continue
+		}
+		group := tables[key[0]]
+		group.Name = key[0]
+		if len(group.Packages) == 0 {
+			problems = append(problems, fmt.Sprintf("[%s] has no packages", group.Name))
+		}
+		for _, name := range group.Packages {
+			switch {
+			case !packageNamePattern.MatchString(name):
+				problems = append(problems, fmt.Sprintf("[%s] invalid package name %q", group.Name, name))
+			case owner[name] == group.Name:
+				problems = append(problems, fmt.Sprintf("[%s] lists %s twice", group.Name, name))
+			case owner[name] != "":
+				problems = append(problems, fmt.Sprintf("[%s] lists %s, already in [%s]", group.Name, name, owner[name]))
+			default:
+				owner[name] = group.Name
+			}
+		}
+		groups = append(groups, group)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s: %s", filename, strings.Join(problems, "; "))
+	}
+	return groups, nil
+}
+
+// key is the config variable that toggles a group, e.g.
+// PACKAGE_GROUP_SYSTEM_TOOLS.
+func (f packageGroupFile) key(group string) string {
+	return f.keyPrefix + strings.ToUpper(strings.ReplaceAll(group, "-", "_"))
+}
+
+// questions asks for each group whether to install it
+func (f packageGroupFile) questions(groups []packageGroup) []Question {
+	var questions []Question
+	for _, group := range groups {
+		packages := strings.Join(group.Packages, " ")
+		if len(packages) > 50 {
+			packages = packages[:47] + "..."
+		}
+		questions = append(questions, Question{
+			ID:     f.key(group.Name),
+			Text:   fmt.Sprintf("Install %s %s (%s)?", f.label, group.Name, packages),
+			Type:   "yesno",
+			Answer: fmt.Sprintf("%t", group.Install),
+		})
+	}
+	return questions
+}
+
+// selected returns the groups toggled on in answers, groups without an
+// answer follow their install default.
+func (f packageGroupFile) selected(groups []packageGroup, answers map[string]string) []packageGroup {
+	var selected []packageGroup
+	for _, group := range groups {
+		value, ok := answers[f.key(group.Name)]
+		if (ok && value == "true") || (!ok && group.Install) {
+			selected = append(selected, group)
+		}
+	}
+	return selected
+}
+
+// resolve returns the names and packages of the selected groups
+func (f packageGroupFile) resolve(answers map[string]string) (names, packages []string, err error) {
+	groups, err := f.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, group := range f.selected(groups, answers) {
+		names = append(names, group.Name)
+		packages = append(packages, group.Packages...)
+	}
+	return names, packages, nil
+}
+
+// hasPackageAnswers tells whether setPackageAnswers has run for answers
+func hasPackageAnswers(answers map[string]string) bool {
+	_, repo := answers["SYSTEM_PACKAGES"]
+	_, aur := answers["AUR_PACKAGES"]
+	_, desktop := answers["DESKTOP_PACKAGES"]
+	_, session := answers["DESKTOP_SESSION"]
+	_, user := answers["USER_PACKAGES"]
+	return repo && aur && desktop && session && user
+}
+
+// setPackageAnswers writes the selected groups and their packages as
+// PACKAGE_GROUPS and SYSTEM_PACKAGES, which system-pkgs.sh installs, and
+// AUR_PACKAGE_GROUPS and AUR_PACKAGES for aur-pkgs.sh. Without an AUR
+// helper no AUR packages are installed. The desktop profile and the
+// [packages] section are resolved along with them.
+func setPackageAnswers(answers map[string]string) error {
+	names, packages, err := repoGroupFile.resolve(answers)
+	if err != nil {
+		return err
+	}
+	answers["PACKAGE_GROUPS"] = strings.Join(names, " ")
+	answers["SYSTEM_PACKAGES"] = strings.Join(packages, " ")
+
+	names, packages, err = aurGroupFile.resolve(answers)
+	if err != nil {
+		return err
+	}
+	if answers["AUR_HELPER"] == "" || answers["AUR_HELPER"] == "none" {
+		names, packages = nil, nil
+	}
+	answers["AUR_PACKAGE_GROUPS"] = strings.Join(names, " ")
+	answers["AUR_PACKAGES"] = strings.Join(packages, " ")
+	if err := setDesktopAnswers(answers); err != nil {
+		return err
+	}
+	return setUserPackageAnswers(answers)
+}
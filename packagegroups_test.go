@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodePackageGroups(t *testing.T) {
+	data := `
+[system-tools]
+install = true
+packages = ["htop", "rsync"]
+
+[dev-tools]
+packages = ["git", "go", "python-pip"]
+
+[fonts]
+install = true
+packages = ["ttf-dejavu", "noto-fonts-cjk"]
+`
+	groups, err := decodePackageGroups([]byte(data), "package_groups.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []packageGroup{
+		{Name: "system-tools", Install: true, Packages: []string{"htop", "rsync"}},
+		{Name: "dev-tools", Packages: []string{"git", "go", "python-pip"}},
+		{Name: "fonts", Install: true, Packages: []string{"ttf-dejavu", "noto-fonts-cjk"}},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("decodePackageGroups = %+v, want %+v", groups, want)
+	}
+}
+
+func TestDecodePackageGroupsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"syntax", "[tools\npackages = []", "error decoding"},
+		{"unknown key", "[tools]\npackage = [\"htop\"]", "unknown key tools.package"},
+		{"no packages", "[tools]\ninstall = true", "[tools] has no packages"},
+		{"invalid name", "[tools]\npackages = [\"Htop\", \"\"]", `[tools] invalid package name "Htop"`},
+		{"listed twice", "[tools]\npackages = [\"htop\", \"htop\"]", "[tools] lists htop twice"},
+		{"in two groups", "[tools]\npackages = [\"htop\"]\n[more]\npackages = [\"htop\"]", "[more] lists htop, already in [tools]"},
+	}
+	for _, tt := range tests {
+		_, err := decodePackageGroups([]byte(tt.data), "package_groups.toml")
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error with %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSelectedPackageGroups(t *testing.T) {
+	groups := []packageGroup{
+		{Name: "system-tools", Install: true, Packages: []string{"htop"}},
+		{Name: "dev-tools", Packages: []string{"git"}},
+		{Name: "fonts", Install: true, Packages: []string{"ttf-dejavu"}},
+	}
+	names := func(selected []packageGroup) []string {
+		var names []string
+		for _, group := range selected {
+			names = append(names, group.Name)
+		}
+		return names
+	}
+
+	// Groups without an answer follow their install default
+	if got := names(repoGroupFile.selected(groups, nil)); !reflect.DeepEqual(got, []string{"system-tools", "fonts"}) {
+		t.Errorf("defaults selected %v", got)
+	}
+	answers := map[string]string{"PACKAGE_GROUP_DEV_TOOLS": "true", "PACKAGE_GROUP_FONTS": "false"}
+	if got := names(repoGroupFile.selected(groups, answers)); !reflect.DeepEqual(got, []string{"system-tools", "dev-tools"}) {
+		t.Errorf("answers selected %v", got)
+	}
+	if got := aurGroupFile.key("dev-tools"); got != "AUR_GROUP_DEV_TOOLS" {
+		t.Errorf("aur key = %s", got)
+	}
+}
+
+func TestEmbeddedPackageGroups(t *testing.T) {
+	for _, f := range []packageGroupFile{repoGroupFile, aurGroupFile} {
+		if groups, err := f.load(); err != nil || len(groups) == 0 {
+			t.Errorf("%s: %d groups, %v", f.path, len(groups), err)
+		}
+	}
+}
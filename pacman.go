@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pacman output when it is not writing to a terminal, which is the case for
+// pacstrap and the package installs in the stage scripts:
+//
+//	Packages (123) base-3-2  linux-6.11.arch1-1 ...
+//	Total Download Size:   512.34 MiB
+//	:: Retrieving packages...
+//	 linux-6.11.arch1-1-x86_64 downloading...
+//	(  5/123) installing linux
+var (
+	ansiPattern          = regexp.MustCompile(`\x1b\[[0-9;?]*[a-zA-Z]`)
+	pacmanPackagesLine   = regexp.MustCompile(`^Packages \((\d+)\)`)
+	pacmanDownloadSize   = regexp.MustCompile(`^Total Download Size:\s+([\d.]+)\s+(B|KiB|MiB|GiB)`)
+	pacmanDownloadingPkg = regexp.MustCompile(`(^\s*downloading \S+|\S+ downloading)\.\.\.$`)
+	pacmanInstallingPkg  = regexp.MustCompile(`^\(\s*(\d+)/(\d+)\) (installing|upgrading|reinstalling|downgrading) `)
+)
+
+// Share of a transaction spent downloading when there is something to download
+const pacmanDownloadWeight = 0.5
+
+// pacmanProgress follows one pacman transaction at a time, every
+// "Packages (N)" line starts a new one.
+type pacmanProgress struct {
+	active      bool
+	total       int
+	downloadMiB float64
+	downloaded  int
+	installed   int
+	started     time.Time
+}
+
+// parseLine updates the progress from a line of output and reports whether
+// the line belonged to pacman.
+func (p *pacmanProgress) parseLine(line string, now time.Time) bool {
+	line = strings.TrimRight(ansiPattern.ReplaceAllString(line, ""), " ")
+
+	if match := pacmanPackagesLine.FindStringSubmatch(line); match != nil {
+		total, _ := strconv.Atoi(match[1])
+		*p = pacmanProgress{active: true, total: total, started: now}
+		return true
+	}
+	if !p.active {
+		return false
+	}
+
+	switch {
+	case pacmanDownloadSize.MatchString(line):
+		match := pacmanDownloadSize.FindStringSubmatch(line)
+		size, _ := strconv.ParseFloat(match[1], 64)
+		p.downloadMiB = toMiB(size, match[2])
+	case pacmanDownloadingPkg.MatchString(line):
+		if p.downloaded < p.total {
+			p.downloaded++
+		}
+	case pacmanInstallingPkg.MatchString(line):
+		match := pacmanInstallingPkg.FindStringSubmatch(line)
+		p.installed, _ = strconv.Atoi(match[1])
+		p.total, _ = strconv.Atoi(match[2])
+	case strings.HasPrefix(line, ":: Running post-transaction hooks"):
+		p.installed = p.total
+	default:
+		return false
+	}
+	return true
+}
+
+func toMiB(size float64, unit string) float64 {
+	switch unit {
+	case "B":
+		return size / (1024 * 1024)
+	case "KiB":
+		return size / 1024
+	case "GiB":
+		return size * 1024
+	}
+	return size
+}
+
+// fraction of the transaction that is done, downloads count for half of it
+// unless everything was already in the cache.
+func (p *pacmanProgress) fraction() float64 {
+	if p.total == 0 {
+		return 0
+	}
+	installed := float64(p.installed) / float64(p.total)
+	if p.downloadMiB == 0 {
+		return installed
+	}
+	downloaded := float64(p.downloaded) / float64(p.total)
+	if p.installed > 0 {
+		// Installing only starts once every download is done
+		downloaded = 1
+	}
+	return pacmanDownloadWeight*downloaded + (1-pacmanDownloadWeight)*installed
+}
+
+// eta extrapolates the time spent so far, it is unknown at the start
+func (p *pacmanProgress) eta(now time.Time) (time.Duration, bool) {
+	done := p.fraction()
+	if done < 0.05 || done >= 1 {
+		return 0, false
+	}
+	elapsed := now.Sub(p.started)
+	return time.Duration(float64(elapsed) * (1 - done) / done).Round(time.Second), true
+}
+
+func (p *pacmanProgress) String() string {
+	var parts []string
+	if p.installed > 0 || p.downloadMiB == 0 {
+		parts = append(parts, fmt.Sprintf("installed %d/%d", p.installed, p.total))
+	} else {
+		parts = append(parts, fmt.Sprintf("downloaded %d/%d", p.downloaded, p.total))
+	}
+	if p.downloadMiB > 0 {
+		parts = append(parts, fmt.Sprintf("%.1f MiB", p.downloadMiB))
+	}
+	if eta, ok := p.eta(time.Now()); ok {
+		parts = append(parts, "ETA "+eta.String())
+	}
+	return strings.Join(parts, " · ")
+}
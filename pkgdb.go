@@ -0,0 +1,405 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// packageCheckStepName is the built-in step of 1-pre that resolves every
+// package the install will ask pacman for, after pre-setup.sh has synced
+// the databases and before the drive stage touches the disk.
+const packageCheckStepName = "check-packages"
+
+const (
+	syncDBDir  = "/var/lib/pacman/sync"
+	aurListURL = "https://aur.archlinux.org/packages.gz"
+)
+
+// Kinds of package names
+const (
+	packageKindRepo     = "repo"
+	packageKindGroup    = "group"
+	packageKindProvides = "provides"
+	packageKindAUR      = "aur"
+	packageKindMissing  = "missing"
+)
+
+// syncDB is what the pacman sync databases know about package names
+type syncDB struct {
+	packages map[string]string   // name to repository
+	groups   map[string][]string // group to its packages
+	provides map[string][]string // virtual name to the packages providing it
+}
+
+func newSyncDB() *syncDB {
+	return &syncDB{
+		packages: make(map[string]string),
+		groups:   make(map[string][]string),
+		provides: make(map[string][]string),
+	}
+}
+
+// loadSyncDBs parses the repository databases in dir. They are tar files,
+// usually gzip compressed; anything else falls back on pacman itself.
+func loadSyncDBs(dir string) (*syncDB, error) {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.db"))
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no sync databases in %s, run pacman -Sy first", dir)
+	}
+	db := newSyncDB()
+	for _, file := range files {
+		if err := db.readRepo(file); err != nil {
+			return pacmanSyncDB()
+		}
+	}
+	return db, nil
+}
+
+func (db *syncDB) readRepo(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	repo := strings.TrimSuffix(filepath.Base(filename), ".db")
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", filename, err)
+		}
+		if filepath.Base(header.Name) == "desc" {
+			db.addDesc(repo, archive)
+		}
+	}
+}
+
+// addDesc reads the %NAME%, %GROUPS% and %PROVIDES% sections of a
+// package's desc file.
+func (db *syncDB) addDesc(repo string, r io.Reader) {
+	var name, section string
+	var groups, provides []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			section = ""
+		case strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%"):
+			section = line
+		case section == "%NAME%":
+			name = line
+		case section == "%GROUPS%":
+			groups = append(groups, line)
+		case section == "%PROVIDES%":
+			provides = append(provides, strings.FieldsFunc(line, func(r rune) bool { return r == '=' || r == '<' || r == '>' })[0])
+		}
+	}
+	if name == "" {
+		return
+	}
+	if _, seen := db.packages[name]; !seen {
+		db.packages[name] = repo
+	}
+	for _, group := range groups {
+		db.groups[group] = append(db.groups[group], name)
+	}
+	for _, virtual := range provides {
+		db.provides[virtual] = append(db.provides[virtual], name)
+	}
+}
+
+// pacmanSyncDB asks pacman for the package and group names, it does not
+// list provides.
+func pacmanSyncDB() (*syncDB, error) {
+	db := newSyncDB()
+	output, err := exec.Command("pacman", "-Sl").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error listing sync packages: %v", err)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			if _, seen := db.packages[fields[1]]; !seen {
+				db.packages[fields[1]] = fields[0]
+			}
+		}
+	}
+	output, err = exec.Command("pacman", "-Sg").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error listing sync groups: %v", err)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			db.groups[fields[0]] = append(db.groups[fields[0]], fields[1])
+		}
+	}
+	return db, nil
+}
+
+// fetchAURNames downloads the list of every AUR package name
+func fetchAURNames() (map[string]bool, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(aurListURL)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching the AUR package list: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching the AUR package list: %s", resp.Status)
+	}
+
+	// The list is served gzip compressed, unless the transport already
+	// decompressed it.
+	body := bufio.NewReader(resp.Body)
+	var r io.Reader = body
+	if magic, _ := body.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the AUR package list: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" && !strings.HasPrefix(name, "#") {
+			names[name] = true
+		}
+	}
+	return names, scanner.Err()
+}
+
+type packageCheck struct {
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+	Helper bool   `json:"helper,omitempty"` // installed by the AUR helper
+}
+
+// ok tells whether the name can be installed: pacman needs it in the
+// repositories, the AUR helper also takes AUR packages.
+func (c packageCheck) ok() bool {
+	switch c.Kind {
+	case packageKindRepo, packageKindGroup, packageKindProvides:
+		return true
+	case packageKindAUR:
+		return c.Helper
+	}
+	return false
+}
+
+// resolvePackage looks a name up as a package, a group, a provide and
+// finally in the AUR. aur may be nil when the AUR list is unavailable.
+func (db *syncDB) resolvePackage(name string, aur map[string]bool) packageCheck {
+	check := packageCheck{Name: name}
+	switch {
+	case db.packages[name] != "":
+		check.Kind, check.Detail = packageKindRepo, db.packages[name]
+	case len(db.groups[name]) > 0:
+		check.Kind, check.Detail = packageKindGroup, fmt.Sprintf("%d packages", len(db.groups[name]))
+	case len(db.provides[name]) > 0:
+		check.Kind, check.Detail = packageKindProvides, "provided by "+strings.Join(db.provides[name], ", ")
+	case aur[name]:
+		check.Kind, check.Detail = packageKindAUR, "only in the AUR, pacman cannot install it"
+	case aur == nil:
+		check.Kind, check.Detail = packageKindMissing, "not in the sync databases (AUR not checked)"
+	default:
+		check.Kind, check.Detail = packageKindMissing, "not in the sync databases or the AUR"
+	}
+	return check
+}
+
+// plannedPackages lists every package name the install plan passes to
+// pacman, pacstrap or the AUR helper, each once, with the scripts that
+// install it. helper holds the names only the AUR helper installs.
+func plannedPackages(answers map[string]string) (names []string, scripts map[string][]string, helper map[string]bool, err error) {
+	plan, err := buildInstallPlan(answers)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	scripts = make(map[string][]string)
+	helper = make(map[string]bool)
+	pacman := make(map[string]bool)
+	for _, step := range plan.Steps {
+		for _, op := range step.Operations {
+			if op.Kind != "packages" && op.Kind != "aur" {
+				continue
+			}
+			for _, name := range op.Items {
+				if scripts[name] == nil {
+					names = append(names, name)
+				}
+				if !containsString(scripts[name], step.Script) {
+					scripts[name] = append(scripts[name], step.Script)
+				}
+				if op.Kind == "aur" {
+					helper[name] = true
+				} else {
+					pacman[name] = true
+				}
+			}
+		}
+	}
+	for name := range pacman {
+		delete(helper, name)
+	}
+	return names, scripts, helper, nil
+}
+
+// checkPackages resolves the planned packages against the sync databases,
+// the AUR list is only fetched when some name is not in the repositories.
+func checkPackages(answers map[string]string, dbDir string) ([]packageCheck, error) {
+	names, scripts, helper, err := plannedPackages(answers)
+	if err != nil {
+		return nil, err
+	}
+	db, err := loadSyncDBs(dbDir)
+	if err != nil {
+		return nil, err
+	}
+
+	checks := make([]packageCheck, len(names))
+	missing := false
+	for i, name := range names {
+		checks[i] = db.resolvePackage(name, map[string]bool{})
+		checks[i].Helper = helper[name]
+		missing = missing || checks[i].Kind == packageKindMissing
+	}
+	if missing {
+		aur, err := fetchAURNames()
+		if err != nil {
+			aur = nil
+		}
+		for i, name := range names {
+			if checks[i].Kind == packageKindMissing {
+				checks[i] = db.resolvePackage(name, aur)
+				checks[i].Helper = helper[name]
+			}
+		}
+	}
+	for i := range checks {
+		if checks[i].Kind == packageKindAUR && checks[i].Helper {
+			checks[i].Detail = "AUR package, installed by " + answers["AUR_HELPER"]
+		}
+	}
+	for i, name := range names {
+		if !checks[i].ok() {
+			checks[i].Detail += " (" + strings.Join(scripts[name], ", ") + ")"
+		}
+	}
+	return checks, nil
+}
+
+// summarizePackages counts the checks by kind, e.g. "90 repo, 2 group"
+func summarizePackages(checks []packageCheck) string {
+	counts := make(map[string]int)
+	for _, check := range checks {
+		counts[check.Kind]++
+	}
+	var parts []string
+	for _, kind := range []string{packageKindRepo, packageKindGroup, packageKindProvides, packageKindAUR, packageKindMissing} {
+		if counts[kind] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[kind], kind))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// packageCheckStep is the check-packages step, unknown names and AUR
+// packages planned for pacman fail the install before anything is
+// partitioned.
+func (r *stageRunner) packageCheckStep(index int, step installStep) error {
+	checks, err := checkPackages(r.answers, syncDBDir)
+	if err != nil {
+		if r.dryRun {
+			fmt.Fprintf(r.stdout, "[DRY RUN] Skipping the package check: %v\n", err)
+			return nil
+		}
+		return err
+	}
+
+	failed := 0
+	for _, check := range checks {
+		if check.Kind == packageKindRepo {
+			continue
+		}
+		fmt.Fprintf(r.stdout, "  [%s] %s: %s\n", check.Kind, check.Name, check.Detail)
+		if !check.ok() {
+			failed++
+			r.recordEvent(index, step, installEvent{Type: eventError, Message: fmt.Sprintf("package %s: %s", check.Name, check.Detail)})
+		}
+	}
+	fmt.Fprintf(r.stdout, "==> %d packages: %s\n", len(checks), summarizePackages(checks))
+	if failed > 0 {
+		return fmt.Errorf("%d packages cannot be installed", failed)
+	}
+	return nil
+}
+
+// runPackages implements "arch-matic packages", checking the packages of a
+// config without installing anything.
+func runPackages(args []string) {
+	flags := flag.NewFlagSet("packages", flag.ExitOnError)
+	configFile := flags.String("config", filepath.Join("install", "arch_config.toml"), "Configuration to check")
+	dbDir := flags.String("dbpath", syncDBDir, "Directory of the pacman sync databases")
+	format := flags.String("format", "text", "Output format: text or json")
+	flags.Parse(args)
+	if *format != "text" && *format != "json" {
+		fmt.Printf("Error: unknown format %q, use text or json\n", *format)
+		os.Exit(1)
+	}
+
+	answers, err := loadTOMLConfig(*configFile)
+	if err != nil {
+		fmt.Printf("Error loading %s: %v\n", *configFile, err)
+		os.Exit(1)
+	}
+	checks, err := checkPackages(answers, *dbDir)
+	if err != nil {
+		fmt.Printf("Error checking packages: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(checks)
+	} else {
+		sort.SliceStable(checks, func(i, j int) bool { return checks[i].ok() && !checks[j].ok() })
+		for _, check := range checks {
+			fmt.Printf("  %-8s %-32s %s\n", check.Kind, check.Name, check.Detail)
+		}
+		fmt.Printf("%d packages: %s\n", len(checks), summarizePackages(checks))
+	}
+	for _, check := range checks {
+		if !check.ok() {
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSyncDB writes a gzipped repository database with the desc files
+func writeSyncDB(t *testing.T, filename string, descs map[string]string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	archive := tar.NewWriter(gz)
+	for dir, desc := range descs {
+		header := &tar.Header{Name: dir + "/desc", Mode: 0644, Size: int64(len(desc))}
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write([]byte(desc)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolvePackage(t *testing.T) {
+	dir := t.TempDir()
+	writeSyncDB(t, filepath.Join(dir, "core.db"), map[string]string{
+		"base-3-2":        "%NAME%\nbase\n\n%VERSION%\n3-2\n",
+		"openssh-9.8p1-1": "%NAME%\nopenssh\n\n%PROVIDES%\nsshd=9.8\n",
+	})
+	writeSyncDB(t, filepath.Join(dir, "extra.db"), map[string]string{
+		"gnome-shell-47.0-1": "%NAME%\ngnome-shell\n\n%GROUPS%\ngnome\n",
+		"mutter-47.0-1":      "%NAME%\nmutter\n\n%GROUPS%\ngnome\n",
+	})
+	db, err := loadSyncDBs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aur := map[string]bool{"paru-bin": true}
+	tests := []struct {
+		name   string
+		aur    map[string]bool
+		helper bool
+		kind   string
+		detail string
+		ok     bool
+	}{
+		{"base", aur, false, packageKindRepo, "core", true},
+		{"gnome", aur, false, packageKindGroup, "2 packages", true},
+		{"sshd", aur, false, packageKindProvides, "provided by openssh", true},
+		{"paru-bin", aur, false, packageKindAUR, "only in the AUR, pacman cannot install it", false},
+		{"paru-bin", aur, true, packageKindAUR, "only in the AUR, pacman cannot install it", true},
+		{"nosuch", aur, false, packageKindMissing, "not in the sync databases or the AUR", false},
+		{"nosuch", nil, false, packageKindMissing, "not in the sync databases (AUR not checked)", false},
+	}
+	for _, tt := range tests {
+		check := db.resolvePackage(tt.name, tt.aur)
+		check.Helper = tt.helper
+		if check.Kind != tt.kind || check.Detail != tt.detail || check.ok() != tt.ok {
+			t.Errorf("resolvePackage(%s) = %s %q ok %v, want %s %q ok %v", tt.name, check.Kind, check.Detail, check.ok(), tt.kind, tt.detail, tt.ok)
+		}
+	}
+
+	if _, err := loadSyncDBs(t.TempDir()); err == nil {
+		t.Errorf("empty directory: expected an error")
+	}
+}
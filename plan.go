@@ -0,0 +1,665 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+// planOperation is one thing a script does. Kind is one of command,
+// partition, format, mount, packages, aur, file, service, user or check; Chroot
+// marks operations that run inside the installed system.
+type planOperation struct {
+	Kind    string   `json:"kind"`
+	Summary string   `json:"summary"`
+	Command string   `json:"command,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	Items   []string `json:"items,omitempty"`
+	Chroot  bool     `json:"chroot,omitempty"`
+}
+
+type planStep struct {
+	Stage      string          `json:"stage"`
+	Script     string          `json:"script"`
+	Operations []planOperation `json:"operations"`
+}
+
+type installPlan struct {
+	Device   string     `json:"device"`
+	Firmware string     `json:"firmware"`
+	Disk     *diskPlan  `json:"disk"`
+	Steps    []planStep `json:"steps"`
+}
+
+// scriptPlanners mirror what each stage script does for a given config.
+// Scripts without a planner show up as a single command.
+var scriptPlanners = map[string]func(p *planner) []planOperation{
+	"pre-setup.sh":         (*planner).preSetup,
+	"run-checks.sh":        (*planner).runChecks,
+	"partition-btrfs.sh":   (*planner).partition,
+	"format-btrfs.sh":      (*planner).format,
+	"partition-ext4.sh":    (*planner).partition,
+	"format-ext4.sh":       (*planner).format,
+	"bootstrap-pkgs.sh":    (*planner).bootstrap,
+	packageCheckStepName:   (*planner).packageCheck,
+	fstabStepName:          (*planner).fstab,
+	"generate-fstab.sh":    (*planner).grub,
+	"secure-boot.sh":       (*planner).secureBoot,
+	"system-config.sh":     (*planner).systemConfig,
+	"system-pkgs.sh":       (*planner).systemPackages,
+	"terminal.sh":          (*planner).scriptPackages,
+	"aur-pkgs.sh":          (*planner).aurPackages,
+	"desktop.sh":           (*planner).desktop,
+	dotfilesStepName:       (*planner).dotfiles,
+	packageSourcesStepName: (*planner).packageSources,
+	"last-cleanup.sh":      (*planner).lastCleanup,
+	verifyStepName:         (*planner).verify,
+}
+
+type planner struct {
+	answers map[string]string
+	disk    *diskPlan
+	step    installStep
+}
+
+// buildInstallPlan works from the config and the embedded scripts only, it
+// runs no detection so the plan can be made on any machine.
+func buildInstallPlan(answers map[string]string) (*installPlan, error) {
+	stages, err := embeddedStagesConfig()
+	if err != nil {
+		return nil, err
+	}
+	// The same default groups prepareInstallDir gives an older config
+	if !hasPackageAnswers(answers) {
+		answers = copyAnswers(answers)
+		if err := setPackageAnswers(answers); err != nil {
+			return nil, err
+		}
+	}
+	disk, err := buildDiskPlan(answers)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := stages.selectSteps(answers, "install/scripts")
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &installPlan{Device: disk.Device, Firmware: answers["BIOS_TYPE"], Disk: disk}
+	if plan.Firmware == "" {
+		plan.Firmware = "uefi"
+	}
+	for _, step := range steps {
+		if _, err := installFiles.ReadFile(step.Path); err != nil && !step.Builtin {
+			if step.Optional {
+				continue
+			}
+			return nil, fmt.Errorf("missing required script %s", step)
+		}
+
+		p := &planner{answers: answers, disk: disk, step: step}
+		planStep := planStep{Stage: step.Stage, Script: step.Script}
+		switch {
+		case scriptPlanners[step.Script] != nil:
+			planStep.Operations = scriptPlanners[step.Script](p)
+		default:
+			planStep.Operations = []planOperation{{Kind: "command", Summary: "run " + step.Script, Command: "bash " + step.Path}}
+		}
+		plan.Steps = append(plan.Steps, planStep)
+	}
+	return plan, nil
+}
+
+func command(chroot bool, cmd string) planOperation {
+	return planOperation{Kind: "command", Summary: cmd, Command: cmd, Chroot: chroot}
+}
+
+func packages(summary string, names ...string) planOperation {
+	var items []string
+	for _, name := range names {
+		items = append(items, strings.Fields(name)...)
+	}
+	return planOperation{
+		Kind:    "packages",
+		Summary: summary,
+		Command: "pacman -S --noconfirm --needed " + strings.Join(items, " "),
+		Items:   items,
+		Chroot:  true,
+	}
+}
+
+func file(path, summary string) planOperation {
+	return planOperation{Kind: "file", Summary: summary, Path: path, Chroot: true}
+}
+
+func service(name string) planOperation {
+	return planOperation{Kind: "service", Summary: "enable " + name, Command: "systemctl enable " + name, Items: []string{name}, Chroot: true}
+}
+
+func (p *planner) value(key, fallback string) string {
+	if p.answers[key] != "" {
+		return p.answers[key]
+	}
+	return fallback
+}
+
+func (p *planner) preSetup() []planOperation {
+	// An image install leaves the machine it runs on alone
+	if p.answers["TARGET_IMAGE"] != "" {
+		return []planOperation{{Kind: "check", Summary: "disk image install, the live system is not set up"}}
+	}
+	var ops []planOperation
+	if servers := p.mirrorServers(); len(servers) > 0 {
+		ops = append(ops, planOperation{Kind: "file", Summary: "[repository] servers first, then the backup", Path: "/etc/pacman.d/mirrorlist", Items: servers})
+	}
+	// The live system installs these too, so the package check and
+	// cache build see them
+	keyring := packages("refresh the keyring", "archlinux-keyring")
+	keyring.Command = "pacman -Sy archlinux-keyring --noconfirm"
+	keyring.Chroot = false
+	tools := packages("live system tools", "pacman-contrib terminus-font rsync reflector gptfdisk btrfs-progs glibc")
+	tools.Chroot = false
+	return append(ops,
+		command(false, "timedatectl set-ntp true"),
+		keyring,
+		tools,
+		planOperation{Kind: "file", Summary: fmt.Sprintf("ParallelDownloads = %s, Color", p.value("PARALLEL_DOWNLOADS", "5")), Path: "/etc/pacman.conf"},
+		command(false, "pacman -Syy"),
+		planOperation{Kind: "file", Summary: "backup of the mirrorlist", Path: "/etc/pacman.d/mirrorlist.backup"},
+	)
+}
+
+// mirrorServers are the Server lines pre-setup.sh puts first in the
+// mirrorlist, in order
+func (p *planner) mirrorServers() []string {
+	var servers []string
+	if local := p.answers["LOCAL_REPO"]; local != "" {
+		servers = append(servers, localRepoServer(local))
+	}
+	if mirror := p.answers["PACMAN_MIRROR"]; mirror != "" {
+		servers = append(servers, mirror)
+	}
+	return servers
+}
+
+func (p *planner) runChecks() []planOperation {
+	return []planOperation{{Kind: "command", Summary: "check root, Arch ISO, pacman and network; connect Wi-Fi if needed"}}
+}
+
+func (p *planner) packageCheck() []planOperation {
+	return []planOperation{{
+		Kind:    "check",
+		Summary: "resolve every package below against the sync databases and the AUR",
+		Command: "arch-matic packages",
+	}}
+}
+
+func (p *planner) partition() []planOperation {
+	ops := []planOperation{
+		{Kind: "command", Summary: "unmount /mnt if mounted", Command: "if mountpoint -q /mnt; then umount -A --recursive /mnt; else echo '/mnt is not mounted'; fi"},
+		{Kind: "partition", Summary: "wipe partition table of " + p.disk.Device, Command: "sgdisk -Z " + p.disk.Device},
+	}
+	for _, part := range p.disk.Partitions {
+		ops = append(ops, planOperation{
+			Kind:    "partition",
+			Summary: fmt.Sprintf("%s %s type %s %q", part.Device, part.sizeText(), part.TypeCode, part.Label),
+			Command: fmt.Sprintf("sgdisk -n%d:%s:%s -t%d:%s -c%d:'%s' %s", part.Number, part.Start, part.Size, part.Number, part.TypeCode, part.Number, part.Label, p.disk.Device),
+		})
+	}
+	return ops
+}
+
+func (p *planner) format() []planOperation {
+	var ops []planOperation
+	for _, fs := range p.disk.Filesystems {
+		cmd := fmt.Sprintf("mkfs.%s -f -L %s %s", fs.Type, fs.Label, fs.Device)
+		switch fs.Type {
+		case "vfat":
+			cmd = fmt.Sprintf("mkfs.vfat -F32 -n %s %s", fs.Label, fs.Device)
+		case "ext4":
+			cmd = fmt.Sprintf("mkfs.ext4 -F -L %s %s", fs.Label, fs.Device)
+		case "swap":
+			cmd = fmt.Sprintf("mkswap -L %s %s", fs.Label, fs.Device)
+		}
+		ops = append(ops, planOperation{Kind: "format", Summary: fmt.Sprintf("%s as %s %q", fs.Device, fs.Type, fs.Label), Command: cmd})
+	}
+	for _, subvolume := range p.disk.Subvolumes {
+		ops = append(ops, planOperation{Kind: "format", Summary: "btrfs subvolume " + subvolume, Command: "btrfs subvolume create /mnt/" + subvolume})
+	}
+	// Written the way the format scripts mount them
+	for _, m := range p.disk.Mounts {
+		target := filepath.Join("/mnt", m.Target)
+		cmd := fmt.Sprintf("mount -o %s %s %s", m.Options, m.Source, target)
+		if m.Options == "defaults" {
+			cmd = fmt.Sprintf("mount -t %s %s %s", m.FSType, m.Source, target)
+		}
+		ops = append(ops, planOperation{
+			Kind:    "mount",
+			Summary: fmt.Sprintf("%s on %s (%s)", m.Source, target, m.Options),
+			Command: cmd,
+		})
+	}
+	for _, fs := range p.disk.Filesystems {
+		if fs.Type == "swap" {
+			ops = append(ops, planOperation{Kind: "mount", Summary: "swap on " + fs.Device, Command: "swapon " + fs.Device})
+		}
+	}
+	return ops
+}
+
+func (p *planner) bootstrap() []planOperation {
+	names := []string{"base", "base-devel", p.value("KERNELS", "linux"), p.answers["KERNEL_HEADERS"], "linux-firmware", "efibootmgr", "grub"}
+	if microcode := p.answers["MICROCODE"]; microcode == "amd" || microcode == "intel" {
+		names = append(names, microcode+"-ucode")
+	}
+	op := packages("pacstrap the base system", names...)
+	op.Command = "pacstrap /mnt " + strings.Join(op.Items, " ") + " --noconfirm --needed"
+	if p.answers["REUSE_ISO_CACHE"] == "true" {
+		op.Summary += " from the ISO package cache"
+		op.Command = "pacstrap -c /mnt " + strings.Join(op.Items, " ") + " --noconfirm --needed"
+	}
+	op.Chroot = false
+	return []planOperation{op}
+}
+
+func (p *planner) fstab() []planOperation {
+	op := planOperation{Kind: "file", Summary: "fstab from the disk plan, checked against genfstab -U", Path: "/etc/fstab", Chroot: true}
+	entries, err := buildFstab(p.disk, p.answers["FSTAB_ID"], nil)
+	if err != nil {
+		op.Summary = err.Error()
+	}
+	for _, entry := range entries {
+		op.Items = append(op.Items, fmt.Sprintf("%s %s %s %s", entry.Source, entry.Target, entry.FSType, entry.Options))
+	}
+	return []planOperation{op}
+}
+
+func (p *planner) grub() []planOperation {
+	install := "grub-install --target=x86_64-efi --efi-directory=/boot/efi --bootloader-id=GRUB"
+	if p.answers["TARGET_IMAGE"] != "" {
+		install += " --removable --no-nvram"
+	}
+	if p.answers["SECURE_BOOT"] == "true" {
+		install += " --modules=tpm --disable-shim-lock --sbat /usr/share/grub/sbat.csv"
+	}
+	return []planOperation{
+		command(true, install),
+		file("/etc/default/grub", fmt.Sprintf("GRUB_DISABLE_SUBMENU=y, GRUB_TOP_LEVEL=/boot/vmlinuz-%s", p.value("DEFAULT_KERNEL", "linux"))),
+		{Kind: "file", Summary: "GRUB menu", Path: "/boot/grub/grub.cfg", Command: "grub-mkconfig -o /boot/grub/grub.cfg", Chroot: true},
+	}
+}
+
+func (p *planner) secureBoot() []planOperation {
+	uki := p.answers["UKI"] == "true"
+	secureBoot := p.answers["SECURE_BOOT"] == "true"
+	if !uki && !secureBoot {
+		return []planOperation{{Kind: "command", Summary: "nothing to do, UKI and Secure Boot are off"}}
+	}
+
+	kernels := strings.Fields(p.value("KERNELS", "linux"))
+	ops := []planOperation{
+		packages("UKI and Secure Boot tools", "sbctl efibootmgr"),
+		file("/etc/kernel/cmdline", "root=UUID=<root-uuid> rw"),
+	}
+	for _, kernel := range kernels {
+		ops = append(ops, file("/etc/mkinitcpio.d/"+kernel+".preset", "initramfs and UKI preset for "+kernel))
+	}
+	ops = append(ops, command(true, "mkinitcpio -P"))
+	image := p.answers["TARGET_IMAGE"] != ""
+	if !image {
+		// The default kernel is created last so it is first in BootOrder
+		defaultKernel := p.value("DEFAULT_KERNEL", "linux")
+		var ordered []string
+		for _, kernel := range kernels {
+			if kernel != defaultKernel {
+				ordered = append(ordered, kernel)
+			}
+		}
+		for _, kernel := range append(ordered, defaultKernel) {
+			cmd := fmt.Sprintf(`efibootmgr --create --disk %s --part 2 --label 'Arch Linux (%s)' --loader '\EFI\Linux\arch-%s.efi' --unicode`, p.disk.Device, kernel, kernel)
+			ops = append(ops, planOperation{Kind: "command", Summary: "firmware boot entry for the " + kernel + " UKI", Command: cmd, Chroot: true})
+		}
+	}
+	if !secureBoot {
+		return ops
+	}
+
+	if keys := p.answers["SECURE_BOOT_KEYS"]; keys != "" {
+		ops = append(ops,
+			planOperation{Kind: "command", Summary: "copy the keys of " + keys, Command: fmt.Sprintf("cp -r '%s' /mnt/root/sbkeys", keys)},
+			command(true, "sbctl import-keys --directory /root/sbkeys"),
+			command(true, "rm -rf /root/sbkeys"),
+		)
+	} else {
+		ops = append(ops, command(true, "sbctl create-keys"))
+	}
+	if p.answers["SECURE_BOOT_SETUP_MODE"] == "true" && !image {
+		ops = append(ops, command(true, "sbctl enroll-keys --microsoft"))
+	}
+	loader := "/boot/efi/EFI/GRUB/grubx64.efi"
+	if p.answers["TARGET_IMAGE"] != "" {
+		loader = "/boot/efi/EFI/BOOT/BOOTX64.EFI" // grub-install --removable
+	}
+	ops = append(ops, command(true, "sbctl sign -s "+loader))
+	for _, kernel := range kernels {
+		ops = append(ops,
+			command(true, "sbctl sign -s /boot/vmlinuz-"+kernel),
+			command(true, "sbctl sign -s /boot/efi/EFI/Linux/arch-"+kernel+".efi"),
+			command(true, "sbctl sign -s /boot/efi/EFI/Linux/arch-"+kernel+"-fallback.efi"),
+		)
+	}
+	return append(ops, command(true, "sbctl verify"))
+}
+
+// gpuPackages mirrors gpu_setup in system-config.sh
+func gpuPackages(gpu, driver string) []string {
+	var names []string
+	switch driver {
+	case "none":
+		return nil
+	case "nvidia":
+		names = []string{"nvidia-dkms", "nvidia-utils", "lib32-nvidia-utils"}
+	case "nvidia-open":
+		names = []string{"nvidia-open-dkms", "nvidia-utils", "lib32-nvidia-utils"}
+	case "nouveau":
+		names = []string{"xf86-video-nouveau", "mesa", "lib32-mesa", "vulkan-nouveau", "lib32-vulkan-nouveau"}
+	case "amdgpu":
+		names = []string{"xf86-video-amdgpu", "mesa", "lib32-mesa", "vulkan-radeon", "lib32-vulkan-radeon"}
+	case "intel":
+		names = []string{"mesa", "lib32-mesa", "vulkan-intel", "lib32-vulkan-intel", "intel-media-driver"}
+	default:
+		names = []string{"xf86-video-vesa", "mesa"}
+	}
+	switch gpu {
+	case "intel-nvidia":
+		names = append(names, "mesa", "lib32-mesa", "vulkan-intel", "lib32-vulkan-intel", "intel-media-driver", "nvidia-prime")
+	case "amd-nvidia":
+		names = append(names, "mesa", "lib32-mesa", "vulkan-radeon", "lib32-vulkan-radeon", "nvidia-prime")
+	}
+	return names
+}
+
+func (p *planner) systemConfig() []planOperation {
+	ops := []planOperation{
+		file("/etc/pacman.conf", "ParallelDownloads = "+p.value("PARALLEL_DOWNLOADS", "5")),
+		file("/etc/makepkg.conf", "MAKEFLAGS="+p.value("MAKEFLAGS", "-j$(nproc)")),
+	}
+	if names := gpuPackages(p.answers["GPU"], p.answers["GPU_DRIVER"]); len(names) > 0 {
+		ops = append(ops, packages("GPU driver "+p.answers["GPU_DRIVER"], names...))
+	}
+	if p.answers["GUEST_PACKAGES"] != "" {
+		ops = append(ops, packages("VM guest tools", p.answers["GUEST_PACKAGES"]))
+		for _, name := range strings.Fields(p.answers["GUEST_SERVICES"]) {
+			ops = append(ops, service(name))
+		}
+	}
+	return append(ops,
+		file("/etc/hostname", p.answers["HOSTNAME"]),
+		file("/etc/locale.gen", p.answers["LOCALE"]+" UTF-8"),
+		command(true, "locale-gen"),
+		file("/etc/locale.conf", "LANG="+p.answers["LOCALE"]),
+		file("/etc/localtime", "link to /usr/share/zoneinfo/"+p.answers["TIMEZONE"]),
+		file("/etc/vconsole.conf", "KEYMAP="+p.answers["KEYMAP"]),
+		packages("login shell", p.value("SHELL", "bash")),
+		planOperation{Kind: "user", Summary: fmt.Sprintf("create %s in wheel with /usr/bin/%s", p.answers["USERNAME"], p.value("SHELL", "bash")), Command: fmt.Sprintf("useradd -m -G wheel -s /usr/bin/%s %s", p.value("SHELL", "bash"), p.answers["USERNAME"]), Chroot: true},
+		planOperation{Kind: "user", Summary: "set the root and " + p.answers["USERNAME"] + " passwords", Chroot: true},
+		file("/etc/sudoers", "allow the wheel group"),
+	)
+}
+
+var pacmanInstall = regexp.MustCompile(`pacman -S --noconfirm --needed ([^"]+)"`)
+
+// embeddedScript returns the text of the step's script
+func (p *planner) embeddedScript() string {
+	data, _ := installFiles.ReadFile(filepath.ToSlash(p.step.Path))
+	return string(data)
+}
+
+// expand fills in the variables of a script line the way the script sees
+// them: renamed by shellConfigNames and with their ${NAME:-default}
+func (p *planner) expand(text string) string {
+	answerNames := make(map[string]string)
+	for answer, name := range shellConfigNames {
+		answerNames[name] = answer
+	}
+	return os.Expand(text, func(key string) string {
+		key, fallback, _ := strings.Cut(key, ":-")
+		if answer, ok := answerNames[key]; ok {
+			key = answer
+		}
+		return p.value(key, fallback)
+	})
+}
+
+// systemPackages lists the selected package groups, system-pkgs.sh
+// installs their packages from SYSTEM_PACKAGES.
+func (p *planner) systemPackages() []planOperation {
+	groups, err := repoGroupFile.load()
+	if err != nil {
+		return []planOperation{{Kind: "packages", Summary: err.Error()}}
+	}
+	var ops []planOperation
+	for _, group := range groups {
+		if containsString(strings.Fields(p.answers["PACKAGE_GROUPS"]), group.Name) {
+			ops = append(ops, packages(group.Name+" group", group.Packages...))
+		}
+	}
+	if p.answers["USER_PACKAGES"] != "" {
+		ops = append(ops, packages("[packages] section", p.answers["USER_PACKAGES"]))
+	}
+	if len(ops) == 0 {
+		ops = append(ops, planOperation{Kind: "command", Summary: "nothing to install, no package groups selected"})
+	}
+	return ops
+}
+
+// scriptPackages lists the pacman installs of a script, the terminal
+// script does nothing else that touches the target.
+func (p *planner) scriptPackages() []planOperation {
+	var ops []planOperation
+	for _, match := range pacmanInstall.FindAllStringSubmatch(p.embeddedScript(), -1) {
+		ops = append(ops, packages(p.step.Script, p.expand(match[1])))
+	}
+	if len(ops) == 0 {
+		ops = append(ops, planOperation{Kind: "command", Summary: "nothing to install"})
+	}
+	return ops
+}
+
+// aurPackages builds the helper as the new user and installs the selected
+// AUR groups one package at a time.
+func (p *planner) aurPackages() []planOperation {
+	helper := p.answers["AUR_HELPER"]
+	if helper == "" || helper == "none" {
+		return []planOperation{{Kind: "command", Summary: "nothing to install, no AUR helper selected"}}
+	}
+	user := p.value("USERNAME", "user")
+	ops := []planOperation{
+		file("/etc/sudoers.d/99-arch-matic-aur", "passwordless sudo for "+user+" while the stage runs"),
+		packages("AUR build tools", "git base-devel"),
+		{
+			Kind:    "command",
+			Summary: "build " + helper + " from the AUR as " + user,
+			Command: fmt.Sprintf("command -v %[2]s >/dev/null || su - %[1]s -c 'rm -rf /tmp/%[2]s-bin && git clone https://aur.archlinux.org/%[2]s-bin.git /tmp/%[2]s-bin && cd /tmp/%[2]s-bin && makepkg -si --noconfirm'", user, helper),
+			Chroot:  true,
+		},
+	}
+	groups, err := aurGroupFile.load()
+	if err != nil {
+		return append(ops, planOperation{Kind: "aur", Summary: err.Error()})
+	}
+	aur := func(summary string, names []string) planOperation {
+		return planOperation{
+			Kind:    "aur",
+			Summary: summary,
+			Command: fmt.Sprintf("su - %s -c '%s -S --noconfirm --needed <package>'", user, helper),
+			Items:   names,
+			Chroot:  true,
+		}
+	}
+	for _, group := range groups {
+		if containsString(strings.Fields(p.answers["AUR_PACKAGE_GROUPS"]), group.Name) {
+			ops = append(ops, aur(group.Name+" group", group.Packages))
+		}
+	}
+	if desktop := strings.Fields(p.answers["DESKTOP_AUR_PACKAGES"]); len(desktop) > 0 {
+		ops = append(ops, aur(p.answers["DESKTOP_ENVIRONMENT"]+" profile", desktop))
+	}
+	if user := strings.Fields(p.answers["USER_AUR_PACKAGES"]); len(user) > 0 {
+		ops = append(ops, aur("[packages] section", user))
+	}
+	return ops
+}
+
+// desktop installs the packages of the chosen desktop profile
+func (p *planner) desktop() []planOperation {
+	if p.answers["DESKTOP_PACKAGES"] == "" {
+		return []planOperation{{Kind: "command", Summary: "nothing to install, profile " + p.value("DESKTOP_ENVIRONMENT", "none")}}
+	}
+	ops := []planOperation{packages(p.answers["DESKTOP_ENVIRONMENT"]+" profile", p.answers["DESKTOP_PACKAGES"])}
+	if p.answers["DISPLAY_MANAGER"] == "greetd" {
+		ops = append(ops, file("/etc/greetd/config.toml", "tuigreet starts "+p.answers["DESKTOP_SESSION"]))
+	}
+	return ops
+}
+
+// dotfiles imports the [dotfiles] section into the home of its user
+func (p *planner) dotfiles() []planOperation {
+	source, user, method, err := dotfilesSettings(p.answers)
+	switch {
+	case err != nil:
+		return []planOperation{{Kind: "file", Summary: err.Error()}}
+	case source == "":
+		return []planOperation{{Kind: "command", Summary: "nothing to import, no dotfiles source configured"}}
+	}
+	home := "/home/" + user
+	if user == "root" {
+		home = "/root"
+	}
+	verb := "link"
+	if method == "copy" {
+		verb = "copy"
+	}
+	return []planOperation{
+		{Kind: "file", Summary: "import of " + source, Path: home + "/" + dotfilesDir, Chroot: true},
+		{Kind: "file", Summary: verb + " the files of every package, existing files kept as .orig", Path: home, Chroot: true},
+	}
+}
+
+func (p *planner) packageSources() []planOperation {
+	var ops []planOperation
+	if local := p.answers["LOCAL_REPO"]; local != "" {
+		ops = append(ops, planOperation{Kind: "mount", Summary: "local repository, read-only", Command: "mount --bind " + local + " " + filepath.Join("/mnt", local)})
+	}
+	if p.answers["REUSE_ISO_CACHE"] == "true" {
+		ops = append(ops,
+			planOperation{Kind: "mount", Summary: "ISO package cache, read-only", Command: "mount --bind " + isoCacheDir + " " + filepath.Join("/mnt", targetISOCache)},
+			file("/etc/pacman.conf", "CacheDir "+isoCacheDir+"/ and "+targetISOCache+"/"),
+		)
+	}
+	return ops
+}
+
+func (p *planner) lastCleanup() []planOperation {
+	var ops []planOperation
+	for _, name := range baseServices(p.answers) {
+		ops = append(ops, service(name))
+	}
+	for _, name := range desktopServices(p.answers) {
+		ops = append(ops, service(name))
+	}
+	if local := p.answers["LOCAL_REPO"]; local != "" {
+		ops = append(ops, command(false, "umount "+filepath.Join("/mnt", local)))
+	}
+	if p.answers["REUSE_ISO_CACHE"] == "true" {
+		ops = append(ops,
+			command(false, "umount "+filepath.Join("/mnt", targetISOCache)),
+			file("/etc/pacman.conf", "ISO package cache removed"),
+		)
+	}
+	if len(p.mirrorServers()) > 0 {
+		summary := "mirrorlist restored from the live system"
+		if mirror := p.answers["PACMAN_MIRROR"]; mirror != "" {
+			summary += ", behind " + mirror
+		}
+		ops = append(ops, file("/etc/pacman.d/mirrorlist", summary))
+	}
+	return ops
+}
+
+func (p *planner) verify() []planOperation {
+	return []planOperation{{
+		Kind:    "check",
+		Summary: "verify fstab, ESP, bootloader, kernels, user, services, hostname, locale and timezone",
+		Command: "arch-matic verify",
+	}}
+}
+
+func printPlanText(w io.Writer, plan *installPlan) {
+	fmt.Fprintf(w, "Install plan for %s (%s, %s)\n", plan.Device, plan.Disk.FormatType, plan.Firmware)
+	fmt.Fprintln(w, "Nothing below has been executed.")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, step := range plan.Steps {
+		fmt.Fprintf(tw, "\n%s/%s\n", step.Stage, step.Script)
+		for _, op := range step.Operations {
+			summary := op.Summary
+			if op.Path != "" {
+				summary = fmt.Sprintf("%s: %s", op.Path, op.Summary)
+			}
+			if op.Kind == "packages" || op.Kind == "aur" {
+				summary = fmt.Sprintf("%s: %s", op.Summary, strings.Join(op.Items, " "))
+			}
+			where := "live"
+			if op.Chroot {
+				where = "target"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", op.Kind, where, summary)
+			if op.Kind != "packages" && op.Kind != "aur" {
+				for _, item := range op.Items {
+					fmt.Fprintf(tw, "  \t\t  %s\n", item)
+				}
+			}
+		}
+	}
+	tw.Flush()
+}
+
+// runPlan implements "arch-matic plan"
+func runPlan(args []string) {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	configFile := flags.String("config", filepath.Join("install", "arch_config.toml"), "Configuration to plan")
+	format := flags.String("format", "text", "Output format: text or json")
+	flags.Parse(args)
+	if *format != "text" && *format != "json" {
+		fmt.Printf("Error: unknown format %q, use text or json\n", *format)
+		os.Exit(1)
+	}
+
+	answers, err := loadTOMLConfig(*configFile)
+	if err != nil {
+		fmt.Printf("Error loading %s: %v\n", *configFile, err)
+		os.Exit(1)
+	}
+	plan, err := buildInstallPlan(answers)
+	if err != nil {
+		fmt.Printf("Error building install plan: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *format == "text" {
+		printPlanText(os.Stdout, plan)
+		return
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(plan); err != nil {
+		fmt.Printf("Error printing install plan: %v\n", err)
+		os.Exit(1)
+	}
+}
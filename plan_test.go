@@ -0,0 +1,216 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func planTestAnswers(formatType string) map[string]string {
+	return map[string]string{
+		"INSTALL_DEVICE": "/dev/nvme0n1",
+		"DEVICE":         "/dev/nvme0n1",
+		"PARTITION_EFI":  "/dev/nvme0n1p2",
+		"PARTITION_ROOT": "/dev/nvme0n1p3",
+		"PARTITION_SWAP": "/dev/nvme0n1p5",
+		"FORMAT_TYPE":    formatType,
+		"MOUNT_OPTIONS":  "noatime,compress=zstd,ssd,commit=120",
+		"HOSTNAME":       "arch",
+		"USERNAME":       "ssnow",
+		"KERNELS":        "linux",
+		"MICROCODE":      "intel",
+		"GPU":            "nvidia",
+		"GPU_DRIVER":     "nvidia-open",
+	}
+}
+
+// expandedScript is the embedded script with the answers filled in, the
+// way execute_process sees its commands
+func expandedScript(t *testing.T, path string, answers map[string]string) string {
+	data, err := installFiles.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.Expand(string(data), func(key string) string { return answers[key] })
+}
+
+// dryRunCommands runs the script of step in dry-run mode and returns the
+// commands it skipped, as execute_process reports them
+func dryRunCommands(t *testing.T, answers map[string]string, stage, script string) []string {
+	dir := t.TempDir()
+	if err := extractEmbeddedFiles(installFiles, "install", dir); err != nil {
+		t.Fatal(err)
+	}
+	runner := newStageRunner(dir, answers, true, false)
+	runner.stdout, runner.stderr = io.Discard, io.Discard
+	var mu sync.Mutex
+	var commands []string
+	runner.onEvent = func(event runnerEvent) {
+		if event.Kind == "event" && event.Event.Type == eventDryRun {
+			mu.Lock()
+			commands = append(commands, event.Event.Message)
+			mu.Unlock()
+		}
+	}
+	if err := writeShellConfig(answers, runner.configFile); err != nil {
+		t.Fatal(err)
+	}
+	step := installStep{Stage: stage, Script: script, Path: filepath.Join(runner.scriptsDir, stage, script)}
+	if _, err := runner.runAttempt(0, step); err != nil {
+		t.Fatalf("dry run of %s: %v", step, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return commands
+}
+
+// installedPackages are the package arguments of the pacman, pacstrap and
+// AUR helper installs among commands
+func installedPackages(commands []string) []string {
+	var names []string
+	for _, command := range commands {
+		if _, inner, found := strings.Cut(command, " -c '"); found && strings.HasPrefix(command, "su - ") {
+			command = strings.TrimSuffix(inner, "'")
+		}
+		fields := strings.Fields(command)
+		if len(fields) < 2 || !containsString([]string{"pacman", "pacstrap", "paru", "yay"}, fields[0]) {
+			continue
+		}
+		if fields[0] != "pacstrap" && !strings.HasPrefix(fields[1], "-S") {
+			continue
+		}
+		for _, arg := range fields[1:] {
+			if !strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "/") {
+				names = append(names, arg)
+			}
+		}
+	}
+	return names
+}
+
+// The planners copy what their scripts do. Every planned command has to be
+// one the script runs, word for word, and the planned packages have to be
+// the ones it installs, for each config below.
+func TestPlanCommandsMatchScripts(t *testing.T) {
+	imageAnswers := planTestAnswers("btrfs")
+	imageAnswers["TARGET_IMAGE"] = "disk.img"
+	imageAnswers["SECURE_BOOT"] = "true"
+	imageAnswers["UKI"] = "true"
+	imageAnswers["SWAP_SIZE"] = "4G"
+	imageAnswers["SUBVOLUMES"] = "@home, @, @log"
+	secureBoot := planTestAnswers("ext4")
+	secureBoot["SECURE_BOOT"] = "true"
+	secureBoot["UKI"] = "true"
+	secureBoot["SECURE_BOOT_SETUP_MODE"] = "true"
+	secureBoot["SECURE_BOOT_KEYS"] = "/root/keys"
+	secureBoot["KERNELS"] = "linux linux-lts"
+	secureBoot["DEFAULT_KERNEL"] = "linux-lts"
+	sources := planTestAnswers("btrfs")
+	sources["LOCAL_REPO"] = "/srv/repo"
+	sources["PACMAN_MIRROR"] = "http://mirror.lan/$repo/os/$arch"
+	sources["REUSE_ISO_CACHE"] = "true"
+	sources["AUR_HELPER"] = "paru"
+	sources["MICROCODE"] = "amd"
+	configs := map[string]map[string]string{
+		"btrfs":           planTestAnswers("btrfs"),
+		"ext4":            planTestAnswers("ext4"),
+		"image":           imageAnswers,
+		"secure boot":     secureBoot,
+		"package sources": sources,
+	}
+
+	for name, answers := range configs {
+		if err := setPackageAnswers(answers); err != nil {
+			t.Fatal(err)
+		}
+		plan, err := buildInstallPlan(answers)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, step := range plan.Steps {
+			var commands, packages []string
+			for _, op := range step.Operations {
+				switch op.Kind {
+				case "packages", "aur":
+					packages = append(packages, op.Items...)
+				case "service":
+					commands = append(commands, op.Command)
+				default:
+					if op.Command != "" {
+						commands = append(commands, op.Command)
+					}
+				}
+			}
+			if scriptPlanners[step.Script] == nil || builtinSteps[step.Script] != nil || len(commands)+len(packages) == 0 {
+				continue
+			}
+			t.Run(name+"/"+step.Script, func(t *testing.T) {
+				t.Parallel()
+				executed := dryRunCommands(t, answers, step.Stage, step.Script)
+				for _, command := range commands {
+					if !containsString(executed, command) {
+						t.Errorf("planned %q, the script runs:\n%s", command, strings.Join(executed, "\n"))
+					}
+				}
+				installed := installedPackages(executed)
+				for _, name := range packages {
+					if !containsString(installed, name) {
+						t.Errorf("planned package %s is not installed", name)
+					}
+				}
+				for _, name := range installed {
+					if !containsString(packages, name) {
+						t.Errorf("package %s is installed but not planned", name)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestGPUPackagesMatchScript(t *testing.T) {
+	script := expandedScript(t, "install/scripts/4-post/system-config.sh", nil)
+	for _, driver := range []string{"nvidia", "nvidia-open", "nouveau", "amdgpu", "intel"} {
+		names := gpuPackages("", driver)
+		if !strings.Contains(script, `packages="`+strings.Join(names, " ")+`"`) {
+			t.Errorf("packages of %s %v are not in gpu_setup", driver, names)
+		}
+		for _, gpu := range []string{"intel-nvidia", "amd-nvidia"} {
+			hybrid := gpuPackages(gpu, driver)[len(names):]
+			if !strings.Contains(script, `packages+=" `+strings.Join(hybrid, " ")+`"`) {
+				t.Errorf("hybrid packages of %s %v are not in gpu_setup", gpu, hybrid)
+			}
+		}
+	}
+	if gpuPackages("nvidia", "none") != nil {
+		t.Errorf("driver none installs packages")
+	}
+}
+
+func TestBuildDiskPlanExt4(t *testing.T) {
+	plan, err := buildDiskPlan(planTestAnswers("ext4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Subvolumes) != 0 {
+		t.Errorf("ext4 plan has subvolumes %v", plan.Subvolumes)
+	}
+	if len(plan.Mounts) != 2 || plan.Mounts[0].Target != "/" || plan.Mounts[0].FSType != "ext4" || plan.Mounts[0].Options != ext4MountOptions {
+		t.Errorf("ext4 mounts = %+v", plan.Mounts)
+	}
+
+	entries, err := buildFstab(plan, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entries[len(entries)-1]; got.Target != "/tmp" || got.FSType != "tmpfs" {
+		t.Errorf("ext4 fstab has no tmpfs /tmp: %+v", entries)
+	}
+
+	if _, err := buildDiskPlan(planTestAnswers("xfs")); err == nil {
+		t.Errorf("xfs: expected an error")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/BurntSushi/toml"
+)
+
+type cpuReport struct {
+	Model     string `json:"model" toml:"model"`
+	Vendor    string `json:"vendor" toml:"vendor"`
+	Microcode string `json:"microcode" toml:"microcode"`
+	Threads   int    `json:"threads" toml:"threads"`
+}
+
+type diskReport struct {
+	Device      string `json:"device" toml:"device"`
+	Description string `json:"description" toml:"description"`
+	Rotational  bool   `json:"rotational" toml:"rotational"`
+	SMART       string `json:"smart" toml:"smart"`
+}
+
+type hardwareReport struct {
+	Firmware       firmwareInfo       `json:"firmware" toml:"firmware"`
+	CPU            cpuReport          `json:"cpu" toml:"cpu"`
+	MemoryMiB      uint64             `json:"memory_mib" toml:"memory_mib"`
+	Virtualization string             `json:"virtualization" toml:"virtualization"`
+	WiFi           bool               `json:"wifi" toml:"wifi"`
+	Bluetooth      bool               `json:"bluetooth" toml:"bluetooth"`
+	Battery        bool               `json:"battery" toml:"battery"`
+	GPUs           []gpuDevice        `json:"gpus" toml:"gpus"`
+	Disks          []diskReport       `json:"disks" toml:"disks"`
+	Network        []networkInterface `json:"network" toml:"network"`
+}
+
+func probeHardware() hardwareReport {
+	report := hardwareReport{
+		Firmware:       getFirmwareInfo(),
+		MemoryMiB:      getMemoryMiB(),
+		Virtualization: getVirtualization(),
+		Bluetooth:      hasBluetooth(),
+		Battery:        hasBattery(),
+		GPUs:           getGPUs(),
+		Network:        getNetworkInterfaces(),
+	}
+
+	model, vendor, microcode, numCPUs := getCPUInfo()
+	report.CPU = cpuReport{Model: model, Vendor: vendor, Microcode: microcode, Threads: numCPUs}
+
+	// Errors go to stderr, stdout may be the JSON or TOML report
+	drives, err := getDriveInfo()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting drive info: %v\n", err)
+	}
+	for _, drive := range drives {
+		device := strings.Fields(drive)[0]
+		report.Disks = append(report.Disks, diskReport{
+			Device:      device,
+			Description: strings.TrimSpace(strings.TrimPrefix(drive, device)),
+			Rotational:  isRotational(device),
+			SMART:       getSMARTHealth(device),
+		})
+	}
+
+	for _, iface := range report.Network {
+		if iface.Wireless {
+			report.WiFi = true
+		}
+	}
+	return report
+}
+
+func runProbe(args []string) {
+	flags := flag.NewFlagSet("probe", flag.ExitOnError)
+	format := flags.String("format", "table", "Output format: table, json or toml")
+	flags.Parse(args)
+
+	report := probeHardware()
+
+	var err error
+	switch *format {
+	case "table":
+		printHardwareTable(report)
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	case "toml":
+		encoder := toml.NewEncoder(os.Stdout)
+		encoder.Indent = "  "
+		err = encoder.Encode(report)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error printing hardware report: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func printHardwareTable(report hardwareReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	firmware := "bios"
+	if report.Firmware.UEFI {
+		firmware = fmt.Sprintf("uefi (secure boot: %s, setup mode: %s)",
+			onOff(report.Firmware.SecureBoot), onOff(report.Firmware.SetupMode))
+	}
+	fmt.Fprintf(w, "Firmware\t%s\n", firmware)
+	fmt.Fprintf(w, "CPU\t%s (%s, %d threads, microcode %s)\n",
+		report.CPU.Model, report.CPU.Vendor, report.CPU.Threads, report.CPU.Microcode)
+	fmt.Fprintf(w, "Memory\t%d MiB\n", report.MemoryMiB)
+	fmt.Fprintf(w, "Virtualization\t%s\n", report.Virtualization)
+	fmt.Fprintf(w, "Wi-Fi\t%s\n", yesNo(report.WiFi))
+	fmt.Fprintf(w, "Bluetooth\t%s\n", yesNo(report.Bluetooth))
+	fmt.Fprintf(w, "Battery\t%s\n", yesNo(report.Battery))
+
+	for _, gpu := range report.GPUs {
+		fmt.Fprintf(w, "GPU\t%s %s", gpu.Slot, gpu)
+		if gpu.Driver != "" {
+			fmt.Fprintf(w, ", driver %s", gpu.Driver)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, disk := range report.Disks {
+		kind := "ssd"
+		if disk.Rotational {
+			kind = "hdd"
+		}
+		fmt.Fprintf(w, "Disk\t%s %s [%s, smart %s]\n", disk.Device, disk.Description, kind, disk.SMART)
+	}
+	for _, iface := range report.Network {
+		kind := "wired"
+		if iface.Wireless {
+			kind = "wireless"
+		}
+		fmt.Fprintf(w, "Network\t%s %s [%s, %s]\n", iface.Name, iface.MAC, kind, iface.State)
+	}
+}
+
+func onOff(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
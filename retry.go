@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// scriptPolicy is the [scripts."<name>"] table of stages.toml. The wait
+// before a retry starts at backoff and doubles with every attempt.
+type scriptPolicy struct {
+	Retries int           `toml:"retries"`
+	Backoff time.Duration `toml:"backoff"`
+	Timeout time.Duration `toml:"timeout"`
+}
+
+// How long a script that timed out gets to exit after SIGTERM
+const timeoutGrace = 10 * time.Second
+
+func (p scriptPolicy) String() string {
+	s := fmt.Sprintf("retries %d", p.Retries)
+	if p.Retries > 0 {
+		s += fmt.Sprintf(", backoff %s", p.Backoff)
+	}
+	if p.Timeout > 0 {
+		s += fmt.Sprintf(", timeout %s", p.Timeout)
+	}
+	return s
+}
+
+func (p scriptPolicy) backoffFor(attempt int) time.Duration {
+	return p.Backoff * time.Duration(1<<(attempt-1))
+}
+
+// runStep runs a script according to its retry policy. Every failed
+// attempt is logged and reported as a retry event before the next one.
+func (r *stageRunner) runStep(index int, step installStep, state *installState) error {
+	attempts := step.Policy.Retries + 1
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		state.attempt(step, attempt)
+		var timedOut bool
+		timedOut, err = r.runAttempt(index, step)
+		if timedOut {
+			state.timedOut(step)
+			err = fmt.Errorf("timed out after %s", step.Policy.Timeout)
+		}
+		if err == nil || r.isAborted() || attempt == attempts {
+			break
+		}
+
+		wait := step.Policy.backoffFor(attempt)
+		message := fmt.Sprintf("%s failed (attempt %d/%d): %v, retrying in %s", step, attempt, attempts, err, wait)
+		fmt.Fprintf(r.stdout, "==> %s\n", message)
+		r.recordEvent(index, step, installEvent{Type: eventRetry, Message: message})
+		if !r.sleep(wait) {
+			break
+		}
+	}
+	return err
+}
+
+// sleep waits for d unless the install is aborted in the meantime
+func (r *stageRunner) sleep(d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		if r.isAborted() {
+			return false
+		}
+		time.Sleep(min(time.Until(deadline), 250*time.Millisecond))
+	}
+	return !r.isAborted()
+}
+
+// startTimeout stops the script's process group once the step's timeout
+// has passed, SIGKILL follows if it ignores SIGTERM.
+func (r *stageRunner) startTimeout(step installStep, pid int, timedOut *bool) (stop func()) {
+	if step.Policy.Timeout <= 0 {
+		return func() {}
+	}
+	var kill *time.Timer
+	timer := time.AfterFunc(step.Policy.Timeout, func() {
+		r.mu.Lock()
+		*timedOut = true
+		kill = time.AfterFunc(timeoutGrace, func() { syscall.Kill(-pid, syscall.SIGKILL) })
+		r.mu.Unlock()
+		fmt.Fprintf(r.stdout, "==> %s timed out after %s\n", step, step.Policy.Timeout)
+		syscall.Kill(-pid, syscall.SIGTERM)
+	})
+	return func() {
+		timer.Stop()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if kill != nil {
+			kill.Stop()
+		}
+	}
+}
+
+// writeRunSummary lists the scripts that ran with their attempts and time
+func writeRunSummary(w io.Writer, state *installState) {
+	steps := append([]stepState(nil), state.Steps...)
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Stage < steps[j].Stage })
+
+	fmt.Fprintln(w, "Install summary:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, st := range steps {
+		elapsed := "-"
+		if st.Finished != nil {
+			elapsed = st.Finished.Sub(st.Started).Round(time.Second).String()
+		}
+		notes := ""
+		if st.Attempts > 1 {
+			notes = fmt.Sprintf("%d attempts", st.Attempts)
+		}
+		if st.TimedOut {
+			notes += " timed out"
+		}
+		fmt.Fprintf(tw, "  %s/%s\t%s\t%s\t%s\n", st.Stage, st.Script, st.Status, elapsed, notes)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoffFor(t *testing.T) {
+	policy := scriptPolicy{Retries: 3, Backoff: 10 * time.Second}
+	for attempt, want := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 3: 40 * time.Second} {
+		if got := policy.backoffFor(attempt); got != want {
+			t.Errorf("backoffFor(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+	if got := (scriptPolicy{Retries: 2}).backoffFor(2); got != 0 {
+		t.Errorf("no backoff waits %s", got)
+	}
+}
+
+func TestScriptPolicyString(t *testing.T) {
+	tests := map[string]scriptPolicy{
+		"retries 0":                              {},
+		"retries 0, timeout 5m0s":                {Timeout: 5 * time.Minute},
+		"retries 2, backoff 30s, timeout 1h0m0s": {Retries: 2, Backoff: 30 * time.Second, Timeout: time.Hour},
+	}
+	for want, policy := range tests {
+		if got := policy.String(); got != want {
+			t.Errorf("%+v: %s, want %s", policy, got, want)
+		}
+	}
+}
+
+func TestRunStepRetriesFailedScript(t *testing.T) {
+	dir := t.TempDir()
+	count := filepath.Join(dir, "attempts")
+	// Fails on the first attempt only, like a mirror that times out once
+	script := filepath.Join(dir, "flaky.sh")
+	body := "echo x >> " + count + "\n[ $(wc -l < " + count + ") -ge 2 ]\n"
+	if err := os.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	answers := map[string]string{"HOSTNAME": "arch"}
+	runner := newStageRunner(dir, answers, false, false)
+	runner.stdout, runner.stderr = io.Discard, io.Discard
+	step := installStep{Stage: "3-base", Script: "flaky.sh", Path: script, Policy: scriptPolicy{Retries: 2}}
+	if err := runner.runStep(0, step, newInstallState(answers)); err != nil {
+		t.Fatalf("runStep: %v", err)
+	}
+	data, _ := os.ReadFile(count)
+	if attempts := strings.Count(string(data), "x"); attempts != 2 {
+		t.Errorf("ran %d attempts, want 2", attempts)
+	}
+
+	// Without retries the first failure is final
+	os.Remove(count)
+	step.Policy.Retries = 0
+	if err := runner.runStep(0, step, newInstallState(answers)); err == nil {
+		t.Errorf("runStep without retries succeeded")
+	}
+}
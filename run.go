@@ -0,0 +1,226 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stepFilter selects a subset of the install steps. Stage and script names
+// are matched exactly, e.g. "5-desktop" or "format-btrfs.sh"; from starts
+// at the first step of a stage or at a script.
+type stepFilter struct {
+	stages []string
+	only   []string
+	from   string
+	skip   []string
+}
+
+func (f stepFilter) empty() bool {
+	return len(f.stages) == 0 && len(f.only) == 0 && f.from == "" && len(f.skip) == 0
+}
+
+func (f stepFilter) matches(step installStep) bool {
+	if len(f.stages) > 0 && !containsString(f.stages, step.Stage) {
+		return false
+	}
+	if len(f.only) > 0 && !containsString(f.only, step.Script) {
+		return false
+	}
+	return !containsString(f.skip, step.Stage) && !containsString(f.skip, step.Script)
+}
+
+// apply filters the steps, names that match no stage or script are an
+// error so a typo does not silently run nothing.
+func (f stepFilter) apply(steps []installStep) ([]installStep, error) {
+	known := make(map[string]bool)
+	for _, step := range steps {
+		known[step.Stage] = true
+		known[step.Script] = true
+	}
+	names := append(append(append([]string{}, f.stages...), f.only...), f.skip...)
+	if f.from != "" {
+		names = append(names, f.from)
+	}
+	for _, name := range names {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown stage or script %q", name)
+		}
+	}
+
+	start := 0
+	for i, step := range steps {
+		if f.from != "" && (step.Stage == f.from || step.Script == f.from) {
+			start = i
+			break
+		}
+	}
+	var selected []installStep
+	for _, step := range steps[start:] {
+		if f.matches(step) {
+			selected = append(selected, step)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no install steps selected")
+	}
+	return selected, nil
+}
+
+// checkPreconditions makes sure the stages that were skipped have left the
+// target in the state the selected stages expect. The drive stage mounts
+// the target on /mnt and the base stage installs the system chroot runs in.
+func checkPreconditions(selected []installStep) error {
+	first := selected[0].Stage
+	if first > "2-drive" && !isMountpoint("/mnt") {
+		return fmt.Errorf("%s needs the target mounted on /mnt, run 2-drive first or mount it", first)
+	}
+	if first > "3-base" {
+		if _, err := os.Stat("/mnt/usr/bin/bash"); err != nil {
+			return fmt.Errorf("%s needs the base system in /mnt, run 3-base first", first)
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList parses a comma separated flag value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// runStages implements "arch-matic run", running part of the install with
+// the saved configuration.
+func runStages(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	stage := flags.String("stage", "", "Run only these stages (comma separated)")
+	only := flags.String("only", "", "Run only these scripts (comma separated)")
+	from := flags.String("from", "", "Start at this stage or script")
+	skip := flags.String("skip", "", "Skip these stages or scripts (comma separated)")
+	configFile := flags.String("config", filepath.Join("install", "arch_config.toml"), "Configuration to run with")
+	targetImage := flags.String("target-image", "", "Install into this disk image instead of the configured device")
+	size := flags.String("size", "20G", "Size of the disk image")
+	dryRun := flags.Bool("d", false, "Run in dry-run mode")
+	flags.BoolVar(dryRun, "dry-run", false, "Run in dry-run mode")
+	verbose := flags.Bool("v", false, "Run in verbose mode")
+	flags.BoolVar(verbose, "verbose", false, "Run in verbose mode")
+	yes := flags.Bool("yes", false, "Start without asking for confirmation")
+	flags.Parse(args)
+
+	filter := stepFilter{
+		stages: splitList(*stage),
+		only:   splitList(*only),
+		from:   *from,
+		skip:   splitList(*skip),
+	}
+
+	answers, err := loadTOMLConfig(*configFile)
+	if err != nil {
+		fmt.Printf("Error loading %s: %v\n", *configFile, err)
+		os.Exit(1)
+	}
+
+	archDir, err := prepareInstallDir(answers)
+	if err != nil {
+		fmt.Printf("Error preparing install: %v\n", err)
+		os.Exit(1)
+	}
+
+	// The saved configuration keeps the real device, only this run uses
+	// the loop device.
+	var image *diskImage
+	if *targetImage != "" {
+		imageSize, err := parseSize(*size)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		image = &diskImage{path: *targetImage, size: imageSize, dryRun: *dryRun}
+		if err := image.attach(os.Stdout); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		answers = copyAnswers(answers)
+		setDeviceAnswers(answers, image.device)
+		// Tells the scripts to keep off the firmware of this machine
+		answers["TARGET_IMAGE"] = image.path
+	}
+
+	runner := newStageRunner(archDir, answers, *dryRun, *verbose)
+	runner.command = commandLine(os.Args)
+	runner.yes = *yes
+	if image != nil {
+		runner.stateFile = image.path + "." + stateFileName
+	}
+	err = runSelectedSteps(runner, filter)
+	if image != nil {
+		if detachErr := image.detach(answers, os.Stdout); detachErr != nil {
+			fmt.Printf("Error: %v\n", detachErr)
+			if err == nil {
+				os.Exit(1)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runSelectedSteps(runner *stageRunner, filter stepFilter) error {
+	runner.partial = !filter.empty()
+	steps, err := runner.loadSteps()
+	if err != nil {
+		return fmt.Errorf("error loading install stages: %v", err)
+	}
+	selected, err := filter.apply(steps)
+	if err != nil {
+		return fmt.Errorf("error selecting install steps: %v", err)
+	}
+	if !runner.dryRun {
+		if err := checkPreconditions(selected); err != nil {
+			return err
+		}
+	}
+
+	if err := runWithView(runner, selected); err != nil {
+		return fmt.Errorf("error running install stages: %v", err)
+	}
+	return nil
+}
+
+// commandLine joins a command the way it can be pasted into a shell
+func commandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = arg
+		if arg == "" || strings.ContainsAny(arg, " \t'\"\\$`*?;&|<>()") {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+func copyAnswers(answers map[string]string) map[string]string {
+	copied := make(map[string]string, len(answers))
+	for key, value := range answers {
+		copied[key] = value
+	}
+	return copied
+}
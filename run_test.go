@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStepFilterApply(t *testing.T) {
+	steps := []installStep{
+		{Stage: "1-pre", Script: "pre-setup.sh"},
+		{Stage: "2-drive", Script: "partition-btrfs.sh"},
+		{Stage: "2-drive", Script: "format-btrfs.sh"},
+		{Stage: "3-base", Script: "bootstrap-pkgs.sh"},
+		{Stage: "4-post", Script: "system-config.sh"},
+	}
+	scripts := func(selected []installStep) []string {
+		var names []string
+		for _, step := range selected {
+			names = append(names, step.Script)
+		}
+		return names
+	}
+
+	tests := []struct {
+		name   string
+		filter stepFilter
+		want   []string
+	}{
+		{"stage", stepFilter{stages: []string{"2-drive"}}, []string{"partition-btrfs.sh", "format-btrfs.sh"}},
+		{"only", stepFilter{only: []string{"bootstrap-pkgs.sh"}}, []string{"bootstrap-pkgs.sh"}},
+		{"from stage", stepFilter{from: "3-base"}, []string{"bootstrap-pkgs.sh", "system-config.sh"}},
+		{"from script", stepFilter{from: "format-btrfs.sh"}, []string{"format-btrfs.sh", "bootstrap-pkgs.sh", "system-config.sh"}},
+		{"from with skip", stepFilter{from: "2-drive", skip: []string{"3-base"}}, []string{"partition-btrfs.sh", "format-btrfs.sh", "system-config.sh"}},
+	}
+	for _, tt := range tests {
+		selected, err := tt.filter.apply(steps)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := scripts(selected); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: selected %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, filter := range []stepFilter{{from: "9-nothing"}, {only: []string{"typo.sh"}}, {only: []string{"pre-setup.sh"}, stages: []string{"4-post"}}} {
+		if _, err := filter.apply(steps); err == nil {
+			t.Errorf("%+v: expected an error", filter)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	if got := splitList(" 1-pre, ,2-drive,"); !reflect.DeepEqual(got, []string{"1-pre", "2-drive"}) {
+		t.Errorf("splitList = %v", got)
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	got := commandLine([]string{"./arch-matic", "run", "-only", "format-btrfs.sh", "-config", "my config.toml", "-target-image", "it's.img"})
+	want := `./arch-matic run -only format-btrfs.sh -config 'my config.toml' -target-image 'it'\''s.img'`
+	if got != want {
+		t.Errorf("commandLine = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+type stageDefinition struct {
+	Mandatory []string `toml:"mandatory"`
+	Optional  []string `toml:"optional"`
+}
+
+// stagesConfig mirrors install/stages.toml
+type stagesConfig struct {
+	Stages      map[string]stageDefinition `toml:"stages"`
+	Scripts     map[string]scriptPolicy    `toml:"scripts"`
+	FormatTypes map[string][]string        `toml:"format_types"`
+}
+
+// installStep is one script of a stage with its placeholders resolved.
+// Builtin steps are run by the runner itself and have no script file.
+type installStep struct {
+	Stage    string
+	Script   string
+	Path     string
+	Optional bool
+	Builtin  bool
+	Policy   scriptPolicy
+}
+
+// builtinSteps are steps of stages.toml that the runner implements itself
+// instead of running a script. It is filled in init because the package
+// check resolves the steps itself.
+var builtinSteps map[string]func(r *stageRunner, index int, step installStep) error
+
+func init() {
+	builtinSteps = map[string]func(r *stageRunner, index int, step installStep) error{
+		packageCheckStepName:   (*stageRunner).packageCheckStep,
+		fstabStepName:          (*stageRunner).fstabStep,
+		verifyStepName:         (*stageRunner).verifyStep,
+		dotfilesStepName:       (*stageRunner).dotfilesStep,
+		packageSourcesStepName: (*stageRunner).packageSourcesStep,
+	}
+}
+
+func (s installStep) String() string {
+	return s.Stage + "/" + s.Script
+}
+
+func loadStagesConfig(filename string) (*stagesConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", filename, err)
+	}
+	return decodeStagesConfig(data, filename)
+}
+
+// embeddedStagesConfig reads the stages.toml compiled into the binary, the
+// wizard uses it before the install files are extracted.
+func embeddedStagesConfig() (*stagesConfig, error) {
+	data, err := installFiles.ReadFile("install/stages.toml")
+	if err != nil {
+		return nil, fmt.Errorf("error reading embedded stages.toml: %v", err)
+	}
+	return decodeStagesConfig(data, "stages.toml")
+}
+
+func decodeStagesConfig(data []byte, filename string) (*stagesConfig, error) {
+	var config stagesConfig
+	if _, err := toml.Decode(string(data), &config); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", filename, err)
+	}
+	if len(config.Stages) == 0 {
+		return nil, fmt.Errorf("no stages defined in %s", filename)
+	}
+	return &config, nil
+}
+
+// stageNames returns the stages in execution order, the numeric prefix of
+// the stage directories keeps them sorted.
+func (c *stagesConfig) stageNames() []string {
+	names := make([]string, 0, len(c.Stages))
+	for name := range c.Stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// optionalScriptKey is the config variable that enables an optional script,
+// e.g. run-checks.sh is controlled by INSTALL_RUN_CHECKS.
+func optionalScriptKey(script string) string {
+	name := strings.TrimSuffix(script, filepath.Ext(script))
+	return "INSTALL_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// optionalScriptQuestions asks whether to run each optional script, in
+// stage order. Scripts run unless their INSTALL_* answer is "false".
+func (c *stagesConfig) optionalScriptQuestions() []Question {
+	var questions []Question
+	for _, stage := range c.stageNames() {
+		for _, script := range c.Stages[stage].Optional {
+			questions = append(questions, Question{
+				ID:     optionalScriptKey(script),
+				Text:   fmt.Sprintf("Run optional script %s (%s)?", script, stage),
+				Type:   "yesno",
+				Answer: "true",
+			})
+		}
+	}
+	return questions
+}
+
+func (c *stagesConfig) replacePlaceholders(script string, answers map[string]string) (string, error) {
+	if strings.Contains(script, "{format_type}") {
+		formatType := answers["FORMAT_TYPE"]
+		if _, ok := c.FormatTypes[formatType]; !ok {
+			return "", fmt.Errorf("unknown format type %q", formatType)
+		}
+		script = strings.ReplaceAll(script, "{format_type}", formatType)
+	}
+	return script, nil
+}
+
+// resolveSteps expands the stages into the ordered list of scripts to run.
+// A missing mandatory script fails before anything has been executed.
+func (c *stagesConfig) resolveSteps(answers map[string]string, scriptsDir string) ([]installStep, error) {
+	selected, err := c.selectSteps(answers, scriptsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []installStep
+	var missing []string
+	for _, step := range selected {
+		if step.Builtin {
+			steps = append(steps, step)
+			continue
+		}
+		if _, err := os.Stat(step.Path); err != nil {
+			if step.Optional {
+				fmt.Printf("Warning: optional script not found, skipping: %s\n", step)
+				continue
+			}
+			missing = append(missing, step.String())
+			continue
+		}
+		steps = append(steps, step)
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing required scripts: %s", strings.Join(missing, ", "))
+	}
+	return steps, nil
+}
+
+// selectSteps lists the scripts the config selects without looking at the
+// disk. Mandatory scripts run before the optional scripts of the same stage,
+// and optional scripts are skipped when their INSTALL_* variable is "false".
+func (c *stagesConfig) selectSteps(answers map[string]string, scriptsDir string) ([]installStep, error) {
+	var steps []installStep
+	for _, stage := range c.stageNames() {
+		definition := c.Stages[stage]
+		scripts := []struct {
+			names    []string
+			optional bool
+		}{
+			{definition.Mandatory, false},
+			{definition.Optional, true},
+		}
+		for _, group := range scripts {
+			for _, name := range group.names {
+				script, err := c.replacePlaceholders(name, answers)
+				if err != nil {
+					return nil, fmt.Errorf("stage %s: %v", stage, err)
+				}
+				if group.optional && answers[optionalScriptKey(script)] == "false" {
+					continue
+				}
+
+				step := installStep{
+					Stage:    stage,
+					Script:   script,
+					Path:     filepath.Join(scriptsDir, stage, script),
+					Optional: group.optional,
+					Builtin:  builtinSteps[script] != nil,
+					Policy:   c.Scripts[script],
+				}
+				steps = append(steps, step)
+			}
+		}
+	}
+	return steps, nil
+}
+
+// runnerEvent reports the progress of a stageRunner to a front end
+type runnerEvent struct {
+	Kind  string // "skipped", "started", "finished" or "event"
+	Index int
+	Step  installStep
+	Err   error
+	Event installEvent
+}
+
+type stageRunner struct {
+	archDir    string
+	scriptsDir string
+	configFile string
+	stateFile  string
+	answers    map[string]string
+	dryRun     bool
+	verbose    bool
+	resume     bool
+	partial    bool
+	yes        bool   // start without asking for confirmation
+	command    string // shown on failure, continues the install
+	stdout     io.Writer
+	stderr     io.Writer
+	onEvent    func(runnerEvent)
+
+	targetConfigSaved bool // the config has been copied to the target
+
+	// The event decoders of the scripts share these with the run loop
+	mu       sync.Mutex
+	current  *exec.Cmd
+	aborted  bool
+	eventLog io.Writer
+	packages []installEvent // package events, for the summary
+}
+
+func newStageRunner(archDir string, answers map[string]string, dryRun, verbose bool) *stageRunner {
+	return &stageRunner{
+		archDir:    archDir,
+		scriptsDir: filepath.Join(archDir, "scripts"),
+		configFile: filepath.Join(archDir, "arch_config.cfg"),
+		stateFile:  filepath.Join(archDir, stateFileName),
+		answers:    answers,
+		dryRun:     dryRun,
+		verbose:    verbose,
+		command:    "arch-matic -resume",
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+	}
+}
+
+func (r *stageRunner) loadSteps() ([]installStep, error) {
+	config, err := loadStagesConfig(filepath.Join(r.archDir, "stages.toml"))
+	if err != nil {
+		return nil, err
+	}
+	return config.resolveSteps(r.answers, r.scriptsDir)
+}
+
+// environment is what install.sh used to export for the stage scripts. The
+// answers reach them only through CONFIG_FILE, so the passwords stay out of
+// the environment of every child process.
+func (r *stageRunner) environment() []string {
+	return append(os.Environ(),
+		fmt.Sprintf("ARCH_DIR=%s", r.archDir),
+		fmt.Sprintf("SCRIPTS_DIR=%s", r.scriptsDir),
+		fmt.Sprintf("CONFIG_FILE=%s", r.configFile),
+		fmt.Sprintf("DRY_RUN=%t", r.dryRun),
+		fmt.Sprintf("VERBOSE=%t", r.verbose),
+	)
+}
+
+// loadState starts a new install state, or picks up the previous one when
+// resuming. Partial runs record into the previous state of the same config
+// so a later resume knows about them. Dry runs never record state.
+func (r *stageRunner) loadState() (*installState, error) {
+	if r.partial {
+		if state, err := loadInstallState(r.stateFile); err == nil && state.ConfigHash == configHash(r.answers) {
+			return state, nil
+		}
+		return newInstallState(r.answers), nil
+	}
+	if !r.resume {
+		return newInstallState(r.answers), nil
+	}
+	state, err := loadInstallState(r.stateFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := state.verifyResume(r.answers); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// skipCompleted tells whether a step is left out because an earlier run
+// completed it. Only resuming skips steps, a partial run reruns what it
+// selected.
+func (r *stageRunner) skipCompleted(state *installState, step installStep) bool {
+	return r.resume && state.completed(step)
+}
+
+func (r *stageRunner) saveState(state *installState) {
+	if r.dryRun {
+		return
+	}
+	if err := state.save(r.stateFile); err != nil {
+		fmt.Fprintf(r.stderr, "Warning: %v\n", err)
+	}
+	// A resume after a reboot only finds what is on the target
+	if !r.targetConfigSaved && isMountpoint("/mnt") {
+		if err := writeConfigTOML(r.answers, targetConfigFile); err != nil {
+			fmt.Fprintf(r.stderr, "Warning: error saving the configuration to the target: %v\n", err)
+			return
+		}
+		r.targetConfigSaved = true
+	}
+}
+
+func (r *stageRunner) run(steps []installStep) error {
+	if err := writeShellConfig(r.answers, r.configFile); err != nil {
+		return err
+	}
+	state, err := r.loadState()
+	if err != nil {
+		return err
+	}
+
+	eventLog, err := os.OpenFile(filepath.Join(r.archDir, eventLogName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening event log: %v", err)
+	}
+	r.mu.Lock()
+	r.eventLog = eventLog
+	r.mu.Unlock()
+	// A decoder left running by a script's background children must not
+	// write to the closed file
+	defer func() {
+		r.mu.Lock()
+		r.eventLog = nil
+		r.mu.Unlock()
+		eventLog.Close()
+	}()
+
+	stopSignals := r.watchSignals()
+	defer stopSignals()
+
+	start := time.Now()
+	stage := ""
+	for i, step := range steps {
+		if r.isAborted() {
+			return r.abort(state, nil)
+		}
+		if r.skipCompleted(state, step) {
+			fmt.Fprintf(r.stdout, "==> Skipping %s, already completed\n", step)
+			r.emit(runnerEvent{Kind: "skipped", Index: i, Step: step})
+			continue
+		}
+		if step.Stage != stage {
+			if stage != "" {
+				r.recordEvent(i, step, installEvent{Type: eventStageEnd, Stage: stage, ExitCode: new(int)})
+			}
+			stage = step.Stage
+			r.recordEvent(i, step, installEvent{Type: eventStageStart})
+		}
+
+		fmt.Fprintf(r.stdout, "==> Running %s\n", step)
+		r.emit(runnerEvent{Kind: "started", Index: i, Step: step})
+		state.begin(step)
+		r.saveState(state)
+
+		err := r.runStep(i, step, state)
+		code := exitCode(err)
+		state.finish(step, code)
+		r.saveState(state)
+		r.emit(runnerEvent{Kind: "finished", Index: i, Step: step, Err: err})
+		if err != nil {
+			r.recordEvent(i, step, installEvent{Type: eventStageEnd, ExitCode: &code})
+			if r.isAborted() {
+				return r.abort(state, &step)
+			}
+			writeRunSummary(r.stdout, state)
+			r.writePackageSummary()
+			return fmt.Errorf("%s failed: %v", step, err)
+		}
+	}
+	if stage != "" {
+		r.recordEvent(len(steps)-1, steps[len(steps)-1], installEvent{Type: eventStageEnd, Stage: stage, ExitCode: new(int)})
+	}
+	if !r.partial {
+		state.Status = statusCompleted
+	}
+	r.saveState(state)
+	writeRunSummary(r.stdout, state)
+	r.writePackageSummary()
+	fmt.Fprintf(r.stdout, "Installation completed in %s\n", time.Since(start).Round(time.Second))
+	return nil
+}
+
+// exitCode maps a command error to its exit status, -1 when the script
+// could not be started or was killed by a signal.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// abort records the interrupted install and cleans up the target so it
+// can be resumed later.
+func (r *stageRunner) abort(state *installState, step *installStep) error {
+	state.abort(step)
+	r.saveState(state)
+
+	fmt.Fprintln(r.stdout, "==> Installation aborted, cleaning up the target")
+	if err := cleanupTarget(r.answers, r.dryRun, r.stdout); err != nil {
+		fmt.Fprintf(r.stdout, "Warning: %v\n", err)
+	}
+	if step != nil {
+		return fmt.Errorf("installation aborted during %s", step)
+	}
+	return fmt.Errorf("installation aborted")
+}
+
+func (r *stageRunner) emit(event runnerEvent) {
+	if r.onEvent != nil {
+		r.onEvent(event)
+	}
+}
+
+// recordEvent fills in the stage and script of an event, appends it to the
+// event log and passes it on to the front end.
+func (r *stageRunner) recordEvent(index int, step installStep, event installEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Stage == "" {
+		event.Stage = step.Stage
+	}
+	if event.Script == "" && event.Type != eventStageStart && event.Type != eventStageEnd {
+		event.Script = step.Script
+	}
+	r.mu.Lock()
+	if event.Type == eventPackage {
+		r.packages = append(r.packages, event)
+	}
+	if r.eventLog != nil {
+		if err := writeEvent(r.eventLog, event); err != nil {
+			fmt.Fprintf(r.stderr, "Warning: error writing event log: %v\n", err)
+		}
+	}
+	r.mu.Unlock()
+	r.emit(runnerEvent{Kind: "event", Index: index, Step: step, Event: event})
+}
+
+// writePackageSummary lists the packages installed one by one, as
+// aur-pkgs.sh does, and which of them failed. A retried package counts once
+// with its last result.
+func (r *stageRunner) writePackageSummary() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.packages) == 0 {
+		return
+	}
+	var names []string
+	codes := make(map[string]int)
+	for _, event := range r.packages {
+		if _, seen := codes[event.Message]; !seen {
+			names = append(names, event.Message)
+		}
+		codes[event.Message] = 0
+		if event.ExitCode != nil {
+			codes[event.Message] = *event.ExitCode
+		}
+	}
+	var failed []string
+	for _, name := range names {
+		if codes[name] != 0 {
+			failed = append(failed, fmt.Sprintf("%s (exit %d)", name, codes[name]))
+		}
+	}
+	fmt.Fprintf(r.stdout, "Packages: %d installed, %d failed\n", len(names)-len(failed), len(failed))
+	if len(failed) > 0 {
+		fmt.Fprintf(r.stdout, "Failed packages: %s\n", strings.Join(failed, ", "))
+	}
+}
+
+// runAttempt runs one script with the write end of the event pipe as fd 3
+func (r *stageRunner) runAttempt(index int, step installStep) (timedOut bool, err error) {
+	if step.Builtin {
+		return false, builtinSteps[step.Script](r, index, step)
+	}
+
+	events, eventWriter, err := os.Pipe()
+	if err != nil {
+		return false, fmt.Errorf("error creating event pipe: %v", err)
+	}
+	defer events.Close()
+
+	cmd := exec.Command("/bin/bash", step.Path)
+	cmd.Env = append(r.environment(), fmt.Sprintf("%s=%d", eventFDEnv, eventFD))
+	cmd.Stdout = r.stdout
+	cmd.Stderr = r.stderr
+	cmd.ExtraFiles = []*os.File{eventWriter}
+	// A process group of its own so an abort reaches the script's children
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	r.mu.Lock()
+	err = cmd.Start()
+	if err == nil {
+		r.current = cmd
+	}
+	r.mu.Unlock()
+	// The script holds the write end now, closing ours ends the decoder
+	// once the script and its children exit.
+	eventWriter.Close()
+	if err != nil {
+		return false, err
+	}
+	stopTimeout := r.startTimeout(step, cmd.Process.Pid, &timedOut)
+
+	decoded := make(chan struct{})
+	go func() {
+		decodeEvents(events, func(event installEvent) { r.recordEvent(index, step, event) })
+		close(decoded)
+	}()
+
+	err = cmd.Wait()
+	stopTimeout()
+	r.mu.Lock()
+	r.current = nil
+	timedOut = timedOut && err != nil
+	r.mu.Unlock()
+
+	// Background children may keep the pipe open, do not wait on them forever
+	select {
+	case <-decoded:
+	case <-time.After(2 * time.Second):
+	}
+	return timedOut, err
+}
+
+// shellConfigNames renames the answers that would replace variables of the
+// shells running the scripts: SHELL, EDITOR and MAKEFLAGS are choices for
+// the target, not for the live system.
+var shellConfigNames = map[string]string{
+	"SHELL":     "LOGIN_SHELL",
+	"EDITOR":    "TARGET_EDITOR",
+	"MAKEFLAGS": "TARGET_MAKEFLAGS",
+}
+
+// writeShellConfig writes the answers as the KEY="value" file that lib.sh
+// reads and the scripts' set_option and get_config_value update. It holds
+// the passwords, so only root can read it.
+func writeShellConfig(answers map[string]string, filename string) error {
+	keys := make([]string, 0, len(answers))
+	for key := range answers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "AUTO_RUN=\"%t\"\n", answers["run_install"] == "true")
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	for _, key := range keys {
+		name := key
+		if shellConfigNames[key] != "" {
+			name = shellConfigNames[key]
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"\n", name, escaper.Replace(answers[key]))
+	}
+
+	file, err := createPrivateFile(filename)
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(b.String()); err != nil {
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	return nil
+}
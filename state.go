@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The state file is kept in the extracted install directory, next to the
+// disk image of an image install, and once the target is mounted on the
+// target itself so it survives with the disk. The configuration is kept next
+// to it there, a reboot loses the copy in the install directory.
+const (
+	stateFileName    = "install-state.json"
+	targetStateFile  = "/mnt/var/lib/arch-matic/" + stateFileName
+	targetConfigFile = "/mnt/var/lib/arch-matic/arch_config.toml"
+)
+
+const (
+	statusRunning   = "running"
+	statusCompleted = "completed"
+	statusFailed    = "failed"
+	statusAborted   = "aborted"
+)
+
+type stepState struct {
+	Stage    string     `json:"stage"`
+	Script   string     `json:"script"`
+	Status   string     `json:"status"`
+	ExitCode int        `json:"exit_code"`
+	Attempts int        `json:"attempts,omitempty"`
+	TimedOut bool       `json:"timed_out,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+type installState struct {
+	ConfigHash string      `json:"config_hash"`
+	Status     string      `json:"status"`
+	Started    time.Time   `json:"started"`
+	Updated    time.Time   `json:"updated"`
+	Steps      []stepState `json:"steps"`
+}
+
+// configHash identifies the configuration an installation was started with.
+// It hashes the answers as saving and loading the config returns them, so a
+// resumed install with the saved config gets the same hash.
+func configHash(answers map[string]string) string {
+	answers = normalizeConfig(answers)
+	keys := make([]string, 0, len(answers))
+	for key := range answers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s=%s\n", key, answers[key])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func newInstallState(answers map[string]string) *installState {
+	now := time.Now()
+	return &installState{
+		ConfigHash: configHash(answers),
+		Status:     statusRunning,
+		Started:    now,
+		Updated:    now,
+	}
+}
+
+// loadInstallState reads the state from the live system, falling back on
+// the copy on the target.
+func loadInstallState(stateFile string) (*installState, error) {
+	var lastErr error
+	for _, path := range []string{stateFile, targetStateFile} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var state installState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("error decoding %s: %v", path, err)
+		}
+		return &state, nil
+	}
+	return nil, fmt.Errorf("no install state found: %v", lastErr)
+}
+
+func (s *installState) save(stateFile string) error {
+	s.Updated = time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding install state: %v", err)
+	}
+
+	if err := os.WriteFile(stateFile, data, 0644); err != nil {
+		return fmt.Errorf("error writing install state: %v", err)
+	}
+	if isMountpoint("/mnt") {
+		if err := os.MkdirAll(filepath.Dir(targetStateFile), 0755); err != nil {
+			return fmt.Errorf("error creating %s: %v", filepath.Dir(targetStateFile), err)
+		}
+		if err := os.WriteFile(targetStateFile, data, 0644); err != nil {
+			return fmt.Errorf("error writing install state to target: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *installState) find(step installStep) *stepState {
+	for i := range s.Steps {
+		if s.Steps[i].Stage == step.Stage && s.Steps[i].Script == step.Script {
+			return &s.Steps[i]
+		}
+	}
+	return nil
+}
+
+func (s *installState) completed(step installStep) bool {
+	st := s.find(step)
+	return st != nil && st.Status == statusCompleted
+}
+
+func (s *installState) begin(step installStep) {
+	st := s.find(step)
+	if st == nil {
+		s.Steps = append(s.Steps, stepState{Stage: step.Stage, Script: step.Script})
+		st = &s.Steps[len(s.Steps)-1]
+	}
+	st.Status = statusRunning
+	st.ExitCode = 0
+	st.Attempts = 0
+	st.TimedOut = false
+	st.Started = time.Now()
+	st.Finished = nil
+	s.Status = statusRunning
+}
+
+func (s *installState) attempt(step installStep, attempt int) {
+	if st := s.find(step); st != nil {
+		st.Attempts = attempt
+	}
+}
+
+func (s *installState) timedOut(step installStep) {
+	if st := s.find(step); st != nil {
+		st.TimedOut = true
+	}
+}
+
+func (s *installState) finish(step installStep, exitCode int) {
+	st := s.find(step)
+	if st == nil {
+		return
+	}
+	now := time.Now()
+	st.Finished = &now
+	st.ExitCode = exitCode
+	if exitCode == 0 {
+		st.Status = statusCompleted
+	} else {
+		st.Status = statusFailed
+		s.Status = statusFailed
+	}
+}
+
+// abort marks the install, and the step that was interrupted, as aborted.
+// Aborted steps are not completed so resuming runs them again.
+func (s *installState) abort(step *installStep) {
+	s.Status = statusAborted
+	if step == nil {
+		return
+	}
+	if st := s.find(*step); st != nil {
+		st.Status = statusAborted
+	}
+}
+
+// verifyResume checks that a previous run can be continued: the config must
+// be unchanged, and once the drive stage has completed the target has to be
+// mounted again since partitioning and formatting will not be rerun.
+func (s *installState) verifyResume(answers map[string]string) error {
+	if s.ConfigHash != configHash(answers) {
+		return fmt.Errorf("configuration changed since the interrupted install, start a new install instead")
+	}
+
+	driveDone := false
+	for _, st := range s.Steps {
+		if st.Stage >= "2-drive" && st.Status == statusCompleted {
+			driveDone = true
+		}
+	}
+	if !driveDone {
+		return nil
+	}
+
+	root, ok := findMount("/mnt")
+	if !ok {
+		return fmt.Errorf("/mnt is not mounted, mount the target filesystems before resuming")
+	}
+	if answers["LUKS"] != "true" && answers["PARTITION_ROOT"] != "" && root.Source != answers["PARTITION_ROOT"] {
+		return fmt.Errorf("/mnt is mounted from %s, expected %s", root.Source, answers["PARTITION_ROOT"])
+	}
+	if answers["BIOS_TYPE"] != "bios" && !isMountpoint("/mnt/boot/efi") {
+		return fmt.Errorf("/mnt/boot/efi is not mounted, mount the EFI partition before resuming")
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSkipCompleted(t *testing.T) {
+	done := installStep{Stage: "5-desktop", Script: "desktop.sh"}
+	failed := installStep{Stage: "6-final", Script: "last-cleanup.sh"}
+	fresh := installStep{Stage: "7-post-setup", Script: "post-setup.sh"}
+
+	state := newInstallState(map[string]string{"HOSTNAME": "arch"})
+	state.begin(done)
+	state.finish(done, 0)
+	state.begin(failed)
+	state.finish(failed, 1)
+
+	tests := []struct {
+		name    string
+		resume  bool
+		partial bool
+		step    installStep
+		want    bool
+	}{
+		{"resume skips completed", true, false, done, true},
+		{"resume reruns failed", true, false, failed, false},
+		{"resume runs new", true, false, fresh, false},
+		{"partial reruns completed", false, true, done, false},
+		{"full run reruns completed", false, false, done, false},
+	}
+	for _, tt := range tests {
+		r := &stageRunner{resume: tt.resume, partial: tt.partial}
+		if got := r.skipCompleted(state, tt.step); got != tt.want {
+			t.Errorf("%s: skipCompleted(%s) = %v, want %v", tt.name, tt.step, got, tt.want)
+		}
+	}
+}
+
+func TestLoadStatePartialKeepsPreviousState(t *testing.T) {
+	answers := map[string]string{"HOSTNAME": "arch"}
+	dir := t.TempDir()
+	previous := newInstallState(answers)
+	step := installStep{Stage: "5-desktop", Script: "desktop.sh"}
+	previous.begin(step)
+	previous.finish(step, 0)
+	previous.Status = statusCompleted
+	if err := previous.save(filepath.Join(dir, stateFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &stageRunner{stateFile: filepath.Join(dir, stateFileName), answers: answers, partial: true}
+	state, err := r.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.completed(step) {
+		t.Errorf("partial run lost the steps of the previous state")
+	}
+	if r.skipCompleted(state, step) {
+		t.Errorf("partial run skips %s", step)
+	}
+
+	r.answers = map[string]string{"HOSTNAME": "other"}
+	if state, _ := r.loadState(); state.completed(step) {
+		t.Errorf("partial run with another config reused the previous state")
+	}
+}
+
+func TestVerifyResumeConfigChanged(t *testing.T) {
+	state := newInstallState(map[string]string{"HOSTNAME": "arch"})
+	if err := state.verifyResume(map[string]string{"HOSTNAME": "other"}); err == nil {
+		t.Errorf("verifyResume accepted a changed configuration")
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// verifyStepName is the built-in step of 6-final that checks the installed
+// system once last-cleanup.sh has run.
+const verifyStepName = "verify-install"
+
+// cleanupServices mirrors enable_services in last-cleanup.sh: each service
+// is enabled only when the package providing it is installed. The display
+// manager and services of the desktop profile are enabled as well.
+var cleanupServices = []struct{ Name, Package string }{
+	{"NetworkManager", "networkmanager"},
+	{"sshd", "openssh"},
+	{"cronie", "cronie"},
+	{"bluetooth", "bluez"},
+}
+
+// baseServices lists the cleanupServices whose package the install puts on
+// the target
+func baseServices(answers map[string]string) []string {
+	installed := strings.Fields(answers["SYSTEM_PACKAGES"] + " " + answers["USER_PACKAGES"] + " " + answers["DESKTOP_PACKAGES"])
+	var services []string
+	for _, service := range cleanupServices {
+		if containsString(installed, service.Package) {
+			services = append(services, service.Name)
+		}
+	}
+	return services
+}
+
+// desktopServices lists the services last-cleanup.sh enables for the
+// desktop profile
+func desktopServices(answers map[string]string) []string {
+	return strings.Fields(answers["DISPLAY_MANAGER"] + " " + answers["DESKTOP_SERVICES"])
+}
+
+// enabledServices lists every service the install scripts enable
+func enabledServices(answers map[string]string) []string {
+	services := baseServices(answers)
+	services = append(services, desktopServices(answers)...)
+	return append(services, strings.Fields(answers["GUEST_SERVICES"])...)
+}
+
+type verifyCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+}
+
+// verifier inspects an installed system mounted at root
+type verifier struct {
+	root    string
+	answers map[string]string
+	checks  []verifyCheck
+}
+
+func (v *verifier) check(name string, passed bool, format string, args ...interface{}) {
+	v.checks = append(v.checks, verifyCheck{Name: name, Passed: passed, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (v *verifier) path(name string) string {
+	return filepath.Join(v.root, name)
+}
+
+func (v *verifier) exists(name string) bool {
+	_, err := os.Stat(v.path(name))
+	return err == nil
+}
+
+// checkFile passes when the file exists in the installed system
+func (v *verifier) checkFile(name, file string) {
+	if v.exists(file) {
+		v.check(name, true, "/%s", file)
+	} else {
+		v.check(name, false, "/%s is missing", file)
+	}
+}
+
+func (v *verifier) value(key, fallback string) string {
+	if v.answers[key] != "" {
+		return v.answers[key]
+	}
+	return fallback
+}
+
+// verifyInstall runs every check against the system mounted at root
+func verifyInstall(root string, answers map[string]string) []verifyCheck {
+	v := &verifier{root: root, answers: answers}
+	v.checkFstab()
+	v.checkESP()
+	v.checkBootloader()
+	v.checkKernels()
+	v.checkUser()
+	v.checkAUR()
+	v.checkPackageSources()
+	v.checkServices()
+	v.checkSystemFiles()
+	return v.checks
+}
+
+// resolveDevice finds the device behind an fstab source such as UUID=...,
+// falling back on blkid where udev has not created the by-* links.
+func resolveDevice(source string) (string, bool) {
+	links := map[string]string{"UUID": "by-uuid", "PARTUUID": "by-partuuid", "LABEL": "by-label", "PARTLABEL": "by-partlabel"}
+	key, value, found := strings.Cut(source, "=")
+	if !found {
+		_, err := os.Stat(source)
+		return source, err == nil
+	}
+	if links[key] == "" {
+		return "", false
+	}
+	if device, err := filepath.EvalSymlinks(filepath.Join("/dev/disk", links[key], value)); err == nil {
+		return device, true
+	}
+	output, err := exec.Command("blkid", "-l", "-o", "device", "-t", source).Output()
+	if err != nil || strings.TrimSpace(string(output)) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(string(output)), true
+}
+
+func (v *verifier) checkFstab() {
+	file, err := os.Open(v.path("etc/fstab"))
+	if err != nil {
+		v.check("fstab", false, "%v", err)
+		return
+	}
+	defer file.Close()
+
+	hasRoot, hasSwap := false, false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		source, target, fsType := fields[0], fields[1], fields[2]
+		if target == "/" {
+			hasRoot = true
+		}
+		if !strings.Contains(source, "=") && !strings.HasPrefix(source, "/dev/") {
+			continue // tmpfs, proc and the like have no device
+		}
+		if fsType == "swap" {
+			target = "swap"
+			hasSwap = true
+		}
+		if device, ok := resolveDevice(source); ok {
+			v.check("fstab "+target, true, "%s is %s", source, device)
+		} else {
+			v.check("fstab "+target, false, "%s does not resolve to a device", source)
+		}
+	}
+	if !hasRoot {
+		v.check("fstab /", false, "no entry for the root filesystem")
+	}
+	if v.answers["SWAP_SIZE"] != "" && !hasSwap {
+		v.check("fstab swap", false, "no entry for the %s swap partition", v.answers["SWAP_SIZE"])
+	}
+}
+
+func (v *verifier) checkESP() {
+	if v.answers["BIOS_TYPE"] == "bios" {
+		return
+	}
+	esp := v.path("boot/efi")
+	if !isMountpoint(esp) {
+		v.check("ESP", false, "%s is not mounted", esp)
+		return
+	}
+	entries, err := os.ReadDir(filepath.Join(esp, "EFI"))
+	if err != nil || len(entries) == 0 {
+		v.check("ESP", false, "%s/EFI is empty", esp)
+		return
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	v.check("ESP", true, "%s mounted, EFI/%s", esp, strings.Join(names, ", EFI/"))
+}
+
+// checkBootloader mirrors generate-fstab.sh, and secure-boot.sh when UKIs
+// are built.
+func (v *verifier) checkBootloader() {
+	grubCfg, err := os.ReadFile(v.path("boot/grub/grub.cfg"))
+	switch {
+	case err != nil:
+		v.check("GRUB config", false, "%v", err)
+	case !strings.Contains(string(grubCfg), "menuentry"):
+		v.check("GRUB config", false, "/boot/grub/grub.cfg has no menu entries")
+	default:
+		v.check("GRUB config", true, "/boot/grub/grub.cfg has %d menu entries", strings.Count(string(grubCfg), "\nmenuentry "))
+	}
+
+	if v.answers["BIOS_TYPE"] != "bios" {
+		loader := "boot/efi/EFI/GRUB/grubx64.efi"
+		if v.answers["TARGET_IMAGE"] != "" {
+			loader = "boot/efi/EFI/BOOT/BOOTX64.EFI" // grub-install --removable
+		}
+		v.checkFile("GRUB loader", loader)
+	}
+	if v.answers["UKI"] == "true" || v.answers["SECURE_BOOT"] == "true" {
+		for _, kernel := range strings.Fields(v.value("KERNELS", "linux")) {
+			uki := "boot/efi/EFI/Linux/arch-" + kernel + ".efi"
+			v.checkFile("UKI "+kernel, uki)
+		}
+	}
+}
+
+func (v *verifier) checkKernels() {
+	for _, kernel := range strings.Fields(v.value("KERNELS", "linux")) {
+		image := "boot/vmlinuz-" + kernel
+		v.checkFile("kernel "+kernel, image)
+		// GRUB boots the initramfs images, UKIs are built next to them
+		initramfs := "boot/initramfs-" + kernel + ".img"
+		v.checkFile("initramfs "+kernel, initramfs)
+	}
+}
+
+func (v *verifier) checkUser() {
+	username := v.answers["USERNAME"]
+	shell := v.value("SHELL", "bash")
+	data, err := os.ReadFile(v.path("etc/passwd"))
+	if err != nil {
+		v.check("user "+username, false, "%v", err)
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 || fields[0] != username {
+			continue
+		}
+		loginShell := fields[6]
+		if filepath.Base(loginShell) != shell {
+			v.check("user "+username, false, "login shell is %s, expected %s", loginShell, shell)
+		} else if !v.exists(loginShell) {
+			v.check("user "+username, false, "login shell %s is not installed", loginShell)
+		} else {
+			v.check("user "+username, true, "home %s, shell %s", fields[5], loginShell)
+		}
+		return
+	}
+	v.check("user "+username, false, "not in /etc/passwd")
+}
+
+// checkAUR looks for the AUR helper and makes sure the passwordless sudo
+// rule of aur-pkgs.sh is gone.
+func (v *verifier) checkAUR() {
+	helper := v.answers["AUR_HELPER"]
+	if helper == "" || helper == "none" {
+		return
+	}
+	v.checkFile("aur helper", "usr/bin/"+helper)
+	dropIn := strings.TrimPrefix(aurSudoersDropIn, "/mnt/")
+	if v.exists(dropIn) {
+		v.check("sudoers", false, "/%s is still present", dropIn)
+	} else {
+		v.check("sudoers", true, "no passwordless sudo left from aur-pkgs.sh")
+	}
+}
+
+// checkPackageSources makes sure the target does not depend on the local
+// repository or the ISO cache, which are gone once it boots.
+func (v *verifier) checkPackageSources() {
+	local := v.answers["LOCAL_REPO"]
+	if local == "" && v.answers["REUSE_ISO_CACHE"] != "true" {
+		return
+	}
+	var problems []string
+	mirrorlist, _ := os.ReadFile(v.path("etc/pacman.d/mirrorlist"))
+	if local != "" && strings.Contains(string(mirrorlist), localRepoServer(local)) {
+		problems = append(problems, "mirrorlist still uses "+local)
+	}
+	pacmanConf, _ := os.ReadFile(v.path("etc/pacman.conf"))
+	if strings.Contains(string(pacmanConf), isoCacheMarker) {
+		problems = append(problems, "pacman.conf still uses the ISO cache")
+	}
+	for _, dir := range []string{local, targetISOCache} {
+		if dir != "" && isMountpoint(v.path(dir)) {
+			problems = append(problems, dir+" is still mounted")
+		}
+	}
+	if len(problems) > 0 {
+		v.check("package sources", false, "%s", strings.Join(problems, ", "))
+	} else {
+		v.check("package sources", true, "no local repository or ISO cache left in the pacman configuration")
+	}
+}
+
+func (v *verifier) checkServices() {
+	for _, service := range enabledServices(v.answers) {
+		unit := service
+		if !strings.Contains(unit, ".") {
+			unit += ".service"
+		}
+		link := v.enabledLink(unit)
+		if link == "" {
+			v.check("service "+service, false, "not enabled")
+			continue
+		}
+		unitFile := v.readLink(link)
+		if !filepath.IsAbs(unitFile) {
+			unitFile = filepath.Join(filepath.Dir(link), unitFile)
+		}
+		if !v.exists(unitFile) {
+			v.check("service "+service, false, "%s points to missing %s", link, unitFile)
+			continue
+		}
+		v.check("service "+service, true, "enabled by %s", link)
+	}
+}
+
+// enabledLink finds the symlink systemctl enable created for unit, either
+// in a .wants directory or as an alias such as display-manager.service.
+func (v *verifier) enabledLink(unit string) string {
+	links, _ := filepath.Glob(v.path("etc/systemd/system/*.wants/" + unit))
+	if len(links) > 0 {
+		return strings.TrimPrefix(links[0], v.root)
+	}
+	aliases, _ := filepath.Glob(v.path("etc/systemd/system/*"))
+	for _, alias := range aliases {
+		link := strings.TrimPrefix(alias, v.root)
+		if filepath.Base(v.readLink(link)) == unit {
+			return link
+		}
+	}
+	return ""
+}
+
+// readLink resolves a symlink of the installed system inside root
+func (v *verifier) readLink(name string) string {
+	target, err := os.Readlink(v.path(name))
+	if err != nil {
+		return ""
+	}
+	return target
+}
+
+func (v *verifier) checkSystemFiles() {
+	hostname, _ := os.ReadFile(v.path("etc/hostname"))
+	v.check("hostname", strings.TrimSpace(string(hostname)) == v.answers["HOSTNAME"],
+		"/etc/hostname is %q, expected %q", strings.TrimSpace(string(hostname)), v.answers["HOSTNAME"])
+
+	localeConf, _ := os.ReadFile(v.path("etc/locale.conf"))
+	lang := ""
+	for _, line := range strings.Split(string(localeConf), "\n") {
+		if value, found := strings.CutPrefix(line, "LANG="); found {
+			lang = strings.Trim(value, `"`)
+		}
+	}
+	v.check("locale", lang == v.answers["LOCALE"], "LANG is %q, expected %q", lang, v.answers["LOCALE"])
+
+	zone := v.readLink("etc/localtime")
+	v.check("timezone", strings.HasSuffix(zone, "/zoneinfo/"+v.answers["TIMEZONE"]) && v.exists(filepath.Join("usr/share/zoneinfo", v.answers["TIMEZONE"])),
+		"/etc/localtime points to %q, expected %s", zone, v.answers["TIMEZONE"])
+}
+
+func failedChecks(checks []verifyCheck) int {
+	failed := 0
+	for _, check := range checks {
+		if !check.Passed {
+			failed++
+		}
+	}
+	return failed
+}
+
+func writeChecks(w io.Writer, checks []verifyCheck) {
+	for _, check := range checks {
+		result := "PASS"
+		if !check.Passed {
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "  [%s] %s: %s\n", result, check.Name, check.Detail)
+	}
+}
+
+// verifyStep is the verify-install step: every check is reported as a
+// check event and any failed check fails the step.
+func (r *stageRunner) verifyStep(index int, step installStep) error {
+	if r.dryRun {
+		fmt.Fprintln(r.stdout, "[DRY RUN] Would verify fstab, ESP, bootloader, kernels, user, services, hostname, locale and timezone in /mnt")
+		return nil
+	}
+
+	fmt.Fprintln(r.stdout, "==> Verifying the installation in /mnt")
+	checks := verifyInstall("/mnt", r.answers)
+	writeChecks(r.stdout, checks)
+	for _, check := range checks {
+		passed := check.Passed
+		r.recordEvent(index, step, installEvent{Type: eventCheck, Name: check.Name, Message: check.Detail, Passed: &passed})
+	}
+	if failed := failedChecks(checks); failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	fmt.Fprintf(r.stdout, "==> All %d checks passed\n", len(checks))
+	return nil
+}
+
+// runVerify implements "arch-matic verify", checking an installed system
+// without running the install.
+func runVerify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	configFile := flags.String("config", filepath.Join("install", "arch_config.toml"), "Configuration the system was installed with")
+	root := flags.String("root", "/mnt", "Where the installed system is mounted")
+	format := flags.String("format", "text", "Output format: text or json")
+	flags.Parse(args)
+	if *format != "text" && *format != "json" {
+		fmt.Printf("Error: unknown format %q, use text or json\n", *format)
+		os.Exit(1)
+	}
+
+	answers, err := loadTOMLConfig(*configFile)
+	if err != nil {
+		fmt.Printf("Error loading %s: %v\n", *configFile, err)
+		os.Exit(1)
+	}
+
+	checks := verifyInstall(*root, answers)
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(checks)
+	} else {
+		writeChecks(os.Stdout, checks)
+		fmt.Printf("%d of %d checks passed\n", len(checks)-failedChecks(checks), len(checks))
+	}
+	if failedChecks(checks) > 0 {
+		os.Exit(1)
+	}
+}